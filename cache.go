@@ -0,0 +1,153 @@
+package function
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+// reportTables are the reports read often enough to cache, each is an
+// aggregate over the purchases
+var reportTables = map[string]bool{
+	"dashboard_summary":      true,
+	"registration_summary":   true,
+	"shirt_summary":          true,
+	"club_summary":           true,
+	"registration_breakdown": true,
+	"registration_detail":    true,
+}
+
+const defaultReportCacheTTL = 10 * time.Second
+
+// maxReportCacheEntries bounds the cache, the read filters are part of the key
+// and come from the request
+const maxReportCacheEntries = 1000
+
+type cachedReport struct {
+	resp    handler.Response
+	etag    string
+	expires time.Time
+}
+
+// reportCache keeps report responses for report_cache_ttl, 10s by default and
+// off when 0. Any request other than a read empties it, so checkouts,
+// cancellations and every other change show on the next poll. The cache is
+// per instance, another instance's writes show once the ttl has passed.
+type reportCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedReport
+	// generation counts the invalidations, a report computed across one is
+	// not stored
+	generation uint64
+}
+
+var reports = &reportCache{entries: map[string]cachedReport{}}
+
+func reportCacheTTL() time.Duration {
+	ttl, err := envDuration("report_cache_ttl", defaultReportCacheTTL)
+	if err != nil {
+		logger.Warn().Str("error", err.Error()).Msg("report cache")
+		return defaultReportCacheTTL
+	}
+	return ttl
+}
+
+// reportCacheKey is the key of a cacheable report request, the filters and
+// format of the read and the caller it is for. Exports are streamed and not
+// cached.
+func reportCacheKey(req handler.Request, d Data) (string, bool) {
+	if strings.ToLower(d.Action) != "read" || !reportTables[strings.ToLower(d.Table)] || exportable(d) {
+		return "", false
+	}
+	return strings.Join([]string{
+		strings.ToLower(d.Action),
+		strings.ToLower(d.Table),
+		d.Read.Field,
+		d.Read.Value,
+		strings.ToLower(d.Format),
+		strconv.FormatBool(d.IncludeDeleted),
+		strings.ToLower(strings.TrimSpace(req.Header.Get("email"))),
+	}, "\x00"), true
+}
+
+// lookup returns the cached response of key, or 304 Not Modified when
+// ifNoneMatch holds its etag
+func (c *reportCache) lookup(key, ifNoneMatch string) (handler.Response, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return handler.Response{}, c.generation, false
+	}
+	return e.response(ifNoneMatch), c.generation, true
+}
+
+// store caches resp under key unless the cache was invalidated since
+// generation, and returns it with its etag
+func (c *reportCache) store(key string, generation uint64, resp handler.Response, ifNoneMatch string, ttl time.Duration) handler.Response {
+	sum := sha256.Sum256(resp.Body)
+	e := cachedReport{
+		resp:    resp,
+		etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+		expires: time.Now().Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl > 0 && c.generation == generation {
+		if len(c.entries) >= maxReportCacheEntries {
+			now := time.Now()
+			for k, v := range c.entries {
+				if now.After(v.expires) {
+					delete(c.entries, k)
+				}
+			}
+		}
+		if len(c.entries) < maxReportCacheEntries {
+			c.entries[key] = e
+		}
+	}
+	return e.response(ifNoneMatch)
+}
+
+// invalidate empties the cache
+func (c *reportCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = map[string]cachedReport{}
+}
+
+// response is a copy of the cached response carrying its etag, with no body
+// when ifNoneMatch already has it
+func (e cachedReport) response(ifNoneMatch string) handler.Response {
+	header := http.Header{}
+	for k, v := range e.resp.Header {
+		header[k] = v
+	}
+	header.Set("ETag", e.etag)
+	header.Set("Access-Control-Expose-Headers", "ETag")
+	if etagMatch(ifNoneMatch, e.etag) {
+		return handler.Response{StatusCode: http.StatusNotModified, Header: header}
+	}
+	return handler.Response{Body: e.resp.Body, StatusCode: e.resp.StatusCode, Header: header}
+}
+
+// etagMatch reports whether the If-None-Match header holds etag, weak
+// validators match their strong form
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
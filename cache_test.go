@@ -0,0 +1,98 @@
+package function
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+func TestReportCache(t *testing.T) {
+	c := &reportCache{entries: map[string]cachedReport{}}
+	resp, _ := structResponse(shirtSummary{Small: 2})
+
+	_, generation, ok := c.lookup("k", "")
+	if ok {
+		t.Fatal("empty cache hit")
+	}
+	stored := c.store("k", generation, resp, "", time.Minute)
+	etag := stored.Header.Get("ETag")
+	if etag == "" || string(stored.Body) != string(resp.Body) {
+		t.Fatalf("store returned %+v", stored)
+	}
+
+	hit, _, ok := c.lookup("k", "")
+	if !ok || string(hit.Body) != string(resp.Body) || hit.Header.Get("ETag") != etag {
+		t.Errorf("lookup = %+v, %v", hit, ok)
+	}
+	hit, _, _ = c.lookup("k", `"other", W/`+etag)
+	if hit.StatusCode != http.StatusNotModified || len(hit.Body) != 0 {
+		t.Errorf("If-None-Match with the etag got %v %s", hit.StatusCode, hit.Body)
+	}
+
+	// a report computed while the cache was invalidated is not kept
+	_, generation, _ = c.lookup("k2", "")
+	c.invalidate()
+	c.store("k2", generation, resp, "", time.Minute)
+	if _, _, ok := c.lookup("k", ""); ok {
+		t.Error("invalidate kept k")
+	}
+	if _, _, ok := c.lookup("k2", ""); ok {
+		t.Error("a report from before the invalidation was stored")
+	}
+
+	c.store("k3", c.generation, resp, "", 0)
+	if _, _, ok := c.lookup("k3", ""); ok {
+		t.Error("a ttl of 0 still caches")
+	}
+}
+
+func TestReportCacheKey(t *testing.T) {
+	req := handler.Request{Header: http.Header{}}
+	req.Header.Set("email", "Admin@Example.com")
+	d := Data{Action: "read", Table: "Shirt_Summary"}
+	k1, ok := reportCacheKey(req, d)
+	if !ok {
+		t.Fatal("shirt_summary is not cacheable")
+	}
+	req.Header.Set("email", "other@example.com")
+	if k2, _ := reportCacheKey(req, d); k1 == k2 {
+		t.Error("two callers share a cache key")
+	}
+	if _, ok := reportCacheKey(req, Data{Action: "read", Table: "customer"}); ok {
+		t.Error("customer reads are cached")
+	}
+}
+
+func TestHandleServesCachedReports(t *testing.T) {
+	captureLogs(t, "error")
+	withoutDatabase(t, errors.New("refused"))
+	savedReports := reports
+	reports = &reportCache{entries: map[string]cachedReport{}}
+	t.Cleanup(func() { reports = savedReports })
+
+	req := handler.Request{Body: []byte(`{"action":"read","table":"club_summary"}`), Header: http.Header{}}
+	key, _ := reportCacheKey(req, Data{Action: "read", Table: "club_summary"})
+	want, _ := structResponse(clubSummary{LeftHanded: 1})
+	etag := reports.store(key, reports.generation, want, "", time.Minute).Header.Get("ETag")
+
+	// the database is unreachable, so only the cache can answer
+	resp, err := Handle(req)
+	if err != nil || string(resp.Body) != string(want.Body) {
+		t.Fatalf("Handle = %s, %v", resp.Body, err)
+	}
+	req.Header.Set("If-None-Match", etag)
+	resp, err = Handle(req)
+	if err != nil || resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Handle with If-None-Match = %v, %v", resp.StatusCode, err)
+	}
+
+	// a change empties the cache
+	Handle(handler.Request{Body: []byte(`{"action":"cancel_order"}`)})
+	_, err = Handle(handler.Request{Body: []byte(`{"action":"read","table":"club_summary"}`)})
+	if err == nil {
+		t.Error("the report was still cached after a cancellation")
+	}
+}
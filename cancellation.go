@@ -0,0 +1,209 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+type refund struct {
+	RefundID     int        `json:"refundid"`
+	SalesOrderID int        `json:"salesorderid"`
+	PurchaseID   int        `json:"purchaseid"`
+	Amount       string     `json:"amount"`
+	Reason       string     `json:"reason"`
+	RefundedAt   time.Time  `json:"refundedat"`
+	DeletedAt    *time.Time `json:"deletedat,omitempty"`
+}
+
+// scan reads a refund from a row of select *, as readall answers it
+func (r *refund) scan(rows pgx.Rows) error {
+	return rows.Scan(&r.RefundID, &r.SalesOrderID, &r.PurchaseID, &r.Amount, &r.Reason, &r.RefundedAt, &r.DeletedAt)
+}
+
+func (r *refund) readall(db Querier, table string, includeDeleted bool) ([]refund, error) {
+	var re refund
+	var rl []refund
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := re.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		rl = append(rl, re)
+	}
+	return rl, nil
+}
+
+func (r *refund) read(db Querier, table, field, value string, includeDeleted bool) ([]refund, error) {
+	var re refund
+	var rl []refund
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, sanitizeColumn(field), deletedFilter(includeDeleted))
+	rows, err := db.Query(context.Background(), query, value)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := re.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		rl = append(rl, re)
+	}
+	return rl, nil
+}
+
+// cancel_order request, without ParticipantIDs every participant still on
+// the salesorder is cancelled. Amount overrides the refund, which otherwise
+// is the purchase price pro rata of the cancelled participants, and can only
+// be given when the cancellation touches a single purchase.
+type cancelOrder struct {
+	SalesOrderID   int      `json:"salesorderid"`
+	ParticipantIDs []string `json:"participantids"`
+	Amount         string   `json:"amount"`
+	Reason         string   `json:"reason"`
+}
+
+type cancellation struct {
+	SalesOrderID int        `json:"salesorderid"`
+	Participants []string   `json:"participants"`
+	Refunds      []refund   `json:"refunds"`
+	Promoted     []waitlist `json:"promoted"`
+}
+
+// cancel marks the participants cancelled and refunds their purchases in one
+// transaction, then offers the freed seats to the events' waitlists
+func (co cancelOrder) cancel(db Querier) (cancellation, error) {
+	c := cancellation{SalesOrderID: co.SalesOrderID}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return c, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var salesorderid int
+	err = tx.QueryRow(context.Background(),
+		"select salesorderid from salesorder where salesorderid = $1 and deleted_at is null for update", co.SalesOrderID,
+	).Scan(&salesorderid)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c, fmt.Errorf("cancel_order: salesorder %v not found", co.SalesOrderID)
+	case err != nil:
+		return c, fmt.Errorf("cancel_order salesorder: %v", err)
+	}
+
+	exec := fmt.Sprintf(`
+	update participant pa set cancelledat = now()
+	from purchase pu
+	where pu.purchaseid = pa.purchaseid
+	and pu.salesorderid = $1
+	and pa.cancelledat is null
+	and (coalesce(cardinality($2::text[]), 0) = 0 or pa.participantid::text = any($2))
+	returning pa.participantid::text`)
+	rows, err := tx.Query(context.Background(), exec, co.SalesOrderID, co.ParticipantIDs)
+	if err != nil {
+		return c, fmt.Errorf("cancel_order participant: %v", err)
+	}
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return c, fmt.Errorf("cancel_order participant scan: %v", err)
+		}
+		c.Participants = append(c.Participants, id)
+	}
+	rows.Close()
+	if len(c.Participants) == 0 {
+		return c, errors.New("cancel_order: no active participants to cancel")
+	}
+
+	var amount interface{}
+	if co.Amount != "" {
+		amount = co.Amount
+	}
+	exec = fmt.Sprintf(`
+	insert into refund(salesorderid, purchaseid, amount, reason, refundedat)
+	select pu.salesorderid, pu.purchaseid,
+			coalesce($3::money, pu.price * pc.cancelled / pc.total), $4, now()
+	from purchase pu
+	inner join (
+			select purchaseid,
+					count(*) filter (where participantid::text = any($2)) as cancelled,
+					count(*) as total
+			from participant
+			group by purchaseid
+	) pc on pc.purchaseid = pu.purchaseid
+	where pu.salesorderid = $1 and pc.cancelled > 0
+	returning refundid, salesorderid, purchaseid, amount, reason, refundedat`)
+	rows, err = tx.Query(context.Background(), exec, co.SalesOrderID, c.Participants, amount, co.Reason)
+	if err != nil {
+		return c, fmt.Errorf("cancel_order refund: %v", err)
+	}
+	for rows.Next() {
+		var re refund
+		err := rows.Scan(&re.RefundID, &re.SalesOrderID, &re.PurchaseID, &re.Amount, &re.Reason, &re.RefundedAt)
+		if err != nil {
+			rows.Close()
+			return c, fmt.Errorf("cancel_order refund scan: %v", err)
+		}
+		c.Refunds = append(c.Refunds, re)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return c, fmt.Errorf("cancel_order refund: %v", rows.Err())
+	}
+	if amount != nil && len(c.Refunds) > 1 {
+		return c, errors.New("cancel_order: amount spans several purchases, cancel them one at a time")
+	}
+
+	err = tx.Commit(context.Background())
+	if err != nil {
+		return c, err
+	}
+
+	// the cancelled seats count as free again, give them to the waitlist
+	exec = fmt.Sprintf(`
+	select distinct pk.eventid
+	from purchase pu
+	inner join pricing p on p.pricingid = pu.pricingid
+	inner join package pk on pk.productid = p.productid
+	where pu.salesorderid = $1`)
+	rows, err = db.Query(context.Background(), exec, co.SalesOrderID)
+	if err != nil {
+		return c, fmt.Errorf("cancel_order events: %v", err)
+	}
+	var events []int
+	for rows.Next() {
+		var eventID int
+		err := rows.Scan(&eventID)
+		if err != nil {
+			rows.Close()
+			return c, fmt.Errorf("cancel_order events scan: %v", err)
+		}
+		events = append(events, eventID)
+	}
+	rows.Close()
+
+	for _, eventID := range events {
+		for {
+			w, err := promoteWaitlist(db, eventID)
+			if err != nil {
+				return c, fmt.Errorf("cancel_order: order cancelled but waitlist promotion failed: %v", err)
+			}
+			if w == nil {
+				break
+			}
+			c.Promoted = append(c.Promoted, *w)
+		}
+	}
+	return c, nil
+}
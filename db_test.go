@@ -0,0 +1,301 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// The integration tests run against a throwaway postgres. TEST_DATABASE_URL
+// points them at an existing, disposable, database, otherwise a cluster is
+// created with the initdb and pg_ctl found in PG_BIN, on PATH or under
+// /usr/lib/postgresql. Without either the tests that need a database skip.
+var (
+	testDSN   string
+	testDBErr error
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	stop := func() {}
+	if testing.Short() {
+		testDBErr = errors.New("short mode")
+	} else {
+		testDSN, stop, testDBErr = startTestDB()
+	}
+	if testDBErr == nil {
+		testDBErr = migrateTestDB()
+	}
+
+	if !testing.Verbose() {
+		logger = newLogger(io.Discard, "")
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	authenticate = func(handler.Request) error { return nil }
+	connect = func(context.Context) (*pgxpool.Pool, error) {
+		if testDBErr != nil {
+			return nil, testDBErr
+		}
+		return pgxpool.Connect(context.Background(), testDSN)
+	}
+
+	code := m.Run()
+	stop()
+	os.Exit(code)
+}
+
+// withoutDatabase makes connecting fail with err for the rest of the test,
+// setting aside the pool an earlier test opened. It returns the number of
+// connections attempted.
+func withoutDatabase(t *testing.T, err error) *int {
+	t.Helper()
+	savedConnect, savedPool := connect, pool
+	attempts := 0
+	connect = func(context.Context) (*pgxpool.Pool, error) {
+		attempts++
+		return nil, err
+	}
+	pool = nil
+	t.Cleanup(func() { connect, pool = savedConnect, savedPool })
+	return &attempts
+}
+
+func startTestDB() (dsn string, stop func(), err error) {
+	stop = func() {}
+	if v := os.Getenv("TEST_DATABASE_URL"); v != "" {
+		return v, stop, nil
+	}
+
+	bin, err := postgresBin()
+	if err != nil {
+		return "", stop, err
+	}
+	dir, err := os.MkdirTemp("", "mojodomo-pg-")
+	if err != nil {
+		return "", stop, err
+	}
+	stop = func() { os.RemoveAll(dir) }
+	data := filepath.Join(dir, "data")
+
+	out, err := exec.Command(filepath.Join(bin, "initdb"),
+		"-D", data, "-U", "postgres", "-A", "trust", "--no-locale", "-E", "UTF8", "--no-sync",
+	).CombinedOutput()
+	if err != nil {
+		return "", stop, fmt.Errorf("initdb: %v: %s", err, out)
+	}
+
+	// listen on a unix socket in dir only, so parallel runs cannot collide
+	out, err = exec.Command(filepath.Join(bin, "pg_ctl"),
+		"-D", data, "-l", filepath.Join(dir, "log"), "-w",
+		"-o", fmt.Sprintf("-k %v -c listen_addresses='' -F", dir),
+		"start",
+	).CombinedOutput()
+	if err != nil {
+		return "", stop, fmt.Errorf("pg_ctl start: %v: %s", err, out)
+	}
+	stop = func() {
+		exec.Command(filepath.Join(bin, "pg_ctl"), "-D", data, "-m", "immediate", "-w", "stop").Run()
+		os.RemoveAll(dir)
+	}
+
+	dsn = fmt.Sprintf("host=%v user=postgres dbname=postgres sslmode=disable", dir)
+	db, err := pgx.Connect(context.Background(), dsn)
+	if err != nil {
+		return "", stop, err
+	}
+	defer db.Close(context.Background())
+	_, err = db.Exec(context.Background(), "create database mojodomo_test")
+	if err != nil {
+		return "", stop, err
+	}
+	return fmt.Sprintf("host=%v user=postgres dbname=mojodomo_test sslmode=disable", dir), stop, nil
+}
+
+// postgresBin finds the directory holding initdb and pg_ctl
+func postgresBin() (string, error) {
+	if v := os.Getenv("PG_BIN"); v != "" {
+		return v, nil
+	}
+	if p, err := exec.LookPath("pg_ctl"); err == nil {
+		return filepath.Dir(p), nil
+	}
+	found, _ := filepath.Glob("/usr/lib/postgresql/*/bin/pg_ctl")
+	if len(found) == 0 {
+		return "", errors.New("no postgres found, set TEST_DATABASE_URL or PG_BIN")
+	}
+	sort.Strings(found)
+	return filepath.Dir(found[len(found)-1]), nil
+}
+
+// migrateTestDB builds the schema with the embedded migrations
+func migrateTestDB() error {
+	db, err := pgx.Connect(context.Background(), testDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close(context.Background())
+	_, err = migrate{Direction: "up"}.run(db)
+	return err
+}
+
+// testDB returns a connection to the test database emptied of any rows, the
+// test skips when there is no database
+func testDB(t *testing.T) *pgx.Conn {
+	t.Helper()
+	if testDBErr != nil {
+		t.Skipf("no test database: %v", testDBErr)
+	}
+	db, err := pgx.Connect(context.Background(), testDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close(context.Background()) })
+
+	var tables []string
+	rows, err := db.Query(context.Background(),
+		"select tablename from pg_tables where schemaname = 'public' and tablename <> 'schema_migrations'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var table string
+		err := rows.Scan(&table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	_, err = db.Exec(context.Background(), fmt.Sprintf("truncate %v restart identity cascade", strings.Join(tables, ", ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the report views and the reports cached by an earlier test are gone
+	// with their rows
+	_, err = refreshReports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports.invalidate()
+	return db
+}
+
+// testOrganizationID runs the fixture event
+const testOrganizationID = "aa9a52a7-ab83-46ff-ab15-b35bd868407f"
+
+// fixtures are the catalog every test starts from: one event selling solo,
+// twosome and foursome registrations, with t-shirt and dexterity options
+type fixtures struct {
+	EventID  int
+	Solo     string
+	Twosome  string
+	Foursome string
+	Options  map[string]string
+}
+
+func seedFixtures(t *testing.T, db *pgx.Conn) fixtures {
+	t.Helper()
+	f := fixtures{Options: map[string]string{}}
+	ctx := context.Background()
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.Exec(ctx, "insert into organization(organizationid, name) values ($1, 'Mojodomo')", testOrganizationID)
+	must(err)
+	var providerID string
+	must(db.QueryRow(ctx, "insert into payment_provider(name) values ('stripe') returning id::text").Scan(&providerID))
+	must(db.QueryRow(ctx, `
+	insert into event(organizationid, name, location, capacity, startson, endson)
+	values ($1, 'Charity Open', 'Pebble Creek', 100, '2026-06-01', '2026-06-01') returning eventid`,
+		testOrganizationID).Scan(&f.EventID))
+	var categoryID int
+	must(db.QueryRow(ctx, "insert into package_category(name) values ('Registration') returning packagecategoryid").Scan(&categoryID))
+
+	for _, p := range []struct {
+		name  string
+		price string
+		id    *string
+	}{
+		{"Solo Registration", "100.00", &f.Solo},
+		{"Twosome Registration", "190.00", &f.Twosome},
+		{"Foursome Registration", "360.00", &f.Foursome},
+	} {
+		var productID string
+		must(db.QueryRow(ctx, "insert into product(description, paymentproviderid) values ($1, $2) returning productid::text",
+			p.name, providerID).Scan(&productID))
+		must(db.QueryRow(ctx, "insert into pricing(productid, price) values ($1, $2::numeric::money) returning pricingid::text",
+			productID, p.price).Scan(p.id))
+		_, err = db.Exec(ctx, "insert into package(eventid, productid, packagecategoryid, name) values ($1, $2, $3, $4)",
+			f.EventID, productID, categoryID, p.name)
+		must(err)
+	}
+
+	// registration.create only takes dexterity option ids 6 and 7, so the
+	// t-shirt sizes have to come first
+	for _, c := range []struct {
+		name  string
+		items []string
+	}{
+		{"T-Shirt", []string{"SMALL", "MEDIUM", "LARGE", "X-LARGE", "2X-LARGE"}},
+		{"Dexterity", []string{"LEFT-HANDED", "RIGHT-HANDED"}},
+	} {
+		var optionID int
+		must(db.QueryRow(ctx, "insert into category_option(packagecategoryid, name) values ($1, $2) returning categoryoptionsid",
+			categoryID, c.name).Scan(&optionID))
+		for _, item := range c.items {
+			var id string
+			must(db.QueryRow(ctx, "insert into option_item(categoryoptionsid, name) values ($1, $2) returning optionitemsid::text",
+				optionID, item).Scan(&id))
+			f.Options[item] = id
+		}
+	}
+	if f.Options["LEFT-HANDED"] != "6" {
+		t.Fatalf("dexterity options got ids %v and %v", f.Options["LEFT-HANDED"], f.Options["RIGHT-HANDED"])
+	}
+	return f
+}
+
+// call invokes Handle with req as the json body and decodes the response
+// into out, failing the test on an error response
+func call(t *testing.T, req interface{}, out interface{}) {
+	t.Helper()
+	resp, err := callErr(req)
+	if err != nil {
+		t.Fatalf("%v: %s", err, resp.Body)
+	}
+	if out == nil {
+		return
+	}
+	err = json.Unmarshal(resp.Body, out)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", resp.Body, err)
+	}
+}
+
+func callErr(req interface{}) (handler.Response, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return handler.Response{}, err
+	}
+	return Handle(handler.Request{Body: body})
+}
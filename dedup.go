@@ -0,0 +1,162 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// customerLockClass namespaces the advisory locks taken per organization
+// while checkout matches or creates a customer, so two checkouts of the same
+// buyer cannot both create one
+const customerLockClass = 3
+
+// normalizeEmail is the form emails are compared in
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizePhone keeps only the digits of phone, so "(555) 010-2030" and
+// "555.010.2030" are the same number
+func normalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, phone)
+}
+
+// checkoutCustomer returns the customer of organizationID with the same
+// normalized email, or failing that phone, creating one when there is none.
+// A matched customer takes the contact details given at checkout.
+func checkoutCustomer(tx pgx.Tx, organizationID, name, email, phone string) (int, error) {
+	_, err := tx.Exec(context.Background(), "select pg_advisory_xact_lock($1, hashtext($2))", customerLockClass, organizationID)
+	if err != nil {
+		return 0, fmt.Errorf("Customer lock: %v", err)
+	}
+
+	var customerID int
+	exec := fmt.Sprintf(`
+	select customerid
+	from customer
+	where organizationid = $1
+	and deleted_at is null
+	and (
+			($2 <> '' and lower(trim(email)) = $2)
+			or ($3 <> '' and regexp_replace(phone, '\D', '', 'g') = $3)
+	)
+	order by ($2 <> '' and lower(trim(email)) = $2) desc, customerid
+	limit 1`)
+	err = tx.QueryRow(context.Background(), exec, organizationID, normalizeEmail(email), normalizePhone(phone)).Scan(&customerID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		exec = fmt.Sprintf(`
+		insert into
+		customer (organizationid, name, email, phone)
+		values ($1, $2, $3, $4) returning customerid`)
+		err = tx.QueryRow(context.Background(), exec, organizationID, name, strings.TrimSpace(email), phone).Scan(&customerID)
+		if err != nil {
+			return 0, fmt.Errorf("Customer: %v", err)
+		}
+		return customerID, nil
+	case err != nil:
+		return 0, fmt.Errorf("Customer match: %v", err)
+	}
+
+	exec = fmt.Sprintf(`
+	update customer set
+	name = coalesce(nullif($2, ''), name),
+	email = coalesce(nullif($3, ''), email),
+	phone = coalesce(nullif($4, ''), phone)
+	where customerid = $1
+	and (name, email, phone) is distinct from (coalesce(nullif($2, ''), name), coalesce(nullif($3, ''), email), coalesce(nullif($4, ''), phone))`)
+	_, err = tx.Exec(context.Background(), exec, customerID, name, strings.TrimSpace(email), phone)
+	if err != nil {
+		return 0, fmt.Errorf("Customer update: %v", err)
+	}
+	return customerID, nil
+}
+
+// merge_customers request, the salesorders of Duplicates move to CustomerID
+// and the duplicates are soft deleted with mergedinto set to CustomerID
+type mergeCustomers struct {
+	CustomerID int   `json:"customerid"`
+	Duplicates []int `json:"duplicates"`
+}
+
+type customerMerge struct {
+	CustomerID  int   `json:"customerid"`
+	Merged      []int `json:"merged"`
+	SalesOrders int64 `json:"salesorders"`
+}
+
+// merge re-points the duplicates' salesorders and soft deletes the duplicates
+// in one transaction. Duplicates have to belong to the same organization.
+func (mc mergeCustomers) merge(db Querier) (customerMerge, error) {
+	m := customerMerge{CustomerID: mc.CustomerID}
+	if len(mc.Duplicates) == 0 {
+		return m, errors.New("merge_customers: no duplicates given")
+	}
+	for _, id := range mc.Duplicates {
+		if id == mc.CustomerID {
+			return m, errors.New("merge_customers: a customer cannot be merged into itself")
+		}
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback(context.Background())
+
+	var organizationID string
+	err = tx.QueryRow(context.Background(),
+		"select organizationid::text from customer where customerid = $1 and deleted_at is null for update", mc.CustomerID,
+	).Scan(&organizationID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return m, fmt.Errorf("merge_customers: customer %v not found", mc.CustomerID)
+	case err != nil:
+		return m, fmt.Errorf("merge_customers customer: %v", err)
+	}
+
+	rows, err := tx.Query(context.Background(),
+		"select customerid from customer where customerid = any($1) and organizationid::text = $2 and deleted_at is null order by customerid for update",
+		mc.Duplicates, organizationID)
+	if err != nil {
+		return m, fmt.Errorf("merge_customers duplicates: %v", err)
+	}
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return m, fmt.Errorf("merge_customers duplicates scan: %v", err)
+		}
+		m.Merged = append(m.Merged, id)
+	}
+	rows.Close()
+	if len(m.Merged) != len(mc.Duplicates) {
+		return m, fmt.Errorf("merge_customers: duplicates %v must exist in the organization of customer %v", mc.Duplicates, mc.CustomerID)
+	}
+
+	tag, err := tx.Exec(context.Background(),
+		"update salesorder set customerid = $1 where customerid = any($2)", mc.CustomerID, m.Merged)
+	if err != nil {
+		return m, fmt.Errorf("merge_customers salesorder: %v", err)
+	}
+	m.SalesOrders = tag.RowsAffected()
+
+	_, err = tx.Exec(context.Background(),
+		"update customer set deleted_at = now(), mergedinto = $1 where customerid = any($2)", mc.CustomerID, m.Merged)
+	if err != nil {
+		return m, fmt.Errorf("merge_customers delete: %v", err)
+	}
+
+	return m, tx.Commit(context.Background())
+}
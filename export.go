@@ -0,0 +1,619 @@
+package function
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+// rowWriter writes an export row by row, close finishes the file
+type rowWriter interface {
+	header(names []string) error
+	row(values []interface{}) error
+	close() error
+}
+
+type exportFormat struct {
+	ContentType string
+	// Accept is the media type of the Accept header asking for the format,
+	// empty when only the format field selects it
+	Accept    string
+	Extension string
+	newWriter func(w io.Writer, name string) rowWriter
+}
+
+// exportFormats are the formats readall and the reports are streamed in, by
+// the format field of the request
+var exportFormats = map[string]exportFormat{
+	"csv": {
+		ContentType: "text/csv; charset=utf-8",
+		Accept:      "text/csv",
+		Extension:   "csv",
+		newWriter:   func(w io.Writer, name string) rowWriter { return &csvRows{w: csv.NewWriter(w)} },
+	},
+	"xlsx": {
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Accept:      "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Extension:   "xlsx",
+		newWriter:   newXLSXRows,
+	},
+	// the json formats have an object per row keyed as in the readall
+	// response, the columns of reports keep their names
+	"ndjson": {
+		ContentType: "application/x-ndjson",
+		Accept:      "application/x-ndjson",
+		Extension:   "ndjson",
+		newWriter: func(w io.Writer, name string) rowWriter {
+			return &jsonRows{w: w, newRecord: exportRecords[name], after: "\n"}
+		},
+	},
+	"json_stream": {
+		ContentType: "application/json",
+		Extension:   "json",
+		newWriter: func(w io.Writer, name string) rowWriter {
+			return &jsonRows{w: w, newRecord: exportRecords[name], open: "[", between: ",", end: "]\n"}
+		},
+	},
+}
+
+// responseFormat is the format field of the request, or without one the
+// export format the Accept header asks for
+func responseFormat(accept, format string) string {
+	if format != "" {
+		return strings.ToLower(format)
+	}
+	for _, a := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(a))
+		if err != nil {
+			continue
+		}
+		for name, f := range exportFormats {
+			if f.Accept != "" && f.Accept == mt {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// exportTables are the tables readall exports by the name the request uses,
+// the older names read their table
+var exportTables = map[string]string{
+	"order":                   "salesorder",
+	"category_options":        "category_option",
+	"option_items":            "option_item",
+	"participant_options":     "participant_option",
+	"customer":                "customer",
+	"event":                   "event",
+	"organization":            "organization",
+	"participant":             "participant",
+	"purchase":                "purchase",
+	"shopping_order":          "shopping_order",
+	"shopping_cart":           "shopping_cart",
+	"cart_participant":        "cart_participant",
+	"cart_participant_option": "cart_participant_option",
+	"waitlist":                "waitlist",
+	"pricing_rule":            "pricing_rule",
+	"refund":                  "refund",
+	"participant_change":      "participant_change",
+}
+
+// rowScanner is a struct readall answers with, read from a row of its table
+type rowScanner interface {
+	scan(rows pgx.Rows) error
+}
+
+// exportRecords make the structs readall answers with by exportTables name,
+// the json formats scan each row into one and encode it as readall does
+var exportRecords = map[string]func() rowScanner{
+	"order":                   func() rowScanner { return &salesorder{} },
+	"category_options":        func() rowScanner { return &category_options{} },
+	"option_items":            func() rowScanner { return &option_items{} },
+	"participant_options":     func() rowScanner { return &participant_options{} },
+	"customer":                func() rowScanner { return &customer{} },
+	"event":                   func() rowScanner { return &event{} },
+	"organization":            func() rowScanner { return &organization{} },
+	"participant":             func() rowScanner { return &participant{} },
+	"purchase":                func() rowScanner { return &purchase{} },
+	"shopping_order":          func() rowScanner { return &shopping_order{} },
+	"shopping_cart":           func() rowScanner { return &shopping_cart{} },
+	"cart_participant":        func() rowScanner { return &cart_participant{} },
+	"cart_participant_option": func() rowScanner { return &cart_participant_option{} },
+	"waitlist":                func() rowScanner { return &waitlist{} },
+	"pricing_rule":            func() rowScanner { return &pricing_rule{} },
+	"refund":                  func() rowScanner { return &refund{} },
+	"participant_change":      func() rowScanner { return &participant_change{} },
+}
+
+// exportable reports whether d is a readall or report read asking for an
+// export format
+func exportable(d Data) bool {
+	if _, ok := exportFormats[strings.ToLower(d.Format)]; !ok {
+		return false
+	}
+	table := strings.ToLower(d.Table)
+	switch strings.ToLower(d.Action) {
+	case "readall":
+		_, ok := exportTables[table]
+		return ok
+	case "read":
+		return reportTables[table]
+	}
+	return false
+}
+
+// participantExport is registration_detail with one row per active
+// participant, read from the tables rather than report_registration_detail
+// since the view holds a row per salesorder. Its first verb filters the
+// deleted participants, purchases, salesorders and customers, the second
+// the deleted options.
+const participantExport = `
+	select p.name as "Name", c.name as "Team Contact", c.phone as "Phone",
+	coalesce(shirt.name, '') as "Shirt", coalesce(club.name, '') as "Dexterity"
+	from participant p
+	inner join purchase pu on pu.purchaseid = p.purchaseid
+	inner join salesorder s on s.salesorderid = pu.salesorderid
+	inner join customer c on c.customerid = s.customerid
+	left join lateral (
+			select oi.name
+			from participant_option po
+			inner join option_item oi on oi.optionitemsid = po.optionitemsid
+			inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+			where po.participantid = p.participantid and co.name = 'T-Shirt' and %[2]v
+			limit 1
+	) shirt on true
+	left join lateral (
+			select oi.name
+			from participant_option po
+			inner join option_item oi on oi.optionitemsid = po.optionitemsid
+			inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+			where po.participantid = p.participantid and co.name = 'Dexterity' and %[2]v
+			limit 1
+	) club on true
+	where p.cancelledat is null and %[1]v
+	order by s.salesorderid, p.name`
+
+// export streams the rows of d to s in d.Format. Nothing is written until
+// the first row has been read, so a failed query is still answered with
+// errResponse; an error after that ends the export where it is.
+// The server's write_timeout ends an export still streaming, large exports
+// go to the db-export deployment of db.yml.
+func export(db Querier, s *responseStream, d Data) (handler.Response, error) {
+	format := strings.ToLower(d.Format)
+	f := exportFormats[format]
+	table := strings.ToLower(d.Table)
+	filename := table + "." + f.Extension
+
+	if strings.ToLower(d.Action) == "read" && table != "registration_detail" {
+		header, values, err := summaryRow(db, table)
+		if err != nil {
+			return errResponse(err)
+		}
+		s.start(f.ContentType, filename)
+		rw := f.newWriter(s, table)
+		if err := rw.header(header); err != nil {
+			return s.response(), err
+		}
+		if err := rw.row(values); err != nil {
+			return s.response(), err
+		}
+		return s.response(), rw.close()
+	}
+
+	query := fmt.Sprintf(participantExport,
+		deletedFilterOn(d.IncludeDeleted, "p", "pu", "s", "c"), deletedFilterOn(d.IncludeDeleted, "po", "oi"))
+	if strings.ToLower(d.Action) == "readall" {
+		query = fmt.Sprintf("select * from %v", exportTables[table])
+		if softDeleteTables[exportTables[table]] {
+			query += " where " + deletedFilter(d.IncludeDeleted)
+		}
+		// waitlist entries are read with their position, as readall has them
+		if exportTables[table] == "waitlist" {
+			query = waitlistQuery + " order by eventid, status desc, position, joinedat"
+		}
+	}
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return errResponse(fmt.Errorf("export %v: %v", table, err))
+	}
+	defer rows.Close()
+	more := rows.Next()
+	if err := rows.Err(); err != nil {
+		return errResponse(fmt.Errorf("export %v: %v", table, err))
+	}
+
+	s.start(f.ContentType, filename)
+	rw := f.newWriter(s, table)
+	if err := rw.header(fieldNames(rows)); err != nil {
+		return s.response(), err
+	}
+	for ; more; more = rows.Next() {
+		if j, ok := rw.(*jsonRows); ok && j.newRecord != nil {
+			if err := j.record(rows); err != nil {
+				return s.response(), fmt.Errorf("export %v: %v", table, err)
+			}
+			continue
+		}
+		values, err := rows.Values()
+		if err != nil {
+			return s.response(), fmt.Errorf("export %v: %v", table, err)
+		}
+		if err := rw.row(values); err != nil {
+			return s.response(), err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return s.response(), fmt.Errorf("export %v: %v", table, err)
+	}
+	return s.response(), rw.close()
+}
+
+// deletedFilterOn is deletedFilter for each of the table aliases of a join
+func deletedFilterOn(includeDeleted bool, aliases ...string) string {
+	if includeDeleted {
+		return deletedFilter(true)
+	}
+	filters := make([]string, len(aliases))
+	for i, a := range aliases {
+		filters[i] = a + "." + deletedFilter(false)
+	}
+	return strings.Join(filters, " and ")
+}
+
+func fieldNames(rows pgx.Rows) []string {
+	var names []string
+	for _, fd := range rows.FieldDescriptions() {
+		names = append(names, string(fd.Name))
+	}
+	return names
+}
+
+// summaryRow reads a summary report as one row named by its json fields,
+// the events of dashboard_summary are left out and report_freshness is
+// exported as its refreshedat
+func summaryRow(db Querier, table string) ([]string, []interface{}, error) {
+	var report interface{}
+	var err error
+	switch table {
+	case "dashboard_summary":
+		ds := &dashboardSummary{}
+		err = ds.getDashboardSummary(db)
+		report = ds
+	case "registration_summary":
+		rs := &registrationSummary{}
+		err = rs.getRegistrationSummary(db)
+		report = rs
+	case "shirt_summary":
+		ss := &shirtSummary{}
+		err = ss.getShirtSummary(db)
+		report = ss
+	case "club_summary":
+		cs := &clubSummary{}
+		err = cs.getClubSummary(db)
+		report = cs
+	case "registration_breakdown":
+		rb := &registrationBreakdown{}
+		err = rb.getRegistrationBreakdown(db)
+		report = rb
+	default:
+		return nil, nil, fmt.Errorf("export: %v is not a report", table)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var header []string
+	var values []interface{}
+	v := reflect.ValueOf(report).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		switch fv := v.Field(i).Interface().(type) {
+		case reportFreshness:
+			header = append(header, "refreshedat")
+			values = append(values, fv.RefreshedAt)
+		case int, string:
+			header = append(header, name)
+			values = append(values, fv)
+		}
+	}
+	return header, values, nil
+}
+
+// exportValue is v as a spreadsheet cell, times in RFC 3339 and uuids in
+// their usual form
+func exportValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case [16]byte:
+		return uuid.UUID(v).String()
+	case driver.Valuer:
+		dv, err := v.Value()
+		if err == nil {
+			if _, ok := dv.(driver.Valuer); !ok {
+				return exportValue(dv)
+			}
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+// jsonRows writes each row as an object followed by after, with between
+// the rows and open and end around them. Rows of a table with a record are
+// the struct newRecord makes, the columns of the others keep their names.
+type jsonRows struct {
+	w                         io.Writer
+	newRecord                 func() rowScanner
+	open, between, after, end string
+	names                     []string
+	rows                      int
+}
+
+func (j *jsonRows) header(names []string) error {
+	j.names = names
+	_, err := io.WriteString(j.w, j.open)
+	return err
+}
+
+func (j *jsonRows) row(values []interface{}) error {
+	var b bytes.Buffer
+	b.WriteString("{")
+	for i, v := range values {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		name, err := json.Marshal(j.names[i])
+		if err != nil {
+			return err
+		}
+		value, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return err
+		}
+		b.Write(name)
+		b.WriteString(":")
+		b.Write(value)
+	}
+	b.WriteString("}")
+	return j.write(json.RawMessage(b.Bytes()))
+}
+
+// record scans the current row into the struct readall answers with
+func (j *jsonRows) record(rows pgx.Rows) error {
+	r := j.newRecord()
+	if err := r.scan(rows); err != nil {
+		return err
+	}
+	return j.write(r)
+}
+
+func (j *jsonRows) write(v interface{}) error {
+	var b bytes.Buffer
+	if j.rows > 0 {
+		b.WriteString(j.between)
+	}
+	if err := json.NewEncoder(&b).Encode(v); err != nil {
+		return err
+	}
+	// Encode ends the object with a newline, after takes its place
+	b.Truncate(b.Len() - 1)
+	b.WriteString(j.after)
+	j.rows++
+	_, err := j.w.Write(b.Bytes())
+	return err
+}
+
+func (j *jsonRows) close() error {
+	_, err := io.WriteString(j.w, j.end)
+	return err
+}
+
+// jsonValue is v as json marshals it, uuids in their usual form and the
+// types pgx has no go value for as their text
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case [16]byte:
+		return uuid.UUID(v).String()
+	case []byte:
+		return string(v)
+	case driver.Valuer:
+		return exportValue(v)
+	}
+	return v
+}
+
+type csvRows struct {
+	w *csv.Writer
+}
+
+func (c *csvRows) header(names []string) error {
+	return c.w.Write(names)
+}
+
+func (c *csvRows) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = csvCell(exportValue(v))
+	}
+	return c.w.Write(record)
+}
+
+func (c *csvRows) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// csvPhonePattern matches the international phone numbers csvCell leaves as
+// typed, digits in groups without any operator but the separators
+var csvPhonePattern = regexp.MustCompile(`^\+[0-9]{1,3}([ .-]?(\([0-9]{1,4}\)|[0-9]{2,4})){2,4}$`)
+
+// csvNumberPattern matches the signed numbers and money amounts csvCell
+// leaves as they are, such as refunds of -$20.00, so they stay numbers
+var csvNumberPattern = regexp.MustCompile(`^[+-]?\$?([0-9]+|[0-9]{1,3}(,[0-9]{3})+)(\.[0-9]+)?$`)
+
+// csvCell keeps a spreadsheet from reading s as a formula, names and phones
+// come from the registration form. Every cell starting with = + - @ or a tab
+// or carriage return is quoted, except numbers such as -20.00 or -$20.00 and
+// phone numbers such as +1 555 010 2030.
+func csvCell(s string) string {
+	if s == "" || !strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return s
+	}
+	if csvNumberPattern.MatchString(s) || csvPhonePattern.MatchString(s) {
+		return s
+	}
+	return "'" + s
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="%v" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxRows writes a workbook of one sheet, its parts are written up front and
+// the sheet is streamed row by row into the zip. Every cell is an inline
+// string, so nothing in a cell is read as a formula.
+type xlsxRows struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	err   error
+}
+
+func newXLSXRows(w io.Writer, name string) rowWriter {
+	x := &xlsxRows{zw: zip.NewWriter(w)}
+	if len(name) > 31 {
+		name = name[:31]
+	}
+	var sheetName bytes.Buffer
+	xml.EscapeText(&sheetName, []byte(name))
+	for _, part := range []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", fmt.Sprintf(xlsxWorkbook, sheetName.String())},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/worksheets/sheet1.xml", xlsxSheetStart},
+	} {
+		pw, err := x.zw.Create(part.name)
+		if err != nil {
+			x.err = err
+			return x
+		}
+		_, err = io.WriteString(pw, part.body)
+		if err != nil {
+			x.err = err
+			return x
+		}
+		x.sheet = pw
+	}
+	return x
+}
+
+func (x *xlsxRows) header(names []string) error {
+	values := make([]interface{}, len(names))
+	for i, n := range names {
+		values[i] = n
+	}
+	return x.row(values)
+}
+
+func (x *xlsxRows) row(values []interface{}) error {
+	if x.err != nil {
+		return x.err
+	}
+	var b bytes.Buffer
+	b.WriteString("<row>")
+	for _, v := range values {
+		b.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		xml.EscapeText(&b, []byte(exportValue(v)))
+		b.WriteString("</t></is></c>")
+	}
+	b.WriteString("</row>")
+	_, x.err = x.sheet.Write(b.Bytes())
+	return x.err
+}
+
+func (x *xlsxRows) close() error {
+	if x.err != nil {
+		return x.err
+	}
+	_, err := io.WriteString(x.sheet, xlsxSheetEnd)
+	if err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+// responseStream is the response an export is written to as it is read, the
+// http.ResponseWriter of Serve or the buffer Handle returns as the body
+type responseStream struct {
+	http.ResponseWriter
+	started bool
+}
+
+// start sends the headers of an export downloaded as filename, the response
+// cannot change after it
+func (s *responseStream) start(contentType, filename string) {
+	h := s.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "*")
+	h.Set("Access-Control-Allow-Headers", "*")
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	s.WriteHeader(http.StatusOK)
+	s.started = true
+}
+
+// response stands for the export already written, for the logs and metrics
+func (s *responseStream) response() handler.Response {
+	return handler.Response{StatusCode: http.StatusOK, Header: s.Header()}
+}
+
+// responseBuffer is the http.ResponseWriter of Handle, it keeps an export in
+// memory to return it as the body
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	if b.header == nil {
+		b.header = http.Header{}
+	}
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) { b.status = status }
+
+func (b *responseBuffer) Write(p []byte) (int, error) { return b.body.Write(p) }
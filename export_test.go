@@ -0,0 +1,361 @@
+package function
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+func TestResponseFormat(t *testing.T) {
+	for _, tc := range []struct{ accept, format, want string }{
+		{"", "", ""},
+		{"text/csv", "", "csv"},
+		{"application/json, text/csv;q=0.9", "", "csv"},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "", "xlsx"},
+		{"text/csv", "HTML", "html"},
+		{"text/html,*/*", "", ""},
+		{"application/x-ndjson", "", "ndjson"},
+		{"application/json", "", ""},
+	} {
+		if got := responseFormat(tc.accept, tc.format); got != tc.want {
+			t.Errorf("responseFormat(%q, %q) = %q, want %q", tc.accept, tc.format, got, tc.want)
+		}
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	for in, want := range map[string]string{
+		"Ann":               "Ann",
+		"=HYPERLINK(1)":     "'=HYPERLINK(1)",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"+cmd":              "'+cmd",
+		"-2+3":              "'-2+3",
+		"-5":                "-5",
+		"-20.50":            "-20.50",
+		"-$1,020.00":        "-$1,020.00",
+		"+3":                "+3",
+		"-5-1":              "'-5-1",
+		"-$5*2":             "'-$5*2",
+		"+1+2":              "'+1+2",
+		"+1 555 SUM(A1)":    "'+1 555 SUM(A1)",
+		"\tcmd":             "'\tcmd",
+		"+1 555 010 2030":   "+1 555 010 2030",
+		"+1 (555) 010-2030": "+1 (555) 010-2030",
+		"+44.20.7946.0958":  "+44.20.7946.0958",
+		"(555) 010-2030":    "(555) 010-2030",
+	} {
+		if got := csvCell(in); got != want {
+			t.Errorf("csvCell(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// exportFake answers the participant export with Ann and Bob
+func exportFake() *fakeQuerier {
+	db := &fakeQuerier{}
+	db.results = append(db.results, &fakeResult{
+		match:  "from participant p",
+		fields: []string{"Name", "Team Contact", "Phone", "Shirt", "Dexterity"},
+		rows: [][]interface{}{
+			{"Ann", "Pat Jones", "(555) 010-2030", "SMALL", "LEFT-HANDED"},
+			{"=Bob", "Pat Jones", "(555) 010-2030", "LARGE", ""},
+		},
+	})
+	return db
+}
+
+func TestExportCSV(t *testing.T) {
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	db := exportFake()
+	_, err := export(db, s, Data{Action: "read", Table: "registration_detail", Format: "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := db.find(t, "from participant p").SQL
+	for _, filter := range []string{
+		"p.cancelledat is null and p.deleted_at is null and pu.deleted_at is null and s.deleted_at is null and c.deleted_at is null",
+		"co.name = 'T-Shirt' and po.deleted_at is null and oi.deleted_at is null",
+	} {
+		if !strings.Contains(query, filter) {
+			t.Errorf("exported without %v:\n%v", filter, query)
+		}
+	}
+	if !s.started || buf.status != http.StatusOK {
+		t.Fatalf("export started %v with status %v", s.started, buf.status)
+	}
+	if got := buf.Header().Get("Content-Disposition"); got != `attachment; filename=registration_detail.csv` {
+		t.Errorf("Content-Disposition = %v", got)
+	}
+
+	records, err := csv.NewReader(&buf.body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"Name", "Team Contact", "Phone", "Shirt", "Dexterity"},
+		{"Ann", "Pat Jones", "(555) 010-2030", "SMALL", "LEFT-HANDED"},
+		{"'=Bob", "Pat Jones", "(555) 010-2030", "LARGE", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("exported %v", records)
+	}
+	for i := range want {
+		if strings.Join(records[i], "|") != strings.Join(want[i], "|") {
+			t.Errorf("row %v = %v, want %v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestExportXLSX(t *testing.T) {
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	_, err := export(exportFake(), s, Data{Action: "read", Table: "registration_detail", Format: "xlsx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := buf.body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := map[string]string{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name] = string(b)
+	}
+	for _, name := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels"} {
+		if _, ok := parts[name]; !ok {
+			t.Errorf("no %v in the workbook", name)
+		}
+	}
+	sheet := parts["xl/worksheets/sheet1.xml"]
+	if strings.Count(sheet, "<row>") != 3 || !strings.HasSuffix(sheet, "</sheetData></worksheet>") {
+		t.Errorf("sheet1.xml = %v", sheet)
+	}
+	if !strings.Contains(sheet, `<t xml:space="preserve">=Bob</t>`) || !strings.Contains(sheet, "Team Contact") {
+		t.Errorf("sheet1.xml = %v", sheet)
+	}
+	if !strings.Contains(parts["xl/workbook.xml"], `name="registration_detail"`) {
+		t.Errorf("workbook.xml = %v", parts["xl/workbook.xml"])
+	}
+}
+
+// purchaseFake answers the purchase export with rows of mixed types
+func purchaseFake(rows ...[]interface{}) *fakeQuerier {
+	db := &fakeQuerier{}
+	db.results = append(db.results, &fakeResult{
+		match:  "select * from purchase",
+		fields: []string{"purchaseid", "salesorderid", "qty", "productname", "description", "price", "pricingruleid", "deleted_at", "pricingid"},
+		rows:   rows,
+	})
+	return db
+}
+
+// readallJSON is l as the readall response has each of its objects
+func readallJSON(t *testing.T, l ...purchase) []string {
+	t.Helper()
+	var objects []string
+	for _, p := range l {
+		b, err := json.Marshal(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, string(b))
+	}
+	return objects
+}
+
+func TestExportNDJSON(t *testing.T) {
+	deleted := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	db := purchaseFake(
+		[]interface{}{int32(1), int32(7), int32(1), "Solo Registration", "", "$100.00", nil, nil, "aa9a52a7-ab83-46ff-ab15-b35bd8868407"},
+		[]interface{}{int32(2), int32(7), int32(1), "Foursome \"Gold\"", "4 golfers", "$360.00", int32(3), deleted, nil},
+	)
+
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	_, err := export(db, s, Data{Action: "readall", Table: "purchase", Format: "ndjson", IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pricingID, ruleID := "aa9a52a7-ab83-46ff-ab15-b35bd8868407", 3
+	want := strings.Join(readallJSON(t,
+		purchase{ID: 1, OrderID: 7, Qty: 1, ProductName: "Solo Registration", Price: "$100.00", PricingID: &pricingID},
+		purchase{ID: 2, OrderID: 7, Qty: 1, ProductName: "Foursome \"Gold\"", Description: "4 golfers", Price: "$360.00", PricingRuleID: &ruleID, DeletedAt: &deleted},
+	), "\n") + "\n"
+	if got := buf.body.String(); got != want {
+		t.Errorf("exported\n%v\nwant\n%v", got, want)
+	}
+	if got := buf.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("Content-Type = %v", got)
+	}
+}
+
+func TestExportNDJSONMatchesReadall(t *testing.T) {
+	orderdate := time.Date(2026, 5, 1, 12, 30, 0, 0, time.UTC)
+	tax := "$8.25"
+	row := []interface{}{int32(7), orderdate, int32(42), "pi_123", "INV-2026-0007", tax, nil, nil}
+	fields := []string{"salesorderid", "orderdate", "customerid", "paymentid", "invoiceno", "tax", "paymentstatus", "deleted_at"}
+	db := &fakeQuerier{}
+	db.results = append(db.results,
+		&fakeResult{match: "select * from salesorder", fields: fields, rows: [][]interface{}{row}},
+		&fakeResult{match: "select * from salesorder", fields: fields, rows: [][]interface{}{row}},
+	)
+
+	var so salesorder
+	sl, err := so.readall(db, "salesorder", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readall, err := structResponse(sl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	_, err = export(db, s, Data{Action: "readall", Table: "order", Format: "ndjson"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := "[" + strings.TrimSuffix(buf.body.String(), "\n") + "]"
+	if got != string(readall.Body) {
+		t.Errorf("exported\n%v\nreadall answers\n%v", got, string(readall.Body))
+	}
+}
+
+func TestExportJSONStream(t *testing.T) {
+	for _, tc := range []struct {
+		rows [][]interface{}
+		want []purchase
+	}{
+		{nil, nil},
+		{
+			[][]interface{}{
+				{int32(1), int32(7), int32(1), "Solo Registration", "", "$100.00", nil, nil, nil},
+				{int32(2), int32(8), int32(1), "Twosome Registration", "", "$180.00", nil, nil, nil},
+			},
+			[]purchase{
+				{ID: 1, OrderID: 7, Qty: 1, ProductName: "Solo Registration", Price: "$100.00"},
+				{ID: 2, OrderID: 8, Qty: 1, ProductName: "Twosome Registration", Price: "$180.00"},
+			},
+		},
+	} {
+		var buf responseBuffer
+		s := &responseStream{ResponseWriter: &buf}
+		_, err := export(purchaseFake(tc.rows...), s, Data{Action: "readall", Table: "purchase", Format: "json_stream"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "[" + strings.Join(readallJSON(t, tc.want...), ",") + "]\n"
+		if got := buf.body.String(); got != want {
+			t.Errorf("exported %v, want %v", got, want)
+		}
+		var v []purchase
+		if err := json.Unmarshal(buf.body.Bytes(), &v); err != nil || len(v) != len(tc.rows) {
+			t.Errorf("exported %v rows of invalid json: %v", len(v), err)
+		}
+	}
+}
+
+func TestExportQueryFailsBeforeStreaming(t *testing.T) {
+	db := &fakeQuerier{}
+	db.fails("from customer", io.ErrUnexpectedEOF)
+
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	resp, err := export(db, s, Data{Action: "readall", Table: "customer", Format: "csv"})
+	if err == nil || s.started || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("export = %v, %v, started %v", resp.StatusCode, err, s.started)
+	}
+	if got := db.find(t, "from customer").SQL; got != "select * from customer where deleted_at is null" {
+		t.Errorf("exported with %v", got)
+	}
+}
+
+func TestSummaryRow(t *testing.T) {
+	db := &fakeQuerier{}
+	at := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	db.returns("from report_option", []interface{}{2, 1})
+	db.returns("from report_refresh", []interface{}{at, 1.0})
+
+	header, values, err := summaryRow(db, "club_summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(header, ",") != "lefthanded,righthanded,refreshedat" {
+		t.Errorf("header = %v", header)
+	}
+	if len(values) != 3 || values[0] != 2 || exportValue(values[2]) != "2026-05-01T12:00:00Z" {
+		t.Errorf("values = %v", values)
+	}
+}
+
+func TestExportRegistrationDetail(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+	register(t, f, "twosome-session", f.Twosome,
+		testGolfer{"Bob", "MEDIUM", "RIGHT-HANDED"},
+		testGolfer{"Ann", "SMALL", ""},
+	)
+	checkout(t, "twosome-session")
+
+	req := handler.Request{Body: []byte(`{"action":"read","table":"registration_detail"}`), Header: http.Header{}}
+	req.Header.Set("Accept", "text/csv")
+	resp, err := Handle(req)
+	if err != nil {
+		t.Fatalf("%v: %s", err, resp.Body)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("Content-Type = %v", got)
+	}
+	records, err := csv.NewReader(bytes.NewReader(resp.Body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Name,Team Contact,Phone,Shirt,Dexterity\n" +
+		"Ann,Pat Jones,(555) 010-2030,SMALL,\n" +
+		"Bob,Pat Jones,(555) 010-2030,MEDIUM,RIGHT-HANDED\n"
+	var got string
+	for _, r := range records {
+		got += strings.Join(r, ",") + "\n"
+	}
+	if got != want {
+		t.Errorf("exported\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestServeWritesResponse(t *testing.T) {
+	captureLogs(t, "error")
+	withoutDatabase(t, errors.New("refused"))
+
+	w := httptest.NewRecorder()
+	req := handler.Request{Body: []byte(`{"action":"readall","table":"customer","format":"csv"}`), Header: http.Header{}}
+	req.Header.Set("X-Request-Id", "req-3")
+	Serve(w, req)
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "refused" {
+		t.Errorf("Serve wrote %v %q", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Request-Id"); got != "req-3" {
+		t.Errorf("X-Request-Id = %v", got)
+	}
+}
@@ -6,73 +6,128 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/S-ign/httputils"
 	"github.com/S-ign/vaultutils"
 	"github.com/gofrs/uuid"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	handler "github.com/openfaas/templates-sdk/go-http"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Querier is the part of the database connection the function uses. Both
+// *pgx.Conn and pgx.Tx satisfy it, so the same code runs on a connection, in a
+// transaction and against the fake of the unit tests.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
 // Creater handles inserting a single row into a database
 type Creater interface {
-	create(db *pgx.Conn, table string) error
+	create(db Querier, table string, oc onConflict) error
+}
+
+// onConflict is the optional on_conflict spec of a create request, Columns
+// is the conflict target, and either DoNothing or Update (the columns to
+// overwrite with the excluded row) picks the conflict action
+type onConflict struct {
+	Columns   []string `json:"columns"`
+	DoNothing bool     `json:"donothing"`
+	Update    []string `json:"update"`
+}
+
+// clause builds the "on conflict" part of an insert statement, an empty spec
+// returns an empty string so it can always be appended to the insert.
+// DoNothing with conflict columns sets the first of them to itself instead of
+// doing nothing, so the insert still returns the id of the existing row.
+func (o onConflict) clause() (string, error) {
+	if len(o.Columns) == 0 && !o.DoNothing && len(o.Update) == 0 {
+		return "", nil
+	}
+	if o.DoNothing == (len(o.Update) > 0) {
+		return "", errors.New("on_conflict err: exactly one of donothing or update is required")
+	}
+
+	target := ""
+	if len(o.Columns) > 0 {
+		target = fmt.Sprintf(" (%v)", strings.Join(sanitizeColumns(o.Columns), ", "))
+	}
+	if o.DoNothing && target == "" {
+		return " on conflict do nothing", nil
+	}
+	if o.DoNothing {
+		c := sanitizeColumns(o.Columns)[0]
+		return fmt.Sprintf(" on conflict%v do update set %v=excluded.%v", target, c, c), nil
+	}
+	if target == "" {
+		return "", errors.New("on_conflict err: update requires conflict columns")
+	}
+
+	var set []string
+	for _, c := range sanitizeColumns(o.Update) {
+		set = append(set, fmt.Sprintf("%v=excluded.%v", c, c))
+	}
+	return fmt.Sprintf(" on conflict%v do update set %v", target, strings.Join(set, ", ")), nil
+}
+
+// insertReturning runs an insert that returns a single id, the id of the
+// existing row on a conflict. A conflict skipped with do nothing and no
+// conflict columns returns no row, and there is no id to return.
+func insertReturning(db Querier, oc onConflict, exec string, args ...interface{}) (int, error) {
+	var id int
+	err := db.QueryRow(context.Background(), exec, args...).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) && oc.DoNothing {
+		return 0, errors.New("on_conflict err: donothing needs conflict columns to return the existing row")
+	}
+	return id, err
+}
+
+func sanitizeColumns(cols []string) []string {
+	var sl []string
+	for _, c := range cols {
+		sl = append(sl, sanitizeColumn(c))
+	}
+	return sl
+}
+
+// sanitizeColumn quotes a column name taken from the request
+func sanitizeColumn(c string) string {
+	return pgx.Identifier{strings.ToLower(c)}.Sanitize()
 }
 
 type registrationDetail struct {
-	Name    string      `json:"name"`
-	Phone   string      `json:"phone"`
-	Members []string    `json:"members"`
-	Shirt   []string    `json:"shirt"`
-	Club    interface{} `json:"club"`
+	Name            string          `json:"name"`
+	Phone           string          `json:"phone"`
+	Members         []string        `json:"members"`
+	Shirt           []string        `json:"shirt"`
+	Club            interface{}     `json:"club"`
+	ReportFreshness reportFreshness `json:"report_freshness"`
 }
 
-func getRegistrationDetail(db *pgx.Conn) ([]registrationDetail, error) {
+func getRegistrationDetail(db Querier) ([]registrationDetail, error) {
 	var rd registrationDetail
 	var rdList []registrationDetail
-	exec := fmt.Sprintf(`select c.name, c.phone, t.members, t.shirt, t1.club
-	from customer c
-	inner join salesorder s on
-	s.customerId = c.customerId
-	inner join (
-			select s.salesorderid, string_agg(p.name, '\n' order by p.name) as members,
-					string_agg(oi.name, '\n' order by p.name) as shirt
-			from participant p
-			inner join purchase pu
-			on pu.purchaseId = p.purchaseId
-			inner join salesorder s 
-			on s.salesorderId = pu.salesorderid
-			inner join participant_option po 
-	on po.participantId = p.participantId
-	inner join option_item oi
-	on oi.optionItemsId = po.optionItemsId 
-	inner join category_option co
-	on co.categoryOptionsId = oi.categoryOptionsId
-	and co.name = 'T-Shirt'
-	group by s.salesorderid
-	) t
-	on t.salesorderId = s.salesorderId
-	left join (
-			select s.salesorderid, string_agg(p.name, '\n' order by p.name) as members,
-					string_agg(oi.name, '\n' order by p.name) as club
-			from participant p
-			inner join purchase pu
-			on pu.purchaseId = p.purchaseId
-			inner join salesorder s 
-			on s.salesorderId = pu.salesorderid
-			inner join participant_option po 
-	on po.participantId = p.participantId
-	inner join option_item oi
-	on oi.optionItemsId = po.optionItemsId 
-	inner join category_option co
-	on co.categoryOptionsId = oi.categoryOptionsId
-	and co.name = 'Dexterity'
-	group by s.salesorderid
-	) t1
-	on t1.salesorderId = s.salesorderId`)
+	rf, err := readFreshness(db, "report_registration_detail")
+	if err != nil {
+		return nil, fmt.Errorf("getRegistrationDetail: %v", err)
+	}
+	exec := fmt.Sprintf(`select name, phone, members, shirt, club
+	from report_registration_detail
+	order by salesorderid`)
 	rows, err := db.Query(context.Background(), exec)
 	if err != nil {
 		return nil, fmt.Errorf("getRegistrationDetail query err: %v", err)
@@ -81,7 +136,7 @@ func getRegistrationDetail(db *pgx.Conn) ([]registrationDetail, error) {
 	for rows.Next() {
 		var members string
 		var shirt string
-		rows.Scan(&rd.Name, &rd.Phone, &members, &shirt, &rd.Club)
+		err := rows.Scan(&rd.Name, &rd.Phone, &members, &shirt, &rd.Club)
 		if err != nil {
 			return nil, fmt.Errorf("getRegistrationDetail scan err: %v", err)
 		}
@@ -93,34 +148,35 @@ func getRegistrationDetail(db *pgx.Conn) ([]registrationDetail, error) {
 		case string:
 			rd.Club = strings.Split(club, "\\n")
 		}
+		rd.ReportFreshness = rf
 
 		rdList = append(rdList, rd)
-		fmt.Println(rows.Err())
 	}
-	return rdList, nil
+	return rdList, rows.Err()
 }
 
 type registrationBreakdown struct {
-	SoloRegistration     int    `json:"soloregistration"`
-	SoloCollected        string `json:"solocollected"`
-	TwosomeRegistration  int    `json:"twosomeregistration"`
-	TwosomeCollected     string `json:"twosomecollected"`
-	FoursomeRegistration int    `json:"foursomeregistration"`
-	FoursomeCollected    string `json:"foursomecollected"`
-}
-
-func (rb *registrationBreakdown) getRegistrationBreakdown(db *pgx.Conn) error {
+	SoloRegistration     int             `json:"soloregistration"`
+	SoloCollected        string          `json:"solocollected"`
+	TwosomeRegistration  int             `json:"twosomeregistration"`
+	TwosomeCollected     string          `json:"twosomecollected"`
+	FoursomeRegistration int             `json:"foursomeregistration"`
+	FoursomeCollected    string          `json:"foursomecollected"`
+	ReportFreshness      reportFreshness `json:"report_freshness"`
+}
+
+func (rb *registrationBreakdown) getRegistrationBreakdown(db Querier) error {
+	// cancelled participants no longer count, collected is summed per purchase
+	// rather than per participant and is net of refunds
 	exec := fmt.Sprintf(`
 	select
-	sum(case when productName = 'Solo Registration' then qty else 0 end) as "Solo Registration",
-	sum(case when productName = 'Solo Registration' then price else cast(0 as money) end) as "Solo Collected",
-	sum(case when productName = 'Twosome Registration' then qty else 0 end) as "Twosome Registration",
-	sum(case when productName = 'Twosome Registration' then price else cast(0 as money) end) as "Twosome Collected",
-	sum(case when productName = 'Foursome Registration' then qty else 0 end) as "Foursome Registration",
-	sum(case when productName = 'Solo Registration' then price else cast(0 as money) end) as "Foursome Collected"
-	from participant pa
-	inner join purchase pu on
-	pa.purchaseId = pu.purchaseId
+	coalesce(sum(registrations) filter (where productname = 'Solo Registration'), 0) as "Solo Registration",
+	coalesce(sum(collected - refunded) filter (where productname = 'Solo Registration'), cast(0 as money)) as "Solo Collected",
+	coalesce(sum(registrations) filter (where productname = 'Twosome Registration'), 0) as "Twosome Registration",
+	coalesce(sum(collected - refunded) filter (where productname = 'Twosome Registration'), cast(0 as money)) as "Twosome Collected",
+	coalesce(sum(registrations) filter (where productname = 'Foursome Registration'), 0) as "Foursome Registration",
+	coalesce(sum(collected - refunded) filter (where productname = 'Foursome Registration'), cast(0 as money)) as "Foursome Collected"
+	from report_product
 	`)
 	row := db.QueryRow(context.Background(), exec)
 	err := row.Scan(
@@ -132,47 +188,169 @@ func (rb *registrationBreakdown) getRegistrationBreakdown(db *pgx.Conn) error {
 		return fmt.Errorf("getRegistrationBreakdown scan err: %v", err)
 	}
 
+	rb.ReportFreshness, err = readFreshness(db, "report_product")
+	if err != nil {
+		return fmt.Errorf("getRegistrationBreakdown: %v", err)
+	}
+
 	return nil
 }
 
+// dashboardSummary totals come from report_product as of ReportFreshness,
+// Events are read live
 type dashboardSummary struct {
-	Participants int    `json:"participants"`
-	Collected    string `json:"collected"`
+	Participants    int             `json:"participants"`
+	Collected       string          `json:"collected"`
+	Refunded        string          `json:"refunded"`
+	Events          []eventCapacity `json:"events"`
+	ReportFreshness reportFreshness `json:"report_freshness"`
 }
 
-func (ds *dashboardSummary) getDashboardSummary(db *pgx.Conn) error {
-	// Overall Summary
+func (ds *dashboardSummary) getDashboardSummary(db Querier) error {
+	// Overall Summary, cancelled participants are left out and collected is
+	// net of refunds
 	exec := fmt.Sprintf(`
-	select count(qty) as Participants, sum(price) as Collected
-	from participant pa
-	inner join purchase pu on
-	pa.purchaseId = pu.purchaseId
+	select coalesce(sum(participants), 0) as Participants,
+	coalesce(sum(collected - refunded), cast(0 as money)) as Collected,
+	coalesce(sum(refunded), cast(0 as money)) as Refunded
+	from report_product
 	`)
 	row := db.QueryRow(context.Background(), exec)
-	err := row.Scan(&ds.Participants, &ds.Collected)
+	err := row.Scan(&ds.Participants, &ds.Collected, &ds.Refunded)
 	if err != nil {
 		return fmt.Errorf("getDashboardSummary scan err: %v", err)
 	}
 
+	ds.ReportFreshness, err = readFreshness(db, "report_product")
+	if err != nil {
+		return fmt.Errorf("getDashboardSummary: %v", err)
+	}
+
+	ds.Events, err = getEventCapacities(db, "true")
+	if err != nil {
+		return fmt.Errorf("getDashboardSummary: %v", err)
+	}
+
+	return nil
+}
+
+// errEventFull is returned when a registration would exceed event.Capacity
+var errEventFull = errors.New("error: event is full")
+
+// eventLockClass namespaces the advisory locks taken per event while
+// registering
+const eventLockClass = 1
+
+type eventCapacity struct {
+	EventID    int    `json:"eventid"`
+	Name       string `json:"name"`
+	Capacity   int    `json:"capacity"`
+	Registered int    `json:"registered"`
+	InFlight   int    `json:"inflight"`
+	Remaining  int    `json:"remaining"`
+}
+
+// getEventCapacities counts the confirmed participants and the ones still in
+// a shopping cart for every event matching where, both are matched to the
+// event's package through the pricing they were sold at
+func getEventCapacities(db Querier, where string, args ...interface{}) ([]eventCapacity, error) {
+	var ec eventCapacity
+	var el []eventCapacity
+	exec := fmt.Sprintf(`
+	select e.eventid, e.name, e.capacity,
+	(
+			select count(*)
+			from participant pa
+			inner join purchase pu on pu.purchaseid = pa.purchaseid
+			inner join pricing p on p.pricingid = pu.pricingid
+			inner join package pk on pk.productid = p.productid
+			where pk.eventid = e.eventid and pa.cancelledat is null and pa.deleted_at is null
+	) as registered,
+	(
+			select count(*)
+			from cart_participant cp
+			inner join shopping_cart sc on sc.shoppingcartid = cp.shoppingcartid
+			inner join pricing p on p.pricingid = sc.pricingid
+			inner join package pk on pk.productid = p.productid
+			where pk.eventid = e.eventid
+	) as inflight
+	from event e
+	where e.deleted_at is null and %v`, where)
+	rows, err := db.Query(context.Background(), exec, args...)
+	if err != nil {
+		return nil, fmt.Errorf("getEventCapacities query err: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := rows.Scan(&ec.EventID, &ec.Name, &ec.Capacity, &ec.Registered, &ec.InFlight)
+		if err != nil {
+			return nil, fmt.Errorf("getEventCapacities scan err: %v", err)
+		}
+		ec.Remaining = ec.Capacity - ec.Registered - ec.InFlight
+		if ec.Remaining < 0 {
+			ec.Remaining = 0
+		}
+		el = append(el, ec)
+	}
+	return el, rows.Err()
+}
+
+// eventForPricing returns the event whose package sells pricingID
+func eventForPricing(db Querier, pricingID string) (int, error) {
+	var eventID int
+	exec := fmt.Sprintf(`
+	select pk.eventid
+	from pricing p
+	inner join package pk on pk.productid = p.productid
+	where p.pricingid = $1`)
+	err := db.QueryRow(context.Background(), exec, pricingID).Scan(&eventID)
+	return eventID, err
+}
+
+// reserveEventCapacity takes the transaction advisory lock of the event sold
+// by pricingID and checks it has room for golfers more participants. The lock
+// is held until tx ends, so the next registration for the event waits for the
+// cart rows written in tx and counts them. Pricing that is not part of an
+// event package, and events with no capacity set, are not limited.
+func reserveEventCapacity(tx pgx.Tx, pricingID string, golfers int) error {
+	eventID, err := eventForPricing(tx, pricingID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil
+	case err != nil:
+		return fmt.Errorf("reserveEventCapacity: %v", err)
+	}
+
+	_, err = tx.Exec(context.Background(), "select pg_advisory_xact_lock($1, $2)", eventLockClass, eventID)
+	if err != nil {
+		return fmt.Errorf("reserveEventCapacity lock err: %v", err)
+	}
+
+	el, err := getEventCapacities(tx, "e.eventid = $1", eventID)
+	if err != nil {
+		return err
+	}
+	if len(el) == 1 && el[0].Capacity > 0 && el[0].Remaining < golfers {
+		return errEventFull
+	}
 	return nil
 }
 
 type registrationSummary struct {
-	SoloRegistration     int `json:"soloregistration"`
-	TwosomeRegistration  int `json:"twosomeregistration"`
-	FoursomeRegistration int `json:"foursomeregistration"`
+	SoloRegistration     int             `json:"soloregistration"`
+	TwosomeRegistration  int             `json:"twosomeregistration"`
+	FoursomeRegistration int             `json:"foursomeregistration"`
+	ReportFreshness      reportFreshness `json:"report_freshness"`
 }
 
-func (rs *registrationSummary) getRegistrationSummary(db *pgx.Conn) error {
+func (rs *registrationSummary) getRegistrationSummary(db Querier) error {
 	// Registration Summary
 	exec := fmt.Sprintf(`
 	select
-	sum(case when productName = 'Solo Registration' then qty else 0 end) as "Solo Registration",
-	sum(case when productName = 'Twosome Registration' then qty else 0 end) as "Twosome Registration",
-	sum(case when productName = 'Foursome Registration' then qty else 0 end) as "Foursome Registration"
-	from participant pa
-	inner join purchase pu on
-	pa.purchaseId = pu.purchaseId
+	coalesce(sum(registrations) filter (where productname = 'Solo Registration'), 0) as "Solo Registration",
+	coalesce(sum(registrations) filter (where productname = 'Twosome Registration'), 0) as "Twosome Registration",
+	coalesce(sum(registrations) filter (where productname = 'Foursome Registration'), 0) as "Foursome Registration"
+	from report_product
 	`)
 	row := db.QueryRow(context.Background(), exec)
 	err := row.Scan(&rs.SoloRegistration, &rs.TwosomeRegistration, &rs.FoursomeRegistration)
@@ -180,29 +358,33 @@ func (rs *registrationSummary) getRegistrationSummary(db *pgx.Conn) error {
 		return fmt.Errorf("getRegistrationSummary scan err: %v", err)
 	}
 
+	rs.ReportFreshness, err = readFreshness(db, "report_product")
+	if err != nil {
+		return fmt.Errorf("getRegistrationSummary: %v", err)
+	}
+
 	return nil
 }
 
 type shirtSummary struct {
-	Small   int `json:"small"`
-	Medium  int `json:"medium"`
-	Large   int `json:"large"`
-	XLarge  int `json:"xlarge"`
-	XXLarge int `json:"xxlarge"`
+	Small           int             `json:"small"`
+	Medium          int             `json:"medium"`
+	Large           int             `json:"large"`
+	XLarge          int             `json:"xlarge"`
+	XXLarge         int             `json:"xxlarge"`
+	ReportFreshness reportFreshness `json:"report_freshness"`
 }
 
-func (ss *shirtSummary) getShirtSummary(db *pgx.Conn) error {
+func (ss *shirtSummary) getShirtSummary(db Querier) error {
 	// Shirt Summary
 	exec := fmt.Sprintf(`
 	select
-	count(case when Name = 'SMALL' then 1 end) as "SMALL",
-	count(case when Name = 'MEDIUM' then 1 end) as "MEDIUM",
-	count(case when Name = 'LARGE' then 1 end) as "LARGE",
-	count(case when Name = 'X-LARGE' then 1 end) as "X-LARGE",
-	count(case when Name = '2X-LARGE' then 1 end) as "2X-LARGE"
-	from participant_option po
-	inner join option_item oi
-	on oi.optionitemsid = po.optionitemsid
+	coalesce(sum(participants) filter (where name = 'SMALL'), 0) as "SMALL",
+	coalesce(sum(participants) filter (where name = 'MEDIUM'), 0) as "MEDIUM",
+	coalesce(sum(participants) filter (where name = 'LARGE'), 0) as "LARGE",
+	coalesce(sum(participants) filter (where name = 'X-LARGE'), 0) as "X-LARGE",
+	coalesce(sum(participants) filter (where name = '2X-LARGE'), 0) as "2X-LARGE"
+	from report_option
 	`)
 	row := db.QueryRow(context.Background(), exec)
 	err := row.Scan(&ss.Small, &ss.Medium, &ss.Large, &ss.XLarge, &ss.XXLarge)
@@ -210,23 +392,27 @@ func (ss *shirtSummary) getShirtSummary(db *pgx.Conn) error {
 		return fmt.Errorf("getShirtSummary scan err: %v", err)
 	}
 
+	ss.ReportFreshness, err = readFreshness(db, "report_option")
+	if err != nil {
+		return fmt.Errorf("getShirtSummary: %v", err)
+	}
+
 	return nil
 }
 
 type clubSummary struct {
-	LeftHanded  int `json:"lefthanded"`
-	RightHanded int `json:"righthanded"`
+	LeftHanded      int             `json:"lefthanded"`
+	RightHanded     int             `json:"righthanded"`
+	ReportFreshness reportFreshness `json:"report_freshness"`
 }
 
-func (cs *clubSummary) getClubSummary(db *pgx.Conn) error {
+func (cs *clubSummary) getClubSummary(db Querier) error {
 	// Club Summary
 	exec := fmt.Sprintf(`
 	select
-	count(case when Name = 'LEFT-HANDED' then 1 end) as "LEFT-HANDED",
-	count(case when Name = 'RIGHT-HANDED' then 1 end) as "RIGHT-HANDED"
-	from participant_option po
-	inner join option_item oi
-	on oi.optionitemsid = po.optionitemsid
+	coalesce(sum(participants) filter (where name = 'LEFT-HANDED'), 0) as "LEFT-HANDED",
+	coalesce(sum(participants) filter (where name = 'RIGHT-HANDED'), 0) as "RIGHT-HANDED"
+	from report_option
 	`)
 	row := db.QueryRow(context.Background(), exec)
 	err := row.Scan(&cs.LeftHanded, &cs.RightHanded)
@@ -234,6 +420,11 @@ func (cs *clubSummary) getClubSummary(db *pgx.Conn) error {
 		return fmt.Errorf("getClubSummary scan err: %v", err)
 	}
 
+	cs.ReportFreshness, err = readFreshness(db, "report_option")
+	if err != nil {
+		return fmt.Errorf("getClubSummary: %v", err)
+	}
+
 	return nil
 }
 
@@ -247,48 +438,56 @@ type registration struct {
 	OrderDate  string   `json:"orderdate"`
 	SessionID  string   `json:"sessionid"`
 	PricingID  string   `json:"pricingid"`
+	CouponCode *string  `json:"couponcode"`
 	GolferInfo []golfer `json:"golferinfo"`
 }
 
-func (r registration) create(db *pgx.Conn) error {
-	var shoppingorderid int
-	var sessionid string
-	var orderdate time.Time
+// create adds the golfers to the session's shopping order and returns its id,
+// the registration rules of validationRules are expected to have passed but
+// the golfer count is checked again for callers that skip them. The
+// capacity check and the cart rows share one transaction, a registration that
+// fails leaves neither a reservation nor a partial cart behind.
+func (r registration) create(db Querier) (int, error) {
 	var shoppingcartid int
 	var cartparticipantid int
 
-	exec := fmt.Sprintf("select * from shopping_order where sessionid = $1")
-	err := db.QueryRow(context.Background(), exec, r.SessionID).Scan(&shoppingorderid, &orderdate, &sessionid)
-	switch {
-	case errors.Is(err, pgx.ErrNoRows):
-		exec = fmt.Sprintf("insert into shopping_order(orderdate, sessionid) values($1, $2) returning shoppingorderid")
-		err = db.QueryRow(context.Background(), exec, r.OrderDate, r.SessionID).Scan(&shoppingorderid)
-		if err != nil {
-			return fmt.Errorf("shopping_order: %v", err)
-		}
+	err := checkCount("registration", "golferinfo", len(r.GolferInfo))
+	if err != nil {
+		return 0, err
+	}
 
-	case err != nil:
-		return fmt.Errorf("select shopping_order: %v", err)
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback(context.Background())
 
-	qty := 1
-	exec = fmt.Sprintf(`
-	insert into shopping_cart(shoppingorderid, pricingid, qty)
-	values ($1, $2, $3) returning shoppingcartid`)
-	err = db.QueryRow(context.Background(), exec, shoppingorderid, r.PricingID, qty).Scan(&shoppingcartid)
+	err = reserveEventCapacity(tx, r.PricingID, len(r.GolferInfo))
 	if err != nil {
-		return fmt.Errorf("shopping_cart: %v", err)
+		return 0, err
 	}
 
-	golfers := len(r.GolferInfo)
-	if golfers > 4 {
-		return fmt.Errorf("error: incorrect number of golfers")
+	// concurrent requests for the same session converge on one shopping_order
+	// (needs a unique constraint on sessionid), the no-op update makes the
+	// existing row return its id
+	so := shopping_order{OrderDate: r.OrderDate, SessionID: r.SessionID}
+	shoppingorderid, err := so.create(tx, "shopping_order", onConflict{
+		Columns: []string{"sessionid"},
+		Update:  []string{"sessionid"},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("shopping_order: %v", err)
 	}
-	if golfers == 3 {
-		return fmt.Errorf("error: incorrect number of golfers")
+
+	sc := shopping_cart{
+		ShoppingOrderID: strconv.Itoa(shoppingorderid),
+		PricingID:       r.PricingID,
+		Qty:             "1",
+		CouponCode:      r.CouponCode,
 	}
-	if golfers <= 0 {
-		return fmt.Errorf("error: incorrect number of golfers")
+	shoppingcartid, err = sc.create(tx, "shopping_cart", onConflict{})
+	if err != nil {
+		return 0, fmt.Errorf("shopping_cart: %v", err)
 	}
 
 	//var cartparticipantid int
@@ -296,47 +495,41 @@ func (r registration) create(db *pgx.Conn) error {
 		exec := fmt.Sprintf(`
 		insert into cart_participant(shoppingcartid, name)
 		values ($1, $2) returning cartparticipantid`)
-		err = db.QueryRow(context.Background(), exec, shoppingcartid, g.Name).Scan(&cartparticipantid)
+		err = tx.QueryRow(context.Background(), exec, shoppingcartid, g.Name).Scan(&cartparticipantid)
 		if err != nil {
-			return fmt.Errorf("cart_participant: %v", err)
+			return 0, fmt.Errorf("cart_participant: %v", err)
 		}
 
 		shirtsize, err := strconv.Atoi(g.ShirtSize)
 		if err != nil {
-			return err
+			return 0, err
 		}
 		exec = fmt.Sprintf(`
 		insert into cart_participant_option(cartparticipantid, optionitemsid)
 		values ($1, $2)`)
-		rows, err := db.Query(context.Background(), exec, cartparticipantid, shirtsize)
+		_, err = tx.Exec(context.Background(), exec, cartparticipantid, shirtsize)
 		if err != nil {
-			return fmt.Errorf("cart_participant_option: shirtsize: %v", err)
-		}
-		for rows.Next() {
-			rows.Close()
+			return 0, fmt.Errorf("cart_participant_option: shirtsize: %v", err)
 		}
 
 		if g.Dexterity != "" {
 			dexterity, err := strconv.Atoi(g.Dexterity)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			if dexterity > 5 && dexterity < 8 {
 				exec = fmt.Sprintf(`
 				insert into cart_participant_option(cartparticipantid, optionitemsid)
 				values ($1, $2)`)
-				rows, err = db.Query(context.Background(), exec, cartparticipantid, dexterity)
+				_, err = tx.Exec(context.Background(), exec, cartparticipantid, dexterity)
 				if err != nil {
-					return fmt.Errorf("cart_participant_option: dexterity: %v", err)
-				}
-				for rows.Next() {
-					rows.Close()
+					return 0, fmt.Errorf("cart_participant_option: dexterity: %v", err)
 				}
 			}
 		}
 	}
 
-	return nil
+	return shoppingorderid, tx.Commit(context.Background())
 }
 
 type cart_participant struct {
@@ -345,7 +538,7 @@ type cart_participant struct {
 	Name              string `json:"name"`
 }
 
-func updateCartParticipant(db *pgx.Conn, d Data, i cart_participant) error {
+func updateCartParticipant(db Querier, d Data, i cart_participant) error {
 
 	// convert struct to map
 	imap := make(map[string]string)
@@ -360,75 +553,86 @@ func updateCartParticipant(db *pgx.Conn, d Data, i cart_participant) error {
 	return fmt.Errorf("updatesalesorder: %v, sql string: %v", err.Error(), exec)
 }
 
-func (c cart_participant) create(db *pgx.Conn, table string) (int, error) {
-	var cartparticipantid int
-	exec := fmt.Sprintf("insert into %v(shoppingcartid, name) values($1, $2) returning cartparticipantid", table)
-	err := db.QueryRow(context.Background(), exec, c.ShoppingCartID, c.Name).Scan(&cartparticipantid)
-	return cartparticipantid, err
+func (c cart_participant) create(db Querier, table string, oc onConflict) (int, error) {
+	conflict, err := oc.clause()
+	if err != nil {
+		return 0, err
+	}
+	exec := fmt.Sprintf("insert into %v(shoppingcartid, name) values($1, $2)%v returning cartparticipantid", table, conflict)
+	return insertReturning(db, oc, exec, c.ShoppingCartID, c.Name)
+}
+
+// scan reads a cart_participant from a row of select *, as readall answers it
+func (c *cart_participant) scan(rows pgx.Rows) error {
+	var cpID int
+	var scID int
+	err := rows.Scan(&cpID, &scID, &c.Name)
+	if err != nil {
+		return err
+	}
+	c.CartParticipantID = strconv.Itoa(cpID)
+	c.ShoppingCartID = strconv.Itoa(scID)
+	return nil
 }
 
-func (c *cart_participant) readall(db *pgx.Conn, table string) ([]cart_participant, error) {
-	var so cart_participant
-	var sl []cart_participant
+func (c *cart_participant) readall(db Querier, table string) ([]cart_participant, error) {
+	var cp cart_participant
+	var cl []cart_participant
 	query := fmt.Sprintf("select * from %v", table)
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&c.ShoppingCartID, &c.Name)
+		err := cp.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		sl = append(sl, so)
+		cl = append(cl, cp)
 	}
-	return sl, nil
+	return cl, nil
 }
 
-func (c *cart_participant) read(db *pgx.Conn, table, field, value string) ([]cart_participant, error) {
+func (c *cart_participant) read(db Querier, table, field, value string) ([]cart_participant, error) {
 	var cp cart_participant
 	var cl []cart_participant
-	var cpID int
-	var scID int
 	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&cpID, &scID, &cp.Name)
+		err := cp.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		cp.CartParticipantID = strconv.Itoa(cpID)
-		cp.ShoppingCartID = strconv.Itoa(scID)
 		cl = append(cl, cp)
 	}
 	return cl, nil
 }
 
-func (c *cart_participant) del(db *pgx.Conn, table, field, value string) error {
-	exec := fmt.Sprintf("delete from %v where %v=$1", table, field)
-	_, err := db.Exec(context.Background(), exec, value)
-	return err
+type category_options struct {
+	ID                int        `json:"id"`
+	PackageCategoryID int        `json:"packagecategoryid"`
+	Name              string     `json:"name"`
+	DeletedAt         *time.Time `json:"deletedat,omitempty"`
 }
 
-type category_options struct {
-	ID                int    `json:"id"`
-	PackageCategoryID int    `json:"packagecategoryid"`
-	Name              string `json:"name"`
+// scan reads a category_options from a row of select *, as readall answers it
+func (c *category_options) scan(rows pgx.Rows) error {
+	return rows.Scan(&c.ID, &c.PackageCategoryID, &c.Name, &c.DeletedAt)
 }
 
-func (c *category_options) readall(db *pgx.Conn, table string) ([]category_options, error) {
+func (c *category_options) readall(db Querier, table string, includeDeleted bool) ([]category_options, error) {
 	var co category_options
 	var cl []category_options
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&co.ID, &co.PackageCategoryID, &co.Name)
+		err := co.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -437,16 +641,16 @@ func (c *category_options) readall(db *pgx.Conn, table string) ([]category_optio
 	return cl, nil
 }
 
-func (c *category_options) read(db *pgx.Conn, table, field, value string) ([]category_options, error) {
+func (c *category_options) read(db Querier, table, field, value string, includeDeleted bool) ([]category_options, error) {
 	var co category_options
 	var cl []category_options
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&co.ID, &co.PackageCategoryID, &co.Name)
+		err := co.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -456,18 +660,21 @@ func (c *category_options) read(db *pgx.Conn, table, field, value string) ([]cat
 }
 
 type salesorder struct {
-	SalesOrderID int    `json:"salesorderid"`
-	OrderDate    string `json:"orderdate"`  // conv to time.Time
-	CustomerID   string `json:"customerid"` // conv to int
-	PaymentID    string `json:"paymentid"`
-	InvoiceNo    string `json:"invoiceno"`
+	SalesOrderID  int        `json:"salesorderid"`
+	OrderDate     string     `json:"orderdate"`  // conv to time.Time
+	CustomerID    string     `json:"customerid"` // conv to int
+	PaymentID     string     `json:"paymentid"`
+	InvoiceNo     string     `json:"invoiceno"`
+	Tax           *string    `json:"tax,omitempty"`
+	PaymentStatus *string    `json:"paymentstatus,omitempty"`
+	DeletedAt     *time.Time `json:"deletedat,omitempty"`
 }
 
 func (s *salesorder) Normalize() {
 	strconv.Atoi(s.CustomerID)
 }
 
-func updateSalesOrder(db *pgx.Conn, d Data, i salesorder) error {
+func updateSalesOrder(db Querier, d Data, i salesorder) error {
 	i.Normalize()
 
 	// convert struct to map
@@ -483,24 +690,41 @@ func updateSalesOrder(db *pgx.Conn, d Data, i salesorder) error {
 	return fmt.Errorf("updatesalesorder: %v, sql string: %v", err.Error(), exec)
 }
 
-func (s salesorder) create(db *pgx.Conn, table string) error {
+func (s salesorder) create(db Querier, table string, oc onConflict) error {
 	s.Normalize()
-	exec := fmt.Sprintf("insert into %v(salesorderid, orderdate, customerid, paymentid, invoiceno) values($1, $2, $3, $4, $5)", table)
-	_, err := db.Exec(context.Background(), exec, s.SalesOrderID, s.OrderDate, s.CustomerID, s.PaymentID, s.InvoiceNo)
+	conflict, err := oc.clause()
+	if err != nil {
+		return err
+	}
+	exec := fmt.Sprintf("insert into %v(salesorderid, orderdate, customerid, paymentid, invoiceno) values($1, $2, $3, $4, $5)%v", table, conflict)
+	_, err = db.Exec(context.Background(), exec, s.SalesOrderID, s.OrderDate, s.CustomerID, s.PaymentID, s.InvoiceNo)
 	return err
 }
 
-func (s *salesorder) readall(db *pgx.Conn, table string) ([]salesorder, error) {
+// scan reads a salesorder from a row of select *, as readall answers it
+func (s *salesorder) scan(rows pgx.Rows) error {
+	var orderdate time.Time
+	var customerid int
+	err := rows.Scan(&s.SalesOrderID, &orderdate, &customerid, &s.PaymentID, &s.InvoiceNo, &s.Tax, &s.PaymentStatus, &s.DeletedAt)
+	if err != nil {
+		return err
+	}
+	s.OrderDate = orderdate.String()
+	s.CustomerID = strconv.Itoa(customerid)
+	return nil
+}
+
+func (s *salesorder) readall(db Querier, table string, includeDeleted bool) ([]salesorder, error) {
 	s.Normalize()
 	var so salesorder
 	var sl []salesorder
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&so.SalesOrderID, &so.OrderDate, &so.CustomerID, &so.PaymentID, &so.InvoiceNo)
+		err := so.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -509,17 +733,17 @@ func (s *salesorder) readall(db *pgx.Conn, table string) ([]salesorder, error) {
 	return sl, nil
 }
 
-func (s *salesorder) read(db *pgx.Conn, table, field, value string) ([]salesorder, error) {
+func (s *salesorder) read(db Querier, table, field, value string, includeDeleted bool) ([]salesorder, error) {
 	s.Normalize()
 	var so salesorder
 	var sl []salesorder
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&so.SalesOrderID, &so.OrderDate, &so.CustomerID, &so.PaymentID, &so.InvoiceNo)
+		err := so.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -529,12 +753,15 @@ func (s *salesorder) read(db *pgx.Conn, table, field, value string) ([]salesorde
 }
 
 type shopping_order struct {
-	ShoppingOrderID string `json:"shoppingorderid"` //int
-	OrderDate       string `json:"orderdate"`
-	SessionID       string `json:"sessionid"`
+	ShoppingOrderID string     `json:"shoppingorderid"` //int
+	OrderDate       string     `json:"orderdate"`
+	SessionID       string     `json:"sessionid"`
+	PaymentID       *string    `json:"paymentid,omitempty"`
+	PaymentStatus   *string    `json:"paymentstatus,omitempty"`
+	LastActivityAt  *time.Time `json:"lastactivityat,omitempty"`
 }
 
-func updateShoppingOrder(db *pgx.Conn, d Data, i shopping_order) error {
+func updateShoppingOrder(db Querier, d Data, i shopping_order) error {
 	// convert struct to map
 	imap := make(map[string]string)
 	m, err := json.Marshal(i)
@@ -548,20 +775,29 @@ func updateShoppingOrder(db *pgx.Conn, d Data, i shopping_order) error {
 	return err
 }
 
-func (s shopping_order) create(db *pgx.Conn, table string) (int, error) {
-	var shoppingorderid int
-	exec := fmt.Sprintf("insert into %v(orderdate, sessionid) values($1, $2) returning shoppingorderid", table)
-	err := db.QueryRow(context.Background(), exec, s.OrderDate, s.SessionID).Scan(&shoppingorderid)
-	return shoppingorderid, err
+func (s shopping_order) create(db Querier, table string, oc onConflict) (int, error) {
+	conflict, err := oc.clause()
+	if err != nil {
+		return 0, err
+	}
+	exec := fmt.Sprintf("insert into %v(orderdate, sessionid) values($1, $2)%v returning shoppingorderid", table, conflict)
+	return insertReturning(db, oc, exec, s.OrderDate, s.SessionID)
 }
 
-func (s *shopping_order) del(db *pgx.Conn, table, field, value string) error {
-	exec := fmt.Sprintf("delete from %v where %v=$1", table, field)
-	_, err := db.Exec(context.Background(), exec, value)
-	return err
+// scan reads a shopping_order from a row of select *, as readall answers it
+func (s *shopping_order) scan(rows pgx.Rows) error {
+	var shoppingorderid int
+	var t time.Time
+	err := rows.Scan(&shoppingorderid, &t, &s.SessionID, &s.PaymentID, &s.PaymentStatus, &s.LastActivityAt)
+	if err != nil {
+		return err
+	}
+	s.ShoppingOrderID = strconv.Itoa(shoppingorderid)
+	s.OrderDate = t.String()
+	return nil
 }
 
-func (s *shopping_order) readall(db *pgx.Conn, table string) ([]shopping_order, error) {
+func (s *shopping_order) readall(db Querier, table string) ([]shopping_order, error) {
 	var so shopping_order
 	var sl []shopping_order
 	query := fmt.Sprintf("select * from %v", table)
@@ -570,7 +806,7 @@ func (s *shopping_order) readall(db *pgx.Conn, table string) ([]shopping_order,
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&so.ShoppingOrderID, &so.OrderDate, &so.SessionID)
+		err := so.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -579,48 +815,50 @@ func (s *shopping_order) readall(db *pgx.Conn, table string) ([]shopping_order,
 	return sl, nil
 }
 
-func (s *shopping_order) read(db *pgx.Conn, table, field, value string) ([]shopping_order, error) {
+func (s *shopping_order) read(db Querier, table, field, value string) ([]shopping_order, error) {
 	var so shopping_order
 	var sl []shopping_order
-	var shoppingorderid int
-	var t time.Time
 	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&shoppingorderid, &t, &so.SessionID)
+		err := so.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		so.ShoppingOrderID = strconv.Itoa(shoppingorderid)
-		so.OrderDate = t.String()
 		sl = append(sl, so)
 	}
 	return sl, nil
 }
 
 type organization struct {
-	ID       uuid.UUID `json:"id"`
-	Name     string    `json:"name"`
-	Address  string    `json:"address"`
-	City     string    `json:"city"`
-	State    string    `json:"state"`
-	PostCode string    `json:"postcode"`
-	IsActive bool      `json:"isactive"`
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Address   string     `json:"address"`
+	City      string     `json:"city"`
+	State     string     `json:"state"`
+	PostCode  string     `json:"postcode"`
+	IsActive  bool       `json:"isactive"`
+	DeletedAt *time.Time `json:"deletedat,omitempty"`
+}
+
+// scan reads a organization from a row of select *, as readall answers it
+func (o *organization) scan(rows pgx.Rows) error {
+	return rows.Scan(&o.ID, &o.Name, &o.Address, &o.City, &o.State, &o.PostCode, &o.IsActive, &o.DeletedAt)
 }
 
-func (o *organization) readall(db *pgx.Conn, table string) ([]organization, error) {
+func (o *organization) readall(db Querier, table string, includeDeleted bool) ([]organization, error) {
 	var or organization
 	var oa []organization
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&or.ID, &or.Name, &or.Address, &or.City, &or.State, &or.PostCode, &or.IsActive)
+		err := or.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -629,16 +867,16 @@ func (o *organization) readall(db *pgx.Conn, table string) ([]organization, erro
 	return oa, nil
 }
 
-func (o *organization) read(db *pgx.Conn, table, field, value string) ([]organization, error) {
+func (o *organization) read(db Querier, table, field, value string, includeDeleted bool) ([]organization, error) {
 	var or organization
 	var oa []organization
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&or.ID, &or.Name, &or.Address, &or.City, &or.State, &or.PostCode, &or.IsActive)
+		err := or.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -648,25 +886,31 @@ func (o *organization) read(db *pgx.Conn, table, field, value string) ([]organiz
 }
 
 type event struct {
-	ID             int       `json:"id"`
-	OrganizationID uuid.UUID `json:"organizationid"`
-	Name           string    `json:"name"`
-	Location       string    `json:"location"`
-	Capacity       int       `json:"capacity"`
-	StartsOn       time.Time `json:"startson"`
-	EndsOn         time.Time `json:"endson"`
+	ID             int        `json:"id"`
+	OrganizationID uuid.UUID  `json:"organizationid"`
+	Name           string     `json:"name"`
+	Location       string     `json:"location"`
+	Capacity       int        `json:"capacity"`
+	StartsOn       time.Time  `json:"startson"`
+	EndsOn         time.Time  `json:"endson"`
+	DeletedAt      *time.Time `json:"deletedat,omitempty"`
+}
+
+// scan reads a event from a row of select *, as readall answers it
+func (e *event) scan(rows pgx.Rows) error {
+	return rows.Scan(&e.ID, &e.OrganizationID, &e.Name, &e.Location, &e.Capacity, &e.StartsOn, &e.EndsOn, &e.DeletedAt)
 }
 
-func (e *event) readall(db *pgx.Conn, table string) ([]event, error) {
+func (e *event) readall(db Querier, table string, includeDeleted bool) ([]event, error) {
 	var ev event
 	var el []event
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&ev.ID, &ev.OrganizationID, &ev.Name, &ev.Location, &ev.Capacity, &ev.StartsOn, &ev.EndsOn)
+		err := ev.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -675,16 +919,16 @@ func (e *event) readall(db *pgx.Conn, table string) ([]event, error) {
 	return el, nil
 }
 
-func (e *event) read(db *pgx.Conn, table, field, value string) ([]event, error) {
+func (e *event) read(db Querier, table, field, value string, includeDeleted bool) ([]event, error) {
 	var ev event
 	var el []event
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&ev.ID, &ev.OrganizationID, &ev.Name, &ev.Location, &ev.Capacity, &ev.StartsOn, &ev.EndsOn)
+		err := ev.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -694,20 +938,21 @@ func (e *event) read(db *pgx.Conn, table, field, value string) ([]event, error)
 }
 
 type payment_provider struct {
-	ID   uuid.UUID `json:"id"`
-	Name string    `json:"name"`
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	DeletedAt *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p *payment_provider) readall(db *pgx.Conn, table string) ([]payment_provider, error) {
+func (p *payment_provider) readall(db Querier, table string, includeDeleted bool) ([]payment_provider, error) {
 	var pp payment_provider
 	var pl []payment_provider
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pp.ID, &pp.Name)
+		err := rows.Scan(&pp.ID, &pp.Name, &pp.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -716,16 +961,16 @@ func (p *payment_provider) readall(db *pgx.Conn, table string) ([]payment_provid
 	return pl, nil
 }
 
-func (p *payment_provider) read(db *pgx.Conn, table, field, value string) ([]payment_provider, error) {
+func (p *payment_provider) read(db Querier, table, field, value string, includeDeleted bool) ([]payment_provider, error) {
 	var pp payment_provider
 	var pl []payment_provider
-	query := fmt.Sprintf("select * from %v, where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pp.ID, &pp.Name)
+		err := rows.Scan(&pp.ID, &pp.Name, &pp.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -735,23 +980,30 @@ func (p *payment_provider) read(db *pgx.Conn, table, field, value string) ([]pay
 }
 
 type customer struct {
-	ID             int       `json:"id"`
-	OrganizationID uuid.UUID `json:"organizationid"`
-	Name           string    `json:"name"`
-	Email          string    `json:"email"`
-	Phone          string    `json:"phone"`
+	ID             int        `json:"id"`
+	OrganizationID uuid.UUID  `json:"organizationid"`
+	Name           string     `json:"name"`
+	Email          string     `json:"email"`
+	Phone          string     `json:"phone"`
+	DeletedAt      *time.Time `json:"deletedat,omitempty"`
+	MergedInto     *int       `json:"mergedinto,omitempty"`
+}
+
+// scan reads a customer from a row of select *, as readall answers it
+func (c *customer) scan(rows pgx.Rows) error {
+	return rows.Scan(&c.ID, &c.OrganizationID, &c.Name, &c.Email, &c.Phone, &c.DeletedAt, &c.MergedInto)
 }
 
-func (c *customer) readall(db *pgx.Conn, table string) ([]customer, error) {
+func (c *customer) readall(db Querier, table string, includeDeleted bool) ([]customer, error) {
 	var cu customer
 	var cl []customer
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&cu.ID, &cu.OrganizationID, &cu.Name, &cu.Email, &cu.Phone)
+		err := cu.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -760,16 +1012,16 @@ func (c *customer) readall(db *pgx.Conn, table string) ([]customer, error) {
 	return cl, nil
 }
 
-func (c *customer) read(db *pgx.Conn, table, field, value string) ([]customer, error) {
+func (c *customer) read(db Querier, table, field, value string, includeDeleted bool) ([]customer, error) {
 	var cu customer
 	var cl []customer
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&cu.ID, &cu.OrganizationID, &cu.Name, &cu.Email, &cu.Phone)
+		err := cu.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -779,24 +1031,25 @@ func (c *customer) read(db *pgx.Conn, table, field, value string) ([]customer, e
 }
 
 type _package struct {
-	ID                int    `json:"id"`
-	EventID           int    `json:"eventid"`
-	ProductID         string `json:"productid"`
-	PackageCategoryID int    `json:"packagecategoryid"`
-	Name              string `json:"name"`
-	Description       string `json:"description"`
+	ID                int        `json:"id"`
+	EventID           int        `json:"eventid"`
+	ProductID         string     `json:"productid"`
+	PackageCategoryID int        `json:"packagecategoryid"`
+	Name              string     `json:"name"`
+	Description       string     `json:"description"`
+	DeletedAt         *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p *_package) readall(db *pgx.Conn, table string) ([]_package, error) {
+func (p *_package) readall(db Querier, table string, includeDeleted bool) ([]_package, error) {
 	var pa _package
 	var pl []_package
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pa.ID, &pa.EventID, &pa.ProductID, &pa.PackageCategoryID, &pa.Name, &pa.Description)
+		err := rows.Scan(&pa.ID, &pa.EventID, &pa.ProductID, &pa.PackageCategoryID, &pa.Name, &pa.Description, &pa.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -806,19 +1059,22 @@ func (p *_package) readall(db *pgx.Conn, table string) ([]_package, error) {
 }
 
 type product struct {
-	PaymentProviderID uuid.UUID `json:"paymentproviderid"`
+	ID                string     `json:"id"`
+	Description       string     `json:"description"`
+	PaymentProviderID uuid.UUID  `json:"paymentproviderid"`
+	DeletedAt         *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p *product) readall(db *pgx.Conn, table string) ([]product, error) {
+func (p *product) readall(db Querier, table string, includeDeleted bool) ([]product, error) {
 	var pr product
 	var pl []product
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pr.PaymentProviderID)
+		err := rows.Scan(&pr.ID, &pr.Description, &pr.PaymentProviderID, &pr.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -828,21 +1084,27 @@ func (p *product) readall(db *pgx.Conn, table string) ([]product, error) {
 }
 
 type option_items struct {
-	ID                int    `json:"id"`
-	CategoryOptionsID int    `json:"categoryoptionsid"`
-	Name              string `json:"name"`
+	ID                int        `json:"id"`
+	CategoryOptionsID int        `json:"categoryoptionsid"`
+	Name              string     `json:"name"`
+	DeletedAt         *time.Time `json:"deletedat,omitempty"`
+}
+
+// scan reads a option_items from a row of select *, as readall answers it
+func (o *option_items) scan(rows pgx.Rows) error {
+	return rows.Scan(&o.ID, &o.CategoryOptionsID, &o.Name, &o.DeletedAt)
 }
 
-func (o *option_items) readall(db *pgx.Conn, table string) ([]option_items, error) {
+func (o *option_items) readall(db Querier, table string, includeDeleted bool) ([]option_items, error) {
 	var oi option_items
 	var ol []option_items
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&oi.ID, &oi.CategoryOptionsID, &oi.Name)
+		err := oi.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -851,16 +1113,16 @@ func (o *option_items) readall(db *pgx.Conn, table string) ([]option_items, erro
 	return ol, nil
 }
 
-func (o *option_items) read(db *pgx.Conn, table, field, value string) ([]option_items, error) {
+func (o *option_items) read(db Querier, table, field, value string, includeDeleted bool) ([]option_items, error) {
 	var oi option_items
 	var ol []option_items
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&oi.ID, &oi.CategoryOptionsID, &oi.Name)
+		err := oi.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -870,20 +1132,22 @@ func (o *option_items) read(db *pgx.Conn, table, field, value string) ([]option_
 }
 
 type pricing struct {
-	PricingID string `json:"pricingid"`
-	ProductID string `json:"productid"`
+	PricingID string     `json:"pricingid"`
+	ProductID string     `json:"productid"`
+	Price     string     `json:"price"`
+	DeletedAt *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p *pricing) readall(db *pgx.Conn, table string) ([]pricing, error) {
+func (p *pricing) readall(db Querier, table string, includeDeleted bool) ([]pricing, error) {
 	var pr pricing
 	var pl []pricing
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pr.PricingID, &pr.ProductID)
+		err := rows.Scan(&pr.PricingID, &pr.ProductID, &pr.Price, &pr.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -892,16 +1156,16 @@ func (p *pricing) readall(db *pgx.Conn, table string) ([]pricing, error) {
 	return pl, nil
 }
 
-func (p *pricing) read(db *pgx.Conn, table, field, value string) ([]pricing, error) {
+func (p *pricing) read(db Querier, table, field, value string, includeDeleted bool) ([]pricing, error) {
 	var pr pricing
 	var pl []pricing
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pr.PricingID, &pr.ProductID)
+		err := rows.Scan(&pr.PricingID, &pr.ProductID, &pr.Price, &pr.DeletedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -911,24 +1175,32 @@ func (p *pricing) read(db *pgx.Conn, table, field, value string) ([]pricing, err
 }
 
 type purchase struct {
-	ID          int    `json:"id"`
-	OrderID     int    `json:"orderid"`
-	Qty         int    `json:"qty"`
-	ProductName string `json:"productname"`
-	Description string `json:"description"`
-	Price       string `json:"price"`
+	ID            int        `json:"id"`
+	OrderID       int        `json:"orderid"`
+	Qty           int        `json:"qty"`
+	ProductName   string     `json:"productname"`
+	Description   string     `json:"description"`
+	Price         string     `json:"price"`
+	PricingRuleID *int       `json:"pricingruleid,omitempty"`
+	DeletedAt     *time.Time `json:"deletedat,omitempty"`
+	PricingID     *string    `json:"pricingid,omitempty"`
 }
 
-func (p *purchase) readall(db *pgx.Conn, table string) ([]purchase, error) {
+// scan reads a purchase from a row of select *, as readall answers it
+func (p *purchase) scan(rows pgx.Rows) error {
+	return rows.Scan(&p.ID, &p.OrderID, &p.Qty, &p.ProductName, &p.Description, &p.Price, &p.PricingRuleID, &p.DeletedAt, &p.PricingID)
+}
+
+func (p *purchase) readall(db Querier, table string, includeDeleted bool) ([]purchase, error) {
 	var pu purchase
 	var pl []purchase
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pu.ID, &pu.OrderID, &pu.Qty, &pu.ProductName, &pu.Description, &pu.Price)
+		err := pu.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -937,16 +1209,16 @@ func (p *purchase) readall(db *pgx.Conn, table string) ([]purchase, error) {
 	return pl, nil
 }
 
-func (p *purchase) read(db *pgx.Conn, table, field, value string) ([]purchase, error) {
+func (p *purchase) read(db Querier, table, field, value string, includeDeleted bool) ([]purchase, error) {
 	var pu purchase
 	var pl []purchase
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pu.ID, &pu.OrderID, &pu.Qty, &pu.ProductName, &pu.Description, &pu.Price)
+		err := pu.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -956,28 +1228,47 @@ func (p *purchase) read(db *pgx.Conn, table, field, value string) ([]purchase, e
 }
 
 type participant struct {
-	ParticipantID string `json:"participantid"` // conv to int
-	PurchaseID    string `json:"purshaseid"`    // conv to int
-	Name          string `json:"name"`
+	ParticipantID string     `json:"participantid"` // conv to int
+	PurchaseID    string     `json:"purshaseid"`    // conv to int
+	Name          string     `json:"name"`
+	CancelledAt   *time.Time `json:"cancelledat,omitempty"`
+	DeletedAt     *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p participant) create(db *pgx.Conn, table string) error {
+func (p participant) create(db Querier, table string, oc onConflict) error {
 	puid, _ := strconv.Atoi(p.PurchaseID)
-	exec := fmt.Sprintf("insert into %v(purchaseid, name) values($1, $2)", table)
-	_, err := db.Exec(context.Background(), exec, puid, p.Name)
+	conflict, err := oc.clause()
+	if err != nil {
+		return err
+	}
+	exec := fmt.Sprintf("insert into %v(purchaseid, name) values($1, $2)%v", table, conflict)
+	_, err = db.Exec(context.Background(), exec, puid, p.Name)
 	return err
 }
 
-func (p *participant) readall(db *pgx.Conn, table string) ([]participant, error) {
+// scan reads a participant from a row of select *, as readall answers it
+func (p *participant) scan(rows pgx.Rows) error {
+	var participantid int
+	var purchaseid int
+	err := rows.Scan(&participantid, &purchaseid, &p.Name, &p.CancelledAt, &p.DeletedAt)
+	if err != nil {
+		return err
+	}
+	p.ParticipantID = strconv.Itoa(participantid)
+	p.PurchaseID = strconv.Itoa(purchaseid)
+	return nil
+}
+
+func (p *participant) readall(db Querier, table string, includeDeleted bool) ([]participant, error) {
 	var pa participant
 	var pl []participant
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pa.ParticipantID, &pa.PurchaseID, &pa.Name)
+		err := pa.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -986,16 +1277,16 @@ func (p *participant) readall(db *pgx.Conn, table string) ([]participant, error)
 	return pl, nil
 }
 
-func (p *participant) read(db *pgx.Conn, table, field, value string) ([]participant, error) {
+func (p *participant) read(db Querier, table, field, value string, includeDeleted bool) ([]participant, error) {
 	var pa participant
 	var pl []participant
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&pa.ParticipantID, &pa.PurchaseID, &pa.Name)
+		err := pa.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -1005,21 +1296,27 @@ func (p *participant) read(db *pgx.Conn, table, field, value string) ([]particip
 }
 
 type participant_options struct {
-	ID            int `json:"id"`
-	ParticipantID int `json:"participantid"`
-	OptionItemsID int `json:"optionitemsid"`
+	ID            int        `json:"id"`
+	ParticipantID int        `json:"participantid"`
+	OptionItemsID int        `json:"optionitemsid"`
+	DeletedAt     *time.Time `json:"deletedat,omitempty"`
 }
 
-func (p *participant_options) readall(db *pgx.Conn, table string) ([]participant_options, error) {
+// scan reads a participant_options from a row of select *, as readall answers it
+func (p *participant_options) scan(rows pgx.Rows) error {
+	return rows.Scan(&p.ID, &p.ParticipantID, &p.OptionItemsID, &p.DeletedAt)
+}
+
+func (p *participant_options) readall(db Querier, table string, includeDeleted bool) ([]participant_options, error) {
 	var po participant_options
 	var pl []participant_options
-	query := fmt.Sprintf("select * from %v", table)
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&po.ID, &po.ParticipantID, &po.OptionItemsID)
+		err := po.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -1028,16 +1325,16 @@ func (p *participant_options) readall(db *pgx.Conn, table string) ([]participant
 	return pl, nil
 }
 
-func (p *participant_options) read(db *pgx.Conn, table, field, value string) ([]participant_options, error) {
+func (p *participant_options) read(db Querier, table, field, value string, includeDeleted bool) ([]participant_options, error) {
 	var po participant_options
 	var pl []participant_options
-	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, field, deletedFilter(includeDeleted))
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&po.ID, &po.ParticipantID, &po.OptionItemsID)
+		err := po.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -1047,17 +1344,20 @@ func (p *participant_options) read(db *pgx.Conn, table, field, value string) ([]
 }
 
 type shopping_cart struct {
-	ShoppingCartID  string `json:"shoppingcartid"`  //conv to int
-	ShoppingOrderID string `json:"shoppingorderid"` //conv to int
-	PricingID       string `json:"pricingid"`
-	Qty             string `json:"qty"` //conv to int
+	ShoppingCartID  string  `json:"shoppingcartid"`  //conv to int
+	ShoppingOrderID string  `json:"shoppingorderid"` //conv to int
+	PricingID       string  `json:"pricingid"`
+	Qty             string  `json:"qty"` //conv to int
+	Price           *string `json:"price,omitempty"`
+	PricingRuleID   *int    `json:"pricingruleid,omitempty"`
+	CouponCode      *string `json:"couponcode,omitempty"`
 }
 
 // UpdateShoppingCart takes two shopping_cart object Unmarshalled from JSON
 // into Data struct's Update.Identifier and Update.UpdateField, these objects
 // are used to identify the row needed to be updated and to Update the field
 // required.
-func updateShoppingCart(db *pgx.Conn, d Data, i shopping_cart) error {
+func updateShoppingCart(db Querier, d Data, i shopping_cart) error {
 
 	// convert struct to map
 	imap := make(map[string]string)
@@ -1072,67 +1372,87 @@ func updateShoppingCart(db *pgx.Conn, d Data, i shopping_cart) error {
 	return err
 }
 
-func (s shopping_cart) create(db *pgx.Conn, table string) (int, error) {
-	var shoppingcartid int
-	exec := fmt.Sprintf("insert into %v(shoppingorderid, pricingid, qty) values($1, $2, $3) returning shoppingcartid", table)
-	err := db.QueryRow(context.Background(), exec, s.ShoppingOrderID, s.PricingID, s.Qty).Scan(&shoppingcartid)
-	return shoppingcartid, err
+// create prices the line with priceFor as of now for the order's quantity of
+// the pricing, counting this line, and prices the order's other lines of the
+// pricing again for it. The price and rule are kept on the line and checked
+// again by migrateData.
+func (s shopping_cart) create(db Querier, table string, oc onConflict) (int, error) {
+	conflict, err := oc.clause()
+	if err != nil {
+		return 0, err
+	}
+	qty, err := strconv.Atoi(s.Qty)
+	if err != nil {
+		return 0, fmt.Errorf("qty: %v", err)
+	}
+	held, err := orderQty(db, s.ShoppingOrderID, s.PricingID)
+	if err != nil {
+		return 0, err
+	}
+	ap, err := priceFor(db, s.PricingID, held+qty, s.CouponCode, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	exec := fmt.Sprintf(`insert into %v(shoppingorderid, pricingid, qty, price, pricingruleid, couponcode)
+	values($1, $2, $3, $4, $5, $6)%v returning shoppingcartid`, table, conflict)
+	id, err := insertReturning(db, oc, exec, s.ShoppingOrderID, s.PricingID, qty, ap.Price, ap.RuleID, s.CouponCode)
+	if err != nil || held == 0 {
+		return id, err
+	}
+	return id, repriceLines(db, s.ShoppingOrderID, s.PricingID, held+qty, id)
 }
 
-func (s *shopping_cart) readall(db *pgx.Conn, table string) ([]shopping_cart, error) {
-	var sc shopping_cart
-	var sl []shopping_cart
+// scan reads a shopping_cart from a row of select *, as readall answers it
+func (s *shopping_cart) scan(rows pgx.Rows) error {
 	var scid int
 	var soid int
 	var qty int
+	err := rows.Scan(&scid, &soid, &s.PricingID, &qty, &s.Price, &s.PricingRuleID, &s.CouponCode)
+	if err != nil {
+		return err
+	}
+	s.ShoppingCartID = strconv.Itoa(scid)
+	s.ShoppingOrderID = strconv.Itoa(soid)
+	s.Qty = strconv.Itoa(qty)
+	return nil
+}
+
+func (s *shopping_cart) readall(db Querier, table string) ([]shopping_cart, error) {
+	var sc shopping_cart
+	var sl []shopping_cart
 	query := fmt.Sprintf("select * from %v", table)
 	rows, err := db.Query(context.Background(), query)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&scid, &soid, &sc.PricingID, &qty)
+		err := sc.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		sc.ShoppingCartID = strconv.Itoa(scid)
-		sc.ShoppingOrderID = strconv.Itoa(soid)
-		sc.Qty = strconv.Itoa(qty)
 		sl = append(sl, sc)
 	}
 	return sl, nil
 }
 
-func (s *shopping_cart) read(db *pgx.Conn, table, field, value string) ([]shopping_cart, error) {
+func (s *shopping_cart) read(db Querier, table, field, value string) ([]shopping_cart, error) {
 	var sc shopping_cart
 	var sl []shopping_cart
-	var scid int
-	var soid int
-	var qty int
 	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&scid, &soid, &sc.PricingID, &qty)
+		err := sc.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		sc.ShoppingCartID = strconv.Itoa(scid)
-		sc.ShoppingOrderID = strconv.Itoa(soid)
-		sc.Qty = strconv.Itoa(qty)
 		sl = append(sl, sc)
 	}
 	return sl, nil
 }
 
-func (s *shopping_cart) del(db *pgx.Conn, table, field, value string) error {
-	exec := fmt.Sprintf("delete from %v where %v=$1", table, field)
-	_, err := db.Exec(context.Background(), exec, value)
-	return err
-}
-
 type orderData struct {
 	SessionID       string `json:"sessionid"`
 	OrderDate       string `json:"orderdate"`
@@ -1146,7 +1466,7 @@ type orderData struct {
 	Category        string `json:"category"`
 }
 
-func (c *orderData) read(db *pgx.Conn, sessionID string) ([]orderData, error) {
+func (c *orderData) read(db Querier, sessionID string) ([]orderData, error) {
 	var odl []orderData
 	var od orderData
 	var orderdate time.Time
@@ -1195,7 +1515,7 @@ type cart_participant_option struct {
 	OptionItemsID           string `json:"optionitemsid"`
 }
 
-func updateCartParticipantOption(db *pgx.Conn, d Data, i cart_participant_option) error {
+func updateCartParticipantOption(db Querier, d Data, i cart_participant_option) error {
 
 	// convert struct to map
 	imap := make(map[string]string)
@@ -1210,13 +1530,32 @@ func updateCartParticipantOption(db *pgx.Conn, d Data, i cart_participant_option
 	return err
 }
 
-func (c cart_participant_option) create(db *pgx.Conn, table string) error {
-	exec := fmt.Sprintf("insert into %v(cartparticipantid, optionitemsid) values($1, $2)", table)
-	_, err := db.Exec(context.Background(), exec, c.CartParticipantID, c.OptionItemsID)
+func (c cart_participant_option) create(db Querier, table string, oc onConflict) error {
+	conflict, err := oc.clause()
+	if err != nil {
+		return err
+	}
+	exec := fmt.Sprintf("insert into %v(cartparticipantid, optionitemsid) values($1, $2)%v", table, conflict)
+	_, err = db.Exec(context.Background(), exec, c.CartParticipantID, c.OptionItemsID)
 	return err
 }
 
-func (c *cart_participant_option) readall(db *pgx.Conn, table string) ([]cart_participant_option, error) {
+// scan reads a cart_participant_option from a row of select *, as readall answers it
+func (c *cart_participant_option) scan(rows pgx.Rows) error {
+	var cpoid int
+	var cpid int
+	var oiid int
+	err := rows.Scan(&cpoid, &cpid, &oiid)
+	if err != nil {
+		return err
+	}
+	c.CartParticipantOptionID = strconv.Itoa(cpoid)
+	c.CartParticipantID = strconv.Itoa(cpid)
+	c.OptionItemsID = strconv.Itoa(oiid)
+	return nil
+}
+
+func (c *cart_participant_option) readall(db Querier, table string) ([]cart_participant_option, error) {
 	var cpo cart_participant_option
 	var cl []cart_participant_option
 	query := fmt.Sprintf("select * from %v", table)
@@ -1225,7 +1564,7 @@ func (c *cart_participant_option) readall(db *pgx.Conn, table string) ([]cart_pa
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&cpo.CartParticipantID, &cpo.OptionItemsID)
+		err := cpo.scan(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -1234,42 +1573,33 @@ func (c *cart_participant_option) readall(db *pgx.Conn, table string) ([]cart_pa
 	return cl, nil
 }
 
-func (c *cart_participant_option) read(db *pgx.Conn, table, field, value string) ([]cart_participant_option, error) {
+func (c *cart_participant_option) read(db Querier, table, field, value string) ([]cart_participant_option, error) {
 	var cpo cart_participant_option
 	var cl []cart_participant_option
-	var cpoid int
-	var cpid int
-	var oiid int
 	query := fmt.Sprintf("select * from %v where %v=$1", table, field)
 	rows, err := db.Query(context.Background(), query, value)
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
-		err := rows.Scan(&cpoid, &cpid, &oiid)
+		err := cpo.scan(rows)
 		if err != nil {
 			return nil, err
 		}
-		cpo.CartParticipantOptionID = strconv.Itoa(cpoid)
-		cpo.CartParticipantID = strconv.Itoa(cpid)
-		cpo.OptionItemsID = strconv.Itoa(oiid)
 		cl = append(cl, cpo)
 	}
 	return cl, nil
 }
 
-func (c *cart_participant_option) del(db *pgx.Conn, table, field, value string) error {
-	exec := fmt.Sprintf("delete from %v where %v=$1", table, field)
-	_, err := db.Exec(context.Background(), exec, value)
-	return err
-}
-
 // Data used to unmarshal json in request to handler func
 type Data struct {
-	Action string          `json:"action"`
-	Table  string          `json:"table"`
-	Create json.RawMessage `json:"create"`
-	Read   struct {
+	Action         string          `json:"action"`
+	Table          string          `json:"table"`
+	Format         string          `json:"format"`
+	Create         json.RawMessage `json:"create"`
+	OnConflict     onConflict      `json:"on_conflict"`
+	IncludeDeleted bool            `json:"include_deleted"`
+	Read           struct {
 		Field string `json:"field"`
 		Value string `json:"value"`
 	} `json:"read"`
@@ -1282,47 +1612,137 @@ type Data struct {
 		Field  string   `json:"field"`
 		Value  string   `json:"value"`
 		Values []string `json:"values"`
+		DryRun bool     `json:"dry_run"`
 	} `json:"delete"`
-}
+	Restore struct {
+		Field string `json:"field"`
+		Value string `json:"value"`
+	} `json:"restore"`
+	Waitlist struct {
+		EventID int `json:"eventid"`
+	} `json:"waitlist"`
+	CancelOrder         cancelOrder         `json:"cancel_order"`
+	TransferParticipant transferParticipant `json:"transfer_participant"`
+	Payment             paymentRequest      `json:"payment"`
+	MergeCustomers      mergeCustomers      `json:"merge_customers"`
+	Migrate             migrate             `json:"migrate"`
+}
+
+// authenticate validates a request's api key and connect opens a pool to the
+// database with the credentials kept in vault, the tests replace both
+var (
+	authenticate = func(req handler.Request) error {
+		return vaultutils.Auth(req, "db", "http://10.62.0.1:8080/function/apikeycontroller")
+	}
+	connect = func(ctx context.Context) (*pgxpool.Pool, error) {
+		user, pass, addr, name, err := getSecrets(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return dbConnect(ctx, string(user), string(pass), string(addr), string(name))
+	}
+)
 
-func dbConnect(user, pass, addr, name string) (*pgx.Conn, error) {
+func dbConnect(ctx context.Context, user, pass, addr, name string) (*pgxpool.Pool, error) {
 	databaseURL := fmt.Sprintf("postgres://%v:%v@%v:5432/%v", user, pass, addr, name)
-	conn, err := pgx.Connect(context.Background(), databaseURL)
+	pool, err := pgxpool.Connect(ctx, databaseURL)
 	if err != nil {
 		return nil, err
 	}
 
-	return conn, nil
+	return pool, nil
 }
 
-func getSecrets() (user, pass, addr, name []byte, err error) {
-	var vd vaultutils.VaultData
-	vd.Action = "getSecret"
-	vd.Path = "db/mojodomodb"
+var (
+	poolMu sync.Mutex
+	pool   *pgxpool.Pool
+)
 
-	vd.Key = "user"
-	user, err = httputils.PostRequest(vd, "http://10.62.0.1:8080/function/apikeycontroller", nil)
-	if err != nil {
-		return
+// dbPool returns the pool every request takes its connection from, it is
+// opened on first use and kept for the life of the process
+func dbPool(ctx context.Context) (*pgxpool.Pool, error) {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if pool != nil {
+		return pool, nil
 	}
-	vd.Key = "pass"
-	pass, err = httputils.PostRequest(vd, "http://10.62.0.1:8080/function/apikeycontroller", nil)
+	p, err := connect(ctx)
 	if err != nil {
-		return
+		return nil, err
 	}
-	vd.Key = "address"
-	addr, err = httputils.PostRequest(vd, "http://10.62.0.1:8080/function/apikeycontroller", nil)
+	pool = p
+	return pool, nil
+}
+
+// acquireConn takes a connection for one request. Its release drops any
+// advisory lock the request left behind, as closing the connection used to.
+func acquireConn(ctx context.Context) (conn *pgxpool.Conn, release func(), err error) {
+	ctx, span := tracer.Start(ctx, "connect")
+	defer func() { endSpan(span, err) }()
+
+	p, err := dbPool(ctx)
 	if err != nil {
-		return
+		return nil, nil, err
 	}
-	vd.Key = "database"
-	name, err = httputils.PostRequest(vd, "http://10.62.0.1:8080/function/apikeycontroller", nil)
+	conn, err = p.Acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	release = func() {
+		_, err := conn.Exec(context.Background(), "select pg_advisory_unlock_all()")
+		if err != nil {
+			conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}
+	return conn, release, nil
+}
+
+// getSecret fetches a single key of a vault path from the apikeycontroller
+func getSecret(ctx context.Context, path, key string) ([]byte, error) {
+	_, span := tracer.Start(ctx, "secret "+path, trace.WithAttributes(
+		attribute.String("vault.path", path),
+		attribute.String("vault.key", key),
+	))
+	var vd vaultutils.VaultData
+	vd.Action = "getSecret"
+	vd.Path = path
+	vd.Key = key
+	start := time.Now()
+	b, err := httputils.PostRequest(vd, "http://10.62.0.1:8080/function/apikeycontroller", nil)
+	observeSecretFetch(path, start, err)
+	endSpan(span, err)
+	return b, err
+}
+
+func getSecrets(ctx context.Context) (user, pass, addr, name []byte, err error) {
+	user, err = getSecret(ctx, "db/mojodomodb", "user")
+	if err != nil {
+		return
+	}
+	pass, err = getSecret(ctx, "db/mojodomodb", "pass")
+	if err != nil {
+		return
+	}
+	addr, err = getSecret(ctx, "db/mojodomodb", "address")
+	if err != nil {
+		return
+	}
+	name, err = getSecret(ctx, "db/mojodomodb", "database")
 	if err != nil {
 		return
 	}
 	return user, pass, addr, name, nil
 }
 
+// conflictResponse answers a request the current state refuses, such as
+// joining the waitlist of an event with places left, with 409
+func conflictResponse(err error) (handler.Response, error) {
+	resp, err := errResponse(err)
+	resp.StatusCode = http.StatusConflict
+	return resp, err
+}
+
 func errResponse(err error) (handler.Response, error) {
 	return handler.Response{
 		Body:       []byte(err.Error()),
@@ -1363,12 +1783,25 @@ func stringResponse(s string) (handler.Response, error) {
 	}, nil
 }
 
-func createResponse(db *pgx.Conn, d Data, c Creater) (handler.Response, error) {
+func htmlResponse(b []byte) (handler.Response, error) {
+	return handler.Response{
+		Body:       b,
+		StatusCode: http.StatusOK,
+		Header: map[string][]string{
+			"Access-Control-Allow-Origin":  {"*"},
+			"Access-Control-Allow-Methods": {"*"},
+			"Access-Control-Allow-Headers": {"*"},
+			"Content-Type":                 {"text/html; charset=utf-8"},
+		},
+	}, nil
+}
+
+func createResponse(db Querier, d Data, c Creater) (handler.Response, error) {
 	err := json.Unmarshal(d.Create, &c)
 	if err != nil {
 		return errResponse(err)
 	}
-	err = c.create(db, d.Table)
+	err = c.create(db, d.Table, d.OnConflict)
 	if err != nil {
 		return errResponse(err)
 	}
@@ -1401,120 +1834,528 @@ func updateStringBuilder(table string, sf, sv []string, m map[string]string) (st
 	return updateString, nil
 }
 
-func deleteItemsFromShoppingCart(db *pgx.Conn, shoppingcartids []string) error {
-	var err error
+// relation is a foreign key, column of table references its parent's key
+type relation struct {
+	table  string
+	column string
+}
+
+// registeredTable describes a table reachable by the delete action, key is its
+// primary key
+type registeredTable struct {
+	key string
+}
+
+var registeredTables = map[string]registeredTable{
+	"organization":            {key: "organizationid"},
+	"payment_provider":        {key: "id"},
+	"event":                   {key: "eventid"},
+	"customer":                {key: "customerid"},
+	"product":                 {key: "productid"},
+	"pricing":                 {key: "pricingid"},
+	"package_category":        {key: "packagecategoryid"},
+	"package":                 {key: "packageid"},
+	"pricing_rule":            {key: "ruleid"},
+	"category_option":         {key: "categoryoptionsid"},
+	"option_item":             {key: "optionitemsid"},
+	"salesorder":              {key: "salesorderid"},
+	"purchase":                {key: "purchaseid"},
+	"participant":             {key: "participantid"},
+	"participant_option":      {key: "participantoptionsid"},
+	"shopping_order":          {key: "shoppingorderid"},
+	"shopping_cart":           {key: "shoppingcartid"},
+	"cart_participant":        {key: "cartparticipantid"},
+	"cart_participant_option": {key: "cartparticipantoptionsid"},
+	"waitlist":                {key: "waitlistid"},
+	"refund":                  {key: "refundid"},
+	"participant_change":      {key: "changeid"},
+}
+
+// cascadeRelations reads the foreign keys declared on delete cascade from
+// pg_constraint, by the table they reference. They are the rows a parent
+// owns, other references are left for the database to refuse.
+func cascadeRelations(q Querier) (map[string][]relation, error) {
+	rows, err := q.Query(context.Background(), `
+	select c.confrelid::regclass::text, c.conrelid::regclass::text, a.attname
+	from pg_constraint c
+	inner join pg_attribute a on a.attrelid = c.conrelid and a.attnum = c.conkey[1]
+	where c.contype = 'f' and c.confdeltype = 'c' and cardinality(c.conkey) = 1
+	order by 1, 2, 3`)
+	if err != nil {
+		return nil, fmt.Errorf("cascadeRelations: %v", err)
+	}
+	defer rows.Close()
+	relations := map[string][]relation{}
+	for rows.Next() {
+		var parent string
+		var r relation
+		err := rows.Scan(&parent, &r.table, &r.column)
+		if err != nil {
+			return nil, fmt.Errorf("cascadeRelations scan: %v", err)
+		}
+		relations[parent] = append(relations[parent], r)
+	}
+	return relations, rows.Err()
+}
+
+// deleteReport lists the keys of the removed rows per table
+type deleteReport map[string][]string
 
-	for _, s := range shoppingcartids {
-		shoppingcartid, err := strconv.Atoi(s)
+// cascadeDelete removes the rows of table where field matches one of values,
+// along with every row of its children in relations. With dryRun nothing is
+// deleted and the report says what would have been.
+func cascadeDelete(tx pgx.Tx, relations map[string][]relation, table, field string, values []string, dryRun bool, report deleteReport) error {
+	t, ok := registeredTables[table]
+	if !ok {
+		return fmt.Errorf("delete: unknown table %v", table)
+	}
+
+	query := fmt.Sprintf("select %v::text from %v where %v::text = any($1)", t.key, table, sanitizeColumn(field))
+	rows, err := tx.Query(context.Background(), query, values)
+	if err != nil {
+		return fmt.Errorf("delete %v: %v", table, err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("delete %v scan: %v", table, err)
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if len(keys) == 0 {
+		return nil
+	}
+	report[table] = append(report[table], keys...)
+
+	for _, c := range relations[table] {
+		err := cascadeDelete(tx, relations, c.table, c.column, keys, dryRun, report)
 		if err != nil {
 			return err
 		}
+	}
 
-		//Deletes all shopping cart entries per shoppingcartid
-		exec := fmt.Sprintf(`
-		delete from cart_participant_option
-		where cartParticipantId in (
-		select cartParticipantId from cart_participant
-		where shoppingcartid = $1
-		)
-		`)
-		_, err = db.Exec(context.Background(), exec, shoppingcartid)
+	if dryRun {
+		return nil
+	}
+	exec := fmt.Sprintf("delete from %v where %v::text = any($1)", table, t.key)
+	_, err = tx.Exec(context.Background(), exec, keys)
+	if err != nil {
+		// wrapped so purge can tell the rows still referenced apart
+		return fmt.Errorf("delete %v: %w", table, err)
+	}
+	return nil
+}
+
+// deleteRows runs cascadeDelete in a single transaction, field defaults to
+// the table's key
+func deleteRows(db Querier, table, field string, values []string, dryRun bool) (deleteReport, error) {
+	if field == "" {
+		field = registeredTables[table].key
+	}
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	relations, err := cascadeRelations(tx)
+	if err != nil {
+		return nil, err
+	}
+	report := deleteReport{}
+	err = cascadeDelete(tx, relations, table, field, values, dryRun, report)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun {
+		return report, nil
+	}
+	return report, tx.Commit(context.Background())
+}
+
+// defaultCartTTL is used when cart_ttl is not set
+const defaultCartTTL = 24 * time.Hour
+
+type cartExpiry struct {
+	Cutoff  time.Time      `json:"cutoff"`
+	Removed map[string]int `json:"removed"`
+}
+
+// expireCarts removes the shopping orders left idle since before now - ttl
+// that were never checked out, with their carts, participants and options.
+// Orders with a payment under way or paid wait for its webhook, and orders of
+// promoted waitlist entries are expired by expireWaitlist.
+func expireCarts(db Querier, ttl time.Duration) (cartExpiry, error) {
+	ce := cartExpiry{Cutoff: time.Now().Add(-ttl), Removed: map[string]int{}}
+
+	exec := fmt.Sprintf(`
+	select so.shoppingorderid::text from shopping_order so
+	where so.lastactivityat < $1
+	and so.paymentstatus is distinct from $2 and so.paymentstatus is distinct from $3
+	and not exists (select 1 from waitlist w where w.shoppingorderid = so.shoppingorderid)`)
+	rows, err := db.Query(context.Background(), exec, ce.Cutoff, paymentPending, paymentSucceeded)
+	if err != nil {
+		return ce, fmt.Errorf("expireCarts query err: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
 		if err != nil {
-			return fmt.Errorf("cart_participant_option: %v", err.Error())
+			rows.Close()
+			return ce, fmt.Errorf("expireCarts scan err: %v", err)
 		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return ce, nil
+	}
 
-		exec = fmt.Sprintf(`
-		delete from  cart_participant 
-		where shoppingcartid = $1
-		`)
-		_, err = db.Exec(context.Background(), exec, shoppingcartid)
+	report, err := deleteRows(db, "shopping_order", "shoppingorderid", ids, false)
+	if err != nil {
+		return ce, fmt.Errorf("expireCarts: %v", err)
+	}
+	for table, keys := range report {
+		ce.Removed[table] = len(keys)
+	}
+	return ce, nil
+}
+
+// envDuration reads a duration such as "720h" from the environment variable
+// name, returning fallback when it is unset
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %v", name, err)
+	}
+	return d, nil
+}
+
+// softDeleteTables are the entity tables carrying a deleted_at column,
+// deleting from them only marks the row, it is removed for good by purge once
+// the retention window has passed. Carts and waitlist entries expire on their
+// own and the audit tables are never deleted, so they are left out.
+var softDeleteTables = map[string]bool{
+	"organization":       true,
+	"payment_provider":   true,
+	"event":              true,
+	"customer":           true,
+	"product":            true,
+	"pricing":            true,
+	"pricing_rule":       true,
+	"package_category":   true,
+	"package":            true,
+	"category_option":    true,
+	"option_item":        true,
+	"salesorder":         true,
+	"purchase":           true,
+	"participant":        true,
+	"participant_option": true,
+	"refund":             true,
+}
+
+// defaultSoftDeleteRetention is used when soft_delete_retention is not set
+const defaultSoftDeleteRetention = 30 * 24 * time.Hour
+
+// deletedFilter returns the sql condition hiding soft deleted rows
+func deletedFilter(includeDeleted bool) string {
+	if includeDeleted {
+		return "true"
+	}
+	return "deleted_at is null"
+}
+
+// softDelete marks the rows of table where field matches value deleted, along
+// with the rows of its soft deletable children. They all share the deleted_at
+// of the transaction, which is how restore tells what went with them.
+func softDelete(db Querier, table, field, value string) error {
+	if field == "" {
+		field = registeredTables[table].key
+	}
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("softDelete %v: %v", table, err)
+	}
+	defer tx.Rollback(context.Background())
+
+	relations, err := cascadeRelations(tx)
+	if err != nil {
+		return err
+	}
+	err = cascadeSoftDelete(tx, relations, table, field, []string{value})
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
+}
+
+func cascadeSoftDelete(tx pgx.Tx, relations map[string][]relation, table, field string, values []string) error {
+	t := registeredTables[table]
+	exec := fmt.Sprintf("update %v set deleted_at = now() where %v::text = any($1) and deleted_at is null returning %v::text",
+		table, sanitizeColumn(field), t.key)
+	rows, err := tx.Query(context.Background(), exec, values)
+	if err != nil {
+		return fmt.Errorf("softDelete %v: %v", table, err)
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		err := rows.Scan(&key)
 		if err != nil {
-			return fmt.Errorf("cart_participant: %v", err.Error())
+			rows.Close()
+			return fmt.Errorf("softDelete %v scan: %v", table, err)
 		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if len(keys) == 0 {
+		return nil
+	}
 
-		exec = fmt.Sprintf(`
-		delete from  shopping_cart 
-		where shoppingcartid = $1
-		`)
-		_, err = db.Exec(context.Background(), exec, shoppingcartid)
+	for _, c := range relations[table] {
+		if !softDeleteTables[c.table] {
+			continue
+		}
+		err := cascadeSoftDelete(tx, relations, c.table, c.column, keys)
 		if err != nil {
-			return fmt.Errorf("shopping_cart: %v", err.Error())
+			return err
 		}
+	}
+	return nil
+}
 
+// restore clears deleted_at on the rows of table where field matches value,
+// and on the children that were soft deleted together with them
+func restore(db Querier, table, field, value string) error {
+	if field == "" {
+		field = registeredTables[table].key
 	}
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return fmt.Errorf("restore %v: %v", table, err)
+	}
+	defer tx.Rollback(context.Background())
 
-	return err
+	relations, err := cascadeRelations(tx)
+	if err != nil {
+		return err
+	}
+	err = cascadeRestore(tx, relations, table, field, []string{value}, nil)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(context.Background())
 }
 
-func deleteShoppingCart(db *pgx.Conn, shoppingcartid string) error {
-	//Deletes all shopping cart entries per shoppingcartid
-	exec := fmt.Sprintf(`
-	delete from cart_participant_option
-	where cartParticipantId in (
-	select cartParticipantId from cart_participant
-	where shoppingcartid = $1
-	)
-	`)
-	_, err := db.Exec(context.Background(), exec, shoppingcartid)
+// cascadeRestore restores the matching rows, only the ones deleted at
+// deletedAt when it is set. The update joins the table to itself to return
+// the deleted_at each row had.
+func cascadeRestore(tx pgx.Tx, relations map[string][]relation, table, field string, values []string, deletedAt *time.Time) error {
+	t := registeredTables[table]
+	args := []interface{}{values}
+	deleted := "d.deleted_at is not null"
+	if deletedAt != nil {
+		args = append(args, *deletedAt)
+		deleted = "d.deleted_at = $2"
+	}
+	exec := fmt.Sprintf(`update %[1]v set deleted_at = null
+	from %[1]v d
+	where d.%[2]v = %[1]v.%[2]v and d.%[3]v::text = any($1) and %[4]v
+	returning %[1]v.%[2]v::text, d.deleted_at`, table, t.key, sanitizeColumn(field), deleted)
+	rows, err := tx.Query(context.Background(), exec, args...)
 	if err != nil {
-		return fmt.Errorf("cart_participant_option: %v", err.Error())
+		return fmt.Errorf("restore %v: %v", table, err)
+	}
+	var order []time.Time
+	keys := map[time.Time][]string{}
+	for rows.Next() {
+		var key string
+		var at time.Time
+		err := rows.Scan(&key, &at)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("restore %v scan: %v", table, err)
+		}
+		if _, ok := keys[at]; !ok {
+			order = append(order, at)
+		}
+		keys[at] = append(keys[at], key)
 	}
+	rows.Close()
 
-	exec = fmt.Sprintf(`
-	delete from  cart_participant 
-	where shoppingcartid = $1
-	`)
-	_, err = db.Exec(context.Background(), exec, shoppingcartid)
-	if err != nil {
-		return fmt.Errorf("cart_participant: %v", err.Error())
+	for _, at := range order {
+		at := at
+		for _, c := range relations[table] {
+			if !softDeleteTables[c.table] {
+				continue
+			}
+			err := cascadeRestore(tx, relations, c.table, c.column, keys[at], &at)
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
-	exec = fmt.Sprintf(`
-	delete from  shopping_cart 
-	where shoppingcartid = $1
-	`)
-	_, err = db.Exec(context.Background(), exec, shoppingcartid)
+// foreignKeyViolation is the sqlstate of a delete of a row still referenced
+const foreignKeyViolation = "23503"
+
+// purged is the response of purge, Blocked lists the keys of the rows still
+// referenced by rows that are not deleted along with them
+type purged struct {
+	Purged  int64    `json:"purged"`
+	Blocked []string `json:"blocked,omitempty"`
+}
+
+// purge permanently deletes the rows of table that were soft deleted more
+// than retention ago, with their children. Each row goes in a transaction of
+// its own, so a row another table still references is reported as blocked
+// instead of holding back the rest.
+func purge(db Querier, table string, retention time.Duration) (purged, error) {
+	var p purged
+	key := registeredTables[table].key
+	query := fmt.Sprintf("select %v::text from %v where deleted_at < $1", key, table)
+	rows, err := db.Query(context.Background(), query, time.Now().Add(-retention))
 	if err != nil {
-		return fmt.Errorf("shopping_cart: %v", err.Error())
+		return p, fmt.Errorf("purge %v: %v", table, err)
+	}
+	var keys []string
+	for rows.Next() {
+		var k string
+		err := rows.Scan(&k)
+		if err != nil {
+			rows.Close()
+			return p, fmt.Errorf("purge %v scan: %v", table, err)
+		}
+		keys = append(keys, k)
 	}
+	rows.Close()
 
-	return err
+	for _, k := range keys {
+		report, err := deleteRows(db, table, key, []string{k}, false)
+		var pe *pgconn.PgError
+		switch {
+		case errors.As(err, &pe) && pe.Code == foreignKeyViolation:
+			p.Blocked = append(p.Blocked, k)
+		case err != nil:
+			return p, fmt.Errorf("purge %v: %v", table, err)
+		default:
+			p.Purged += int64(len(report[table]))
+		}
+	}
+	return p, nil
+}
+
+// orderOrganization returns the organization holding the events the shopping
+// order registers for, it owns the customer and invoice created at checkout.
+// An order without event packages, or spanning several organizations, cannot
+// be checked out.
+func orderOrganization(q Querier, shoppingorderid string) (string, error) {
+	exec := fmt.Sprintf(`
+	select distinct e.organizationid::text
+	from shopping_cart sc
+	inner join pricing p on p.pricingid = sc.pricingid
+	inner join package pk on pk.productid = p.productid
+	inner join event e on e.eventid = pk.eventid
+	where sc.shoppingorderid::text = $1`)
+	rows, err := q.Query(context.Background(), exec, shoppingorderid)
+	if err != nil {
+		return "", fmt.Errorf("orderOrganization: %v", err)
+	}
+	defer rows.Close()
+	var organizations []string
+	for rows.Next() {
+		var id string
+		err := rows.Scan(&id)
+		if err != nil {
+			return "", fmt.Errorf("orderOrganization scan: %v", err)
+		}
+		organizations = append(organizations, id)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("orderOrganization: %v", err)
+	}
+	switch len(organizations) {
+	case 0:
+		return "", fmt.Errorf("shopping order %v has no event registrations", shoppingorderid)
+	case 1:
+		return organizations[0], nil
+	default:
+		return "", fmt.Errorf("shopping order %v spans several organizations", shoppingorderid)
+	}
 }
 
 type migrate_data struct {
 	ShoppingOrderID string `json:"shoppingorderid"`
 	CustomerID      string `json:"customerid"`
 	PaymentID       string `json:"paymentid"`
+	PaymentStatus   string `json:"paymentstatus"`
 	Name            string `json:"name"`
 	Email           string `json:"email"`
 	Phone           string `json:"phone"`
 }
 
-func migrateData(db *pgx.Conn, md migrate_data) error {
-	var customerID int
-	exec := fmt.Sprintf(`
-	insert into
-    customer (organizationid, name, email, phone)
-		values ($1, $2, $3, $4) returning customerid`)
-	err := db.QueryRow(context.Background(), exec, "aa9a52a7-ab83-46ff-ab15-b35bd868407f", md.Name, md.Email, md.Phone).Scan(&customerID)
+// migrateData checks out a shopping order, turning it into a salesorder with
+// the next invoice number of the organization running its events. It runs in
+// one transaction so a failed checkout leaves no gap in the invoice numbers.
+func migrateData(db Querier, md migrate_data) error {
+	tx, err := db.Begin(context.Background())
 	if err != nil {
-		return fmt.Errorf("Customer: %v", err.Error())
+		return err
 	}
+	defer tx.Rollback(context.Background())
 
-	exec = fmt.Sprintf(`
+	organizationID, err := orderOrganization(tx, md.ShoppingOrderID)
+	if err != nil {
+		return err
+	}
+
+	customerID, err := checkoutCustomer(tx, organizationID, md.Name, md.Email, md.Phone)
+	if err != nil {
+		return err
+	}
+
+	err = revalidateCart(tx, md.ShoppingOrderID)
+	if err != nil {
+		return err
+	}
+
+	qu, err := quoteFor(tx, "shoppingorderid", md.ShoppingOrderID)
+	if err != nil {
+		return err
+	}
+
+	invoiceNo, err := nextInvoiceNo(tx, organizationID)
+	if err != nil {
+		return err
+	}
+
+	exec := fmt.Sprintf(`
 	insert into
-    salesorder (salesorderid, customerid, orderdate, paymentid, invoiceno)
+    salesorder (salesorderid, customerid, orderdate, paymentid, invoiceno, tax, paymentstatus)
 	select
     so.shoppingorderid,
     $1,
     so.orderdate,
     $2,
-		$3
+		$3,
+		$5::numeric::money,
+		nullif($6, '')
 	from
     shopping_order so
 	where
     so.shoppingorderid = $4`)
-	_, err = db.Exec(context.Background(), exec, customerID, md.PaymentID, "none", md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, customerID, md.PaymentID, invoiceNo, md.ShoppingOrderID, centsToMoney(qu.Taxes), md.PaymentStatus)
 	if err != nil {
 		return fmt.Errorf("salesorder: %v", err.Error())
 	}
@@ -1527,7 +2368,9 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 					qty,
 					productname,
 					description,
-					price
+					price,
+					pricingruleid,
+					pricingid
 			)
 	select
 			sc.shoppingcartid,
@@ -1535,14 +2378,16 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 			sc.qty,
 			pr.description,
 			pr.description,
-			p.price
+			coalesce(sc.price, p.price),
+			sc.pricingruleid,
+			sc.pricingid
 	from
 			shopping_cart sc
 			inner join pricing p on sc.pricingid = p.pricingid
 			inner join product pr on p.productid = pr.productid
 			inner join shopping_order so on sc.shoppingorderid = so.shoppingorderid
 	and so.shoppingorderid = $1`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("purchase: %v", err.Error())
 	}
@@ -1561,7 +2406,7 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 	where
 			so.shoppingorderid = $1
 	`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("participant: %v", err.Error())
 	}
@@ -1585,7 +2430,7 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 	where
 			so.shoppingorderid = $1
 	`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("participant_option: %v", err.Error())
 	}
@@ -1597,7 +2442,7 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 			from cart_participant cp
 			inner join shopping_cart sc on sc.shoppingcartid = cp.shoppingcartid
 			where sc.shoppingorderid = $1)`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("deleting cart_participant_option: %v", err.Error())
 	}
@@ -1608,7 +2453,7 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 			select shoppingcartid 
 			from shopping_cart
 			where shoppingorderid = $1)`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("deleting cart_participant: %v", err.Error())
 	}
@@ -1616,7 +2461,7 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 	exec = fmt.Sprintf(`
 	delete from shopping_cart 
 	where shoppingorderid = $1`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("deleting shopping_cart: %v", err.Error())
 	}
@@ -1625,45 +2470,165 @@ func migrateData(db *pgx.Conn, md migrate_data) error {
 	delete from shopping_order
 	where shoppingorderid = $1
 	`)
-	_, err = db.Exec(context.Background(), exec, md.ShoppingOrderID)
+	_, err = tx.Exec(context.Background(), exec, md.ShoppingOrderID)
 	if err != nil {
 		return fmt.Errorf("deleting orderid: %v", err.Error())
 	}
 
-	return nil
+	return tx.Commit(context.Background())
 }
 
-// Handle a function invocation
+// Handle a function invocation, an export is returned whole as the body
 func Handle(req handler.Request) (handler.Response, error) {
-	// validate request api key
-	err := vaultutils.Auth(req, "db", "http://10.62.0.1:8080/function/apikeycontroller")
-	if err != nil {
-		errResponse(err)
+	var buf responseBuffer
+	s := &responseStream{ResponseWriter: &buf}
+	resp, err := serve(s, req)
+	if s.started {
+		resp.Body = buf.body.Bytes()
 	}
+	return resp, err
+}
 
-	// get databases info for connection
-	user, pass, addr, name, err := getSecrets()
-	if err != nil {
-		errResponse(err)
+// Serve handles req like Handle and writes the response to w, exports are
+// streamed to w as their rows are read. The template server calls it.
+func Serve(w http.ResponseWriter, req handler.Request) {
+	s := &responseStream{ResponseWriter: w}
+	resp, err := serve(s, req)
+	if s.started {
+		return
 	}
 
-	// connect to database
-	db, err := dbConnect(string(user), string(pass), string(addr), string(name))
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	switch {
+	case err != nil && resp.StatusCode == http.StatusConflict:
+		w.WriteHeader(http.StatusConflict)
+	case err != nil:
+		// the error is logged with the request id and redacted, it is not
+		// written to the logs again
+		w.WriteHeader(http.StatusInternalServerError)
+	case resp.StatusCode == 0:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(resp.StatusCode)
+	}
+	w.Write(resp.Body)
+}
+
+func serve(s *responseStream, req handler.Request) (handler.Response, error) {
+	rl := newRequestLog(req)
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(req.Header))
+	ctx, span := tracer.Start(ctx, "Handle", trace.WithSpanKind(trace.SpanKindServer))
+	rl.ctx = ctx
+	// an export sends its headers before handle returns
+	s.Header().Set("X-Request-Id", rl.ID)
+
+	resp, err := handle(req, rl, s)
+	// any change can move the reports
+	if a := strings.ToLower(rl.Action); a != "read" && a != "readall" {
+		reports.invalidate()
+	}
+	rl.done(resp.StatusCode, err)
+	rl.observe(resp.StatusCode)
+	span.SetAttributes(
+		attribute.String("request.id", rl.ID),
+		attribute.String("action", strings.ToLower(rl.Action)),
+		attribute.String("table", strings.ToLower(rl.Table)),
+		attribute.Int("http.status_code", resp.StatusCode),
+	)
+	endSpan(span, err)
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	resp.Header["X-Request-Id"] = []string{rl.ID}
+	return resp, err
+}
+
+func handle(req handler.Request, rl *requestLog, s *responseStream) (resp handler.Response, err error) {
+	// payment providers call ?webhook=<provider> without an api key, their
+	// deliveries are authenticated by signature instead
+	query, err := url.ParseQuery(req.QueryString)
 	if err != nil {
-		errResponse(err)
+		return errResponse(err)
 	}
+	webhook := query.Get("webhook")
 
-	defer db.Close(context.Background())
+	// validate request api key
+	if webhook == "" {
+		err = authenticate(req)
+		if err != nil {
+			return errResponse(err)
+		}
+	}
 
+	// the request is labelled before connecting so a failed connection is
+	// still logged by action and table
 	var d Data
-	err = json.Unmarshal(req.Body, &d)
+	if webhook != "" {
+		rl.Action, rl.Table = "webhook", webhook
+	} else {
+		err = json.Unmarshal(req.Body, &d)
+		if err != nil {
+			return errResponse(err)
+		}
+		rl.Action, rl.Table = d.Action, d.Table
+		d.Format = responseFormat(req.Header.Get("Accept"), d.Format)
+	}
+
+	// cached reports are answered without connecting
+	if key, ok := reportCacheKey(req, d); ok {
+		ifNoneMatch := req.Header.Get("If-None-Match")
+		cached, generation, ok := reports.lookup(key, ifNoneMatch)
+		if ok {
+			rl.Cache = "hit"
+			return cached, nil
+		}
+		rl.Cache = "miss"
+		defer func() {
+			if err == nil {
+				resp = reports.store(key, generation, resp, ifNoneMatch, reportCacheTTL())
+			}
+		}()
+	}
+
+	// connect to database
+	conn, release, err := acquireConn(rl.ctx)
 	if err != nil {
-		errResponse(err)
+		rl.ErrorClass = "connection"
+		return errResponse(err)
+	}
+
+	defer release()
+	db := statementLog{Querier: conn, rl: rl}
+
+	// PAYMENT WEBHOOK
+	if webhook != "" {
+		pw, err := processPaymentWebhook(rl.ctx, db, webhook, req.Header, req.Body)
+		if err != nil {
+			return errResponse(err)
+		}
+		if pw.CheckedOut {
+			refreshReportsAfter(db, "webhook")
+		}
+		return structResponse(pw)
+	}
+
+	// EXPORT
+	// readall and the reports in csv, xlsx, ndjson or json_stream are
+	// streamed as their rows are read, format or the Accept header selects
+	// them
+	if exportable(d) {
+		return export(db, s, d)
 	}
 
 	// CREATE
 	switch {
 	case strings.ToLower(d.Action) == "create":
+		err := validate(db, d.Table, d.Create)
+		if err != nil {
+			return errResponse(err)
+		}
 		switch {
 		case strings.ToLower(d.Table) == "salesorder":
 			var o salesorder
@@ -1671,7 +2636,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
-			err = o.create(db, d.Table)
+			err = o.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1684,7 +2649,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
-			err = p.create(db, d.Table)
+			err = p.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1697,7 +2662,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
-			shoppingcartid, err := s.create(db, d.Table)
+			shoppingcartid, err := s.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1710,7 +2675,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
-			shoppingorderid, err := s.create(db, d.Table)
+			shoppingorderid, err := s.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1723,7 +2688,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
-			cartparticipantid, err := c.create(db, d.Table)
+			cartparticipantid, err := c.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1737,7 +2702,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 				return errResponse(err)
 			}
 
-			err = r.create(db)
+			_, err = r.create(db)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1745,32 +2710,54 @@ func Handle(req handler.Request) (handler.Response, error) {
 			return stringResponse("success!")
 			//............................................
 
-		case strings.ToLower(d.Table) == "cart_participant_option":
-			var c cart_participant_option
-			err := json.Unmarshal(d.Create, &c)
+		case strings.ToLower(d.Table) == "pricing_rule":
+			var p pricing_rule
+			err := json.Unmarshal(d.Create, &p)
 			if err != nil {
 				return errResponse(err)
 			}
-			err = c.create(db, d.Table)
+			ruleid, err := p.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
-			return stringResponse("success!")
+			return stringResponse(strconv.Itoa(ruleid))
 			//............................................
 
-		case strings.ToLower(d.Table) == "migrate_data":
-			var m migrate_data
-			err := json.Unmarshal(d.Create, &m)
+		case strings.ToLower(d.Table) == "waitlist":
+			var w waitlist
+			err := json.Unmarshal(d.Create, &w)
+			if err != nil {
+				return errResponse(err)
+			}
+			waitlistid, err := w.create(db, d.Table)
+			if errors.Is(err, errEventOpen) {
+				return conflictResponse(err)
+			}
+			if err != nil {
+				return errResponse(err)
+			}
+			return stringResponse(strconv.Itoa(waitlistid))
+			//............................................
+
+		case strings.ToLower(d.Table) == "cart_participant_option":
+			var c cart_participant_option
+			err := json.Unmarshal(d.Create, &c)
 			if err != nil {
 				return errResponse(err)
 			}
-			err = migrateData(db, m)
+			err = c.create(db, d.Table, d.OnConflict)
 			if err != nil {
 				return errResponse(err)
 			}
 			return stringResponse("success!")
 			//............................................
 
+		// the payment webhook is the only way to check out, a client could
+		// otherwise claim any payment succeeded
+		case strings.ToLower(d.Table) == "migrate_data":
+			return errResponse(errors.New("migrate_data: orders are checked out by the payment webhook"))
+			//............................................
+
 		}
 
 	// READ
@@ -1783,7 +2770,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 		switch {
 		case strings.ToLower(d.Table) == "order":
 			var o salesorder
-			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value)
+			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1792,7 +2779,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "category_options":
 			var c category_options
-			cl, err := c.read(db, d.Table, d.Read.Field, d.Read.Value)
+			cl, err := c.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1801,7 +2788,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "customer":
 			var c customer
-			cl, err := c.read(db, d.Table, d.Read.Field, d.Read.Value)
+			cl, err := c.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1810,7 +2797,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "event":
 			var e event
-			el, err := e.read(db, d.Table, d.Read.Field, d.Read.Value)
+			el, err := e.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1819,7 +2806,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "option_items":
 			var o option_items
-			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value)
+			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1828,7 +2815,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "organization":
 			var o organization
-			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value)
+			ol, err := o.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1837,7 +2824,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "participant":
 			var p participant
-			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value)
+			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1846,7 +2833,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "participant_options":
 			var p participant_options
-			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value)
+			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1855,7 +2842,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "purchase":
 			var p purchase
-			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value)
+			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1907,6 +2894,70 @@ func Handle(req handler.Request) (handler.Response, error) {
 			return structResponse(ol)
 			//............................................
 
+		case strings.ToLower(d.Table) == "waitlist":
+			var w waitlist
+			wl, err := w.read(db, d.Read.Field, d.Read.Value)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(wl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "pricing_rule":
+			var p pricing_rule
+			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(pl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "refund":
+			var r refund
+			rl, err := r.read(db, d.Table, d.Read.Field, d.Read.Value, d.IncludeDeleted)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(rl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "participant_change":
+			var p participant_change
+			pl, err := p.read(db, d.Table, d.Read.Field, d.Read.Value)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(pl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "quote":
+			field := d.Read.Field
+			if field == "" {
+				field = "sessionid"
+			}
+			qu, err := quoteFor(db, field, d.Read.Value)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(qu)
+			//............................................
+
+		case strings.ToLower(d.Table) == "invoice":
+			var i invoice
+			err := i.read(db, d.Read.Field, d.Read.Value)
+			if err != nil {
+				return errResponse(err)
+			}
+			if strings.ToLower(d.Format) == "html" {
+				page, err := i.html()
+				if err != nil {
+					return errResponse(err)
+				}
+				return htmlResponse(page)
+			}
+			return structResponse(i)
+			//............................................
+
 		case strings.ToLower(d.Table) == "dashboard_summary":
 			var ds dashboardSummary
 			err := ds.getDashboardSummary(db)
@@ -1966,7 +3017,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 		switch {
 		case strings.ToLower(d.Table) == "order":
 			var o salesorder
-			ol, err := o.readall(db, d.Table)
+			ol, err := o.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1975,7 +3026,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "category_options":
 			var c category_options
-			cl, err := c.readall(db, d.Table)
+			cl, err := c.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1984,7 +3035,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "customer":
 			var c customer
-			cl, err := c.readall(db, d.Table)
+			cl, err := c.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -1993,7 +3044,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "event":
 			var e event
-			el, err := e.readall(db, d.Table)
+			el, err := e.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2002,7 +3053,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "option_items":
 			var o option_items
-			ol, err := o.readall(db, d.Table)
+			ol, err := o.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2011,7 +3062,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "organization":
 			var o organization
-			oa, err := o.readall(db, d.Table)
+			oa, err := o.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2020,7 +3071,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "participant":
 			var p participant
-			pl, err := p.readall(db, d.Table)
+			pl, err := p.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2029,7 +3080,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "participant_options":
 			var p participant_options
-			pl, err := p.readall(db, d.Table)
+			pl, err := p.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2038,7 +3089,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 
 		case strings.ToLower(d.Table) == "purchase":
 			var p purchase
-			pl, err := p.readall(db, d.Table)
+			pl, err := p.readall(db, d.Table, d.IncludeDeleted)
 			if err != nil {
 				return errResponse(err)
 			}
@@ -2081,6 +3132,42 @@ func Handle(req handler.Request) (handler.Response, error) {
 			return structResponse(sl)
 			//............................................
 
+		case strings.ToLower(d.Table) == "waitlist":
+			var w waitlist
+			wl, err := w.readall(db)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(wl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "pricing_rule":
+			var p pricing_rule
+			pl, err := p.readall(db, d.Table, d.IncludeDeleted)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(pl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "refund":
+			var r refund
+			rl, err := r.readall(db, d.Table, d.IncludeDeleted)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(rl)
+			//............................................
+
+		case strings.ToLower(d.Table) == "participant_change":
+			var p participant_change
+			pl, err := p.readall(db, d.Table)
+			if err != nil {
+				return errResponse(err)
+			}
+			return structResponse(pl)
+			//............................................
+
 		}
 
 	// UPDATE
@@ -2096,6 +3183,7 @@ func Handle(req handler.Request) (handler.Response, error) {
 			if err != nil {
 				return errResponse(err)
 			}
+			refreshReportsAfter(db, "update")
 			return stringResponse("success!")
 			//............................................
 
@@ -2181,34 +3269,196 @@ func Handle(req handler.Request) (handler.Response, error) {
 		}
 
 	// DELETE
+	// Deletes the rows where field (the table's key by default) matches value
+	// or one of values, together with their dependent rows, dry_run only
+	// reports them
 	case strings.ToLower(d.Action) == "delete":
-		switch {
+		table := strings.ToLower(d.Table)
+		values := d.Delete.Values
+		if d.Delete.Value != "" {
+			values = append(values, d.Delete.Value)
+		}
+		if len(values) == 0 {
+			return errResponse(errors.New("delete: value or values is required"))
+		}
 
-		case strings.ToLower(d.Table) == "shopping_cart":
-			shoppingCartID := d.Delete.Value
-			if err != nil {
-				return errResponse(err)
+		switch {
+		case softDeleteTables[table]:
+			if d.Delete.DryRun {
+				report, err := deleteRows(db, table, d.Delete.Field, values, true)
+				if err != nil {
+					return errResponse(err)
+				}
+				return structResponse(report)
 			}
-			err = deleteShoppingCart(db, shoppingCartID)
-			if err != nil {
-				return errResponse(err)
+			for _, v := range values {
+				err = softDelete(db, table, d.Delete.Field, v)
+				if err != nil {
+					return errResponse(err)
+				}
 			}
+			refreshReportsAfter(db, "delete")
 			return stringResponse("success!")
 			//...........................................
 
-		/// TODO: test
-		case strings.ToLower(d.Table) == "shopping_carts":
-			shoppingCartID := d.Delete.Values
+		// shopping_carts is kept for callers of the old multi cart delete
+		case table == "shopping_carts":
+			table = "shopping_cart"
+			fallthrough
+
+		default:
+			report, err := deleteRows(db, table, d.Delete.Field, values, d.Delete.DryRun)
 			if err != nil {
 				return errResponse(err)
 			}
-			err = deleteItemsFromShoppingCart(db, shoppingCartID)
-			if err != nil {
-				return errResponse(err)
+			if !d.Delete.DryRun && !unreportedTables[table] {
+				refreshReportsAfter(db, "delete")
 			}
-			return stringResponse("success!")
+			return structResponse(report)
 			//...........................................
 		}
+
+	// RESTORE
+	// Clears deleted_at on soft deleted rows matching restore field (the table's
+	// key by default) and value, and on the children deleted along with them
+	case strings.ToLower(d.Action) == "restore":
+		if !softDeleteTables[strings.ToLower(d.Table)] {
+			return errResponse(fmt.Errorf("restore: %v does not support soft delete", d.Table))
+		}
+		err = restore(db, strings.ToLower(d.Table), d.Restore.Field, d.Restore.Value)
+		if err != nil {
+			return errResponse(err)
+		}
+		refreshReportsAfter(db, "restore")
+		return stringResponse("success!")
+
+	// PURGE
+	// Permanently removes rows soft deleted longer than soft_delete_retention,
+	// the rows other rows still reference are reported as blocked
+	case strings.ToLower(d.Action) == "purge":
+		if !softDeleteTables[strings.ToLower(d.Table)] {
+			return errResponse(fmt.Errorf("purge: %v does not support soft delete", d.Table))
+		}
+		retention, err := envDuration("soft_delete_retention", defaultSoftDeleteRetention)
+		if err != nil {
+			return errResponse(fmt.Errorf("purge: %v", err))
+		}
+		p, err := purge(db, strings.ToLower(d.Table), retention)
+		if err != nil {
+			return errResponse(err)
+		}
+		if p.Purged > 0 {
+			refreshReportsAfter(db, "purge")
+		}
+		return structResponse(p)
+
+	// EXPIRE_CARTS
+	// Removes abandoned shopping orders older than cart_ttl, meant to be
+	// invoked on a schedule by the cron connector
+	case strings.ToLower(d.Action) == "expire_carts":
+		ttl, err := envDuration("cart_ttl", defaultCartTTL)
+		if err != nil {
+			return errResponse(fmt.Errorf("expire_carts: %v", err))
+		}
+		ce, err := expireCarts(db, ttl)
+		if err != nil {
+			return errResponse(err)
+		}
+		return structResponse(ce)
+
+	// REFRESH_REPORTS
+	// Refreshes the report views, the actions changing purchases, participants
+	// or refunds refresh them already, meant to be invoked on a schedule by
+	// the cron connector to pick up every other change
+	case strings.ToLower(d.Action) == "refresh_reports":
+		rr, err := refreshReports(db)
+		if err != nil {
+			return errResponse(err)
+		}
+		return structResponse(rr)
+
+	// PROMOTE_WAITLIST
+	// Moves the next waiting entry of waitlist.eventid into a shopping order
+	// when the event has room for it
+	case strings.ToLower(d.Action) == "promote_waitlist":
+		w, err := promoteWaitlist(db, d.Waitlist.EventID)
+		if err != nil {
+			return errResponse(err)
+		}
+		if w == nil {
+			return stringResponse("no entry promoted")
+		}
+		return structResponse(w)
+
+	// EXPIRE_WAITLIST
+	// Expires promotions left unpaid for waitlist_claim_ttl and promotes the
+	// next entries in their place
+	case strings.ToLower(d.Action) == "expire_waitlist":
+		ttl, err := envDuration("waitlist_claim_ttl", defaultWaitlistClaimTTL)
+		if err != nil {
+			return errResponse(fmt.Errorf("expire_waitlist: %v", err))
+		}
+		we, err := expireWaitlist(db, ttl)
+		if err != nil {
+			return errResponse(err)
+		}
+		return structResponse(we)
+
+	// CANCEL_ORDER
+	// Cancels a salesorder, or only cancel_order.participantids of it, and
+	// refunds the purchases involved
+	case strings.ToLower(d.Action) == "cancel_order":
+		c, err := d.CancelOrder.cancel(db)
+		if err != nil {
+			return errResponse(err)
+		}
+		refreshReportsAfter(db, "cancel_order")
+		return structResponse(c)
+
+	// TRANSFER_PARTICIPANT
+	// Renames or replaces a participant and changes their options, recording
+	// who made the change
+	case strings.ToLower(d.Action) == "transfer_participant":
+		// the change is recorded against the email vaultutils.Auth checked
+		// the api key of
+		d.TransferParticipant.ChangedBy = req.Header.Get("email")
+		pc, err := d.TransferParticipant.transfer(db)
+		if err != nil {
+			return errResponse(err)
+		}
+		refreshReportsAfter(db, "transfer_participant")
+		return structResponse(pc)
+
+	// CREATE_PAYMENT
+	// Starts paying for the cart of payment.sessionid with payment.provider,
+	// the provider's webhook checks the cart out once the payment succeeds
+	case strings.ToLower(d.Action) == "create_payment":
+		p, err := d.Payment.create(rl.ctx, db)
+		if err != nil {
+			return errResponse(err)
+		}
+		return structResponse(p)
+
+	// MERGE_CUSTOMERS
+	// Moves the salesorders of merge_customers.duplicates to
+	// merge_customers.customerid and soft deletes the duplicates
+	case strings.ToLower(d.Action) == "merge_customers":
+		m, err := d.MergeCustomers.merge(db)
+		if err != nil {
+			return errResponse(err)
+		}
+		refreshReportsAfter(db, "merge_customers")
+		return structResponse(m)
+
+	// MIGRATE
+	// Applies (up) or reverts (down) migrate.steps schema migrations, or
+	// lists them (status)
+	case strings.ToLower(d.Action) == "migrate":
+		sl, err := d.Migrate.run(db)
+		if err != nil {
+			return errResponse(err)
+		}
+		return structResponse(sl)
 	}
 
 	return errResponse(errors.New("error: could not retrieve data: " + err.Error()))
@@ -0,0 +1,1081 @@
+package function
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgconn"
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+type testGolfer struct {
+	name, shirt, dexterity string
+}
+
+// register adds golfers to sessionID's cart through Handle
+func register(t *testing.T, f fixtures, sessionID, pricingID string, golfers ...testGolfer) {
+	t.Helper()
+	var gi []map[string]string
+	for _, g := range golfers {
+		gi = append(gi, map[string]string{
+			"name":      g.name,
+			"shirtsize": f.Options[g.shirt],
+			"dexterity": f.Options[g.dexterity],
+		})
+	}
+	call(t, map[string]interface{}{
+		"action": "create",
+		"table":  "registration",
+		"create": map[string]interface{}{
+			"orderdate":  time.Now().Format(time.RFC3339),
+			"sessionid":  sessionID,
+			"pricingid":  pricingID,
+			"golferinfo": gi,
+		},
+	}, nil)
+}
+
+// checkout pays for sessionID's cart with the fake provider and delivers the
+// succeeded webhook that checks it out, returning the salesorderid
+func checkout(t *testing.T, sessionID string) int {
+	t.Helper()
+	t.Setenv("allow_fake_payments", "true")
+	t.Setenv("fake_payment_secret", "whsec_test")
+
+	var qu quote
+	call(t, map[string]interface{}{
+		"action": "read",
+		"table":  "quote",
+		"read":   map[string]string{"value": sessionID},
+	}, &qu)
+	customer := map[string]string{
+		"name":  "Pat Jones",
+		"email": "pat@example.com",
+		"phone": "(555) 010-2030",
+	}
+	var p payment
+	call(t, map[string]interface{}{
+		"action": "create_payment",
+		"payment": map[string]string{
+			"provider":  "fake",
+			"sessionid": sessionID,
+			"name":      customer["name"],
+			"email":     customer["email"],
+			"phone":     customer["phone"],
+		},
+	}, &p)
+
+	customer["shoppingorderid"] = strconv.Itoa(qu.ShoppingOrderID)
+	body, err := json.Marshal(paymentEvent{
+		EventID:   "evt_" + sessionID,
+		Type:      "payment_intent.succeeded",
+		PaymentID: p.PaymentID,
+		Status:    paymentSucceeded,
+		Amount:    p.Amount,
+		Currency:  p.Currency,
+		Metadata:  customer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write(body)
+	req := handler.Request{Body: body, Header: http.Header{}, QueryString: "webhook=fake"}
+	req.Header.Set("X-Fake-Signature", hex.EncodeToString(mac.Sum(nil)))
+	resp, err := Handle(req)
+	if err != nil {
+		t.Fatalf("%v: %s", err, resp.Body)
+	}
+	var pw paymentWebhook
+	err = json.Unmarshal(resp.Body, &pw)
+	if err != nil || !pw.CheckedOut {
+		t.Fatalf("webhook did not check out %v: %s", sessionID, resp.Body)
+	}
+	return qu.ShoppingOrderID
+}
+
+func readReport(t *testing.T, table string, out interface{}) {
+	t.Helper()
+	call(t, map[string]interface{}{"action": "read", "table": table}, out)
+}
+
+// fresh fails the test unless rf was refreshed by the checkouts before it,
+// and clears it so the report compares on its data alone
+func fresh(t *testing.T, rf *reportFreshness) {
+	t.Helper()
+	if rf.RefreshedAt.IsZero() || rf.AgeSeconds < 0 || rf.AgeSeconds > 60 {
+		t.Errorf("report_freshness = %+v", *rf)
+	}
+	*rf = reportFreshness{}
+}
+
+func TestRegistrationCheckoutAndReports(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+
+	register(t, f, "solo-session", f.Solo, testGolfer{"Ann", "SMALL", "LEFT-HANDED"})
+	register(t, f, "foursome-session", f.Foursome,
+		testGolfer{"Bob", "MEDIUM", "RIGHT-HANDED"},
+		testGolfer{"Cid", "LARGE", "RIGHT-HANDED"},
+		testGolfer{"Dee", "LARGE", "LEFT-HANDED"},
+		testGolfer{"Eve", "2X-LARGE", ""},
+	)
+
+	var od []orderData
+	call(t, map[string]interface{}{
+		"action": "read",
+		"table":  "order_data",
+		"read":   map[string]string{"value": "foursome-session"},
+	}, &od)
+	// one row per selected option, Eve has no dexterity
+	if len(od) != 7 {
+		t.Fatalf("order_data has %v rows, want 7: %+v", len(od), od)
+	}
+
+	var qu quote
+	call(t, map[string]interface{}{
+		"action": "read",
+		"table":  "quote",
+		"read":   map[string]string{"value": "foursome-session"},
+	}, &qu)
+	if qu.Total != 36000 || !qu.Valid {
+		t.Fatalf("foursome quote = %+v, want a valid total of 36000", qu)
+	}
+
+	solo := checkout(t, "solo-session")
+	checkout(t, "foursome-session")
+
+	var customers int
+	err := db.QueryRow(context.Background(), "select count(*) from customer").Scan(&customers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if customers != 1 {
+		t.Errorf("checkout created %v customers for one buyer, want 1", customers)
+	}
+
+	var ds dashboardSummary
+	readReport(t, "dashboard_summary", &ds)
+	fresh(t, &ds.ReportFreshness)
+	if ds.Participants != 5 || ds.Collected != "$460.00" || ds.Refunded != "$0.00" {
+		t.Errorf("dashboard_summary = %+v", ds)
+	}
+	if len(ds.Events) != 1 || ds.Events[0].Registered != 5 || ds.Events[0].InFlight != 0 || ds.Events[0].Remaining != 95 {
+		t.Errorf("dashboard_summary events = %+v", ds.Events)
+	}
+
+	var rs registrationSummary
+	readReport(t, "registration_summary", &rs)
+	fresh(t, &rs.ReportFreshness)
+	if rs != (registrationSummary{SoloRegistration: 1, FoursomeRegistration: 4}) {
+		t.Errorf("registration_summary = %+v", rs)
+	}
+
+	var ss shirtSummary
+	readReport(t, "shirt_summary", &ss)
+	fresh(t, &ss.ReportFreshness)
+	if ss != (shirtSummary{Small: 1, Medium: 1, Large: 2, XXLarge: 1}) {
+		t.Errorf("shirt_summary = %+v", ss)
+	}
+
+	var cs clubSummary
+	readReport(t, "club_summary", &cs)
+	fresh(t, &cs.ReportFreshness)
+	if cs != (clubSummary{LeftHanded: 2, RightHanded: 2}) {
+		t.Errorf("club_summary = %+v", cs)
+	}
+
+	var rb registrationBreakdown
+	readReport(t, "registration_breakdown", &rb)
+	fresh(t, &rb.ReportFreshness)
+	want := registrationBreakdown{
+		SoloRegistration: 1, SoloCollected: "$100.00",
+		TwosomeRegistration: 0, TwosomeCollected: "$0.00",
+		FoursomeRegistration: 4, FoursomeCollected: "$360.00",
+	}
+	if rb != want {
+		t.Errorf("registration_breakdown = %+v, want %+v", rb, want)
+	}
+
+	var rd []registrationDetail
+	readReport(t, "registration_detail", &rd)
+	if len(rd) != 2 {
+		t.Fatalf("registration_detail has %v orders, want 2: %+v", len(rd), rd)
+	}
+	fresh(t, &rd[0].ReportFreshness)
+
+	var inv invoice
+	call(t, map[string]interface{}{
+		"action": "read",
+		"table":  "invoice",
+		"read":   map[string]string{"field": "salesorderid", "value": strconv.Itoa(solo)},
+	}, &inv)
+	if wantNo := fmt.Sprintf("INV-%d-00001", time.Now().Year()); inv.InvoiceNo != wantNo || inv.Total != "$100.00" {
+		t.Errorf("invoice = %v total %v, want %v total $100.00", inv.InvoiceNo, inv.Total, wantNo)
+	}
+}
+
+// Foursome Collected used to sum the Solo Registration purchases
+func TestRegistrationBreakdownFoursomeCollected(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+
+	register(t, f, "solo-session", f.Solo, testGolfer{"Ann", "SMALL", ""})
+	register(t, f, "foursome-session", f.Foursome,
+		testGolfer{"Bob", "SMALL", ""},
+		testGolfer{"Cid", "SMALL", ""},
+		testGolfer{"Dee", "SMALL", ""},
+		testGolfer{"Eve", "SMALL", ""},
+	)
+	checkout(t, "solo-session")
+	foursome := checkout(t, "foursome-session")
+
+	var rb registrationBreakdown
+	readReport(t, "registration_breakdown", &rb)
+	if rb.SoloCollected != "$100.00" || rb.FoursomeCollected != "$360.00" {
+		t.Fatalf("collected solo %v foursome %v, want $100.00 and $360.00", rb.SoloCollected, rb.FoursomeCollected)
+	}
+
+	// a cancelled foursome golfer is refunded a quarter of the purchase
+	var participantID string
+	err := db.QueryRow(context.Background(),
+		"select participantid::text from participant where name = 'Eve'").Scan(&participantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call(t, map[string]interface{}{
+		"action": "cancel_order",
+		"cancel_order": map[string]interface{}{
+			"salesorderid":   foursome,
+			"participantids": []string{participantID},
+			"reason":         "injury",
+		},
+	}, nil)
+
+	readReport(t, "registration_breakdown", &rb)
+	if rb.FoursomeRegistration != 3 || rb.FoursomeCollected != "$270.00" || rb.SoloCollected != "$100.00" {
+		t.Errorf("after cancelling, registration_breakdown = %+v", rb)
+	}
+}
+
+func TestUpdateStringBuilder(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sf, sv []string
+		m      map[string]string
+		want   string
+	}{
+		{
+			name: "one field",
+			sf:   []string{"sessionid"}, sv: []string{"abc"},
+			m:    map[string]string{"shoppingorderid": "4", "sessionid": ""},
+			want: "update shopping_order set sessionid='abc' where shoppingorderid='4'",
+		},
+		{
+			name: "more fields",
+			sf:   []string{"sessionid", "orderdate"}, sv: []string{"abc", "now()"},
+			m:    map[string]string{"shoppingorderid": "4"},
+			want: "update shopping_order set sessionid='abc',orderdate=now() where shoppingorderid='4'",
+		},
+		{
+			name: "no identifier",
+			sf:   []string{"sessionid"}, sv: []string{"abc"},
+			m:    map[string]string{"shoppingorderid": ""},
+			want: "update shopping_order set sessionid='abc'",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := updateStringBuilder("shopping_order", tc.sf, tc.sv, tc.m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("got  %v\nwant %v", got, tc.want)
+			}
+		})
+	}
+
+	_, err := updateStringBuilder("shopping_order", []string{"a", "b"}, []string{"1"}, nil)
+	if err == nil {
+		t.Error("mismatched fields and values did not fail")
+	}
+}
+
+func TestUpdateShoppingOrderExecs(t *testing.T) {
+	db := &fakeQuerier{}
+	var d Data
+	d.Table = "shopping_order"
+	d.Update.SetFields = []string{"sessionid"}
+	d.Update.SetValues = []string{"abc"}
+
+	err := updateShoppingOrder(db, d, shopping_order{ShoppingOrderID: "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"update shopping_order set sessionid='abc' where shoppingorderid='4'"}
+	if got := db.sql(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+}
+
+func TestDeleteAndRestoreRefreshReports(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+	register(t, f, "twosome-session", f.Twosome,
+		testGolfer{"Ann", "SMALL", "LEFT-HANDED"},
+		testGolfer{"Bob", "MEDIUM", "RIGHT-HANDED"},
+	)
+	checkout(t, "twosome-session")
+
+	var ann string
+	err := db.QueryRow(context.Background(), "select participantid::text from participant where name = 'Ann'").Scan(&ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		action     string
+		lefthanded int
+	}{
+		{"delete", 0},
+		{"restore", 1},
+	} {
+		call(t, map[string]interface{}{
+			"action":  tc.action,
+			"table":   "participant",
+			tc.action: map[string]string{"value": ann},
+		}, nil)
+		var cs clubSummary
+		readReport(t, "club_summary", &cs)
+		if cs.LeftHanded != tc.lefthanded || cs.RightHanded != 1 {
+			t.Errorf("club_summary after %v = %+v", tc.action, cs)
+		}
+	}
+}
+
+func TestCustomerRead(t *testing.T) {
+	org := uuid.Must(uuid.FromString(testOrganizationID))
+	deleted := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	survivor := 7
+	db := &fakeQuerier{}
+	db.returns("from customer",
+		[]interface{}{7, org, "Pat Jones", "pat@example.com", "5550102030", nil, nil},
+		[]interface{}{8, org, "Pat J", "pat@example.com", "", deleted, 7},
+	)
+
+	var c customer
+	cl, err := c.read(db, "customer", "email", "pat@example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := db.find(t, "from customer")
+	if want := "select * from customer where email=$1 and deleted_at is null"; call.SQL != want {
+		t.Errorf("ran %v, want %v", call.SQL, want)
+	}
+	if want := []interface{}{"pat@example.com"}; !reflect.DeepEqual(call.Args, want) {
+		t.Errorf("args %v, want %v", call.Args, want)
+	}
+	want := []customer{
+		{ID: 7, OrganizationID: org, Name: "Pat Jones", Email: "pat@example.com", Phone: "5550102030"},
+		{ID: 8, OrganizationID: org, Name: "Pat J", Email: "pat@example.com", DeletedAt: &deleted, MergedInto: &survivor},
+	}
+	if !reflect.DeepEqual(cl, want) {
+		t.Errorf("read %+v, want %+v", cl, want)
+	}
+
+	db = &fakeQuerier{}
+	_, err = c.readall(db, "customer", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.sql(), []string{"select * from customer where true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("readall ran %q, want %q", got, want)
+	}
+}
+
+func TestMergeCustomersSoftDeletes(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("select organizationid::text from customer", []interface{}{testOrganizationID})
+	db.returns("select customerid from customer", []interface{}{8}, []interface{}{9})
+	db.results = append(db.results, &fakeResult{match: "update salesorder", tag: "UPDATE 3"})
+
+	m, err := mergeCustomers{CustomerID: 7, Duplicates: []int{8, 9}}.merge(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.SalesOrders != 3 || !reflect.DeepEqual(m.Merged, []int{8, 9}) {
+		t.Errorf("merged %+v", m)
+	}
+	call := db.find(t, "update customer")
+	if want := "update customer set deleted_at = now(), mergedinto = $1 where customerid = any($2)"; call.SQL != want {
+		t.Errorf("ran %v, want %v", call.SQL, want)
+	}
+	if want := []interface{}{7, []int{8, 9}}; !reflect.DeepEqual(call.Args, want) {
+		t.Errorf("args %v, want %v", call.Args, want)
+	}
+	for _, sql := range db.sql() {
+		if strings.HasPrefix(sql, "delete") {
+			t.Errorf("merge ran %v", sql)
+		}
+	}
+}
+
+func TestParticipantReadallScansIDs(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("from participant", []interface{}{3, 9, "Ann", nil, nil})
+
+	var p participant
+	pl, err := p.readall(db, "participant", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pl) != 1 || pl[0].ParticipantID != "3" || pl[0].PurchaseID != "9" || pl[0].Name != "Ann" {
+		t.Errorf("readall %+v", pl)
+	}
+}
+
+// registrationFake scripts the event, pricing and inserts registration.create
+// reads back, the event has remaining room for room golfers
+func registrationFake(room int) *fakeQuerier {
+	db := &fakeQuerier{}
+	db.returns("select pk.eventid", []interface{}{3})
+	db.returns("e.eventid = $1", []interface{}{3, "Charity Open", 10, 10 - room, 0})
+	db.returns("insert into shopping_order", []interface{}{11})
+	db.returns("select coalesce(sum(qty), 0) from shopping_cart", []interface{}{0})
+	db.returns("coalesce(r.price, p.price)", []interface{}{"$190.00", 19000, nil})
+	db.returns("insert into shopping_cart", []interface{}{21})
+	db.returns("insert into cart_participant(", []interface{}{31})
+	db.returns("insert into cart_participant(", []interface{}{32})
+	return db
+}
+
+func TestRegistrationCreateSQL(t *testing.T) {
+	db := registrationFake(2)
+	r := registration{
+		OrderDate: "2026-05-01",
+		SessionID: "twosome-session",
+		PricingID: "pricing-2",
+		GolferInfo: []golfer{
+			{Name: "Ann", ShirtSize: "1", Dexterity: "6"},
+			{Name: "Bob", ShirtSize: "2"},
+		},
+	}
+	id, err := r.create(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 11 {
+		t.Errorf("create returned %v, want shoppingorderid 11", id)
+	}
+
+	want := []fakeCall{
+		{"begin", nil},
+		{"select pk.eventid", []interface{}{"pricing-2"}},
+		{"select pg_advisory_xact_lock($1, $2)", []interface{}{eventLockClass, 3}},
+		{"select e.eventid", []interface{}{3}},
+		{"insert into shopping_order(orderdate, sessionid) values($1, $2) on conflict (\"sessionid\") do update set \"sessionid\"=excluded.\"sessionid\" returning shoppingorderid",
+			[]interface{}{"2026-05-01", "twosome-session"}},
+		{"select coalesce(sum(qty), 0) from shopping_cart", []interface{}{"11", "pricing-2"}},
+		{"select coalesce(r.price, p.price)", nil},
+		{"insert into shopping_cart(", []interface{}{"11", "pricing-2", 1, "$190.00", (*int)(nil), (*string)(nil)}},
+		{"insert into cart_participant(shoppingcartid, name)", []interface{}{21, "Ann"}},
+		{"insert into cart_participant_option", []interface{}{31, 1}},
+		{"insert into cart_participant_option", []interface{}{31, 6}},
+		{"insert into cart_participant(shoppingcartid, name)", []interface{}{21, "Bob"}},
+		{"insert into cart_participant_option", []interface{}{32, 2}},
+		{"commit", nil},
+	}
+	if len(db.calls) != len(want) {
+		t.Fatalf("ran %v statements, want %v:\n%v", len(db.calls), len(want), strings.Join(db.sql(), "\n"))
+	}
+	for i, w := range want {
+		got := db.calls[i]
+		if !strings.HasPrefix(got.SQL, w.SQL) {
+			t.Errorf("statement %d is %v, want %v", i, got.SQL, w.SQL)
+		}
+		if w.Args != nil && !reflect.DeepEqual(got.Args, w.Args) {
+			t.Errorf("statement %d args %#v, want %#v", i, got.Args, w.Args)
+		}
+	}
+}
+
+func TestRegistrationCreateEventFull(t *testing.T) {
+	db := registrationFake(1)
+	r := registration{
+		OrderDate:  "2026-05-01",
+		SessionID:  "twosome-session",
+		PricingID:  "pricing-2",
+		GolferInfo: []golfer{{Name: "Ann", ShirtSize: "1"}, {Name: "Bob", ShirtSize: "2"}},
+	}
+	_, err := r.create(db)
+	if !errors.Is(err, errEventFull) {
+		t.Fatalf("create err %v, want %v", err, errEventFull)
+	}
+	for _, sql := range db.sql() {
+		if strings.HasPrefix(sql, "insert") {
+			t.Errorf("a full event still ran %v", sql)
+		}
+	}
+	if got := db.sql(); got[len(got)-1] != "rollback" {
+		t.Errorf("a full event ended with %v", got[len(got)-1])
+	}
+}
+
+func TestRegistrationCreateRollsBack(t *testing.T) {
+	db := registrationFake(2)
+	db.fails("insert into cart_participant_option", errors.New("no such option item"))
+	r := registration{
+		OrderDate:  "2026-05-01",
+		SessionID:  "twosome-session",
+		PricingID:  "pricing-2",
+		GolferInfo: []golfer{{Name: "Ann", ShirtSize: "99"}},
+	}
+	_, err := r.create(db)
+	if err == nil {
+		t.Fatal("create with a failing option succeeded")
+	}
+	got := db.sql()
+	if got[0] != "begin" || got[len(got)-1] != "rollback" {
+		t.Errorf("ran\n%v", strings.Join(got, "\n"))
+	}
+}
+
+func TestRegistrationCreateChecksGolferCount(t *testing.T) {
+	for _, n := range []int{0, 3, 5} {
+		db := registrationFake(n)
+		r := registration{OrderDate: "2026-05-01", SessionID: "s", PricingID: "pricing-2"}
+		for i := 0; i < n; i++ {
+			r.GolferInfo = append(r.GolferInfo, golfer{Name: "Ann", ShirtSize: "1"})
+		}
+		_, err := r.create(db)
+		var errs validationErrors
+		if !errors.As(err, &errs) || errs["golferinfo"] != "must have 1, 2 or 4 items" {
+			t.Errorf("create with %v golfers = %v", n, err)
+		}
+		if len(db.sql()) != 0 {
+			t.Errorf("create with %v golfers ran %v", n, db.sql())
+		}
+	}
+}
+
+func TestHandleRejectsUnauthenticated(t *testing.T) {
+	attempts := withoutDatabase(t, errors.New("refused"))
+	saved := authenticate
+	authenticate = func(handler.Request) error { return errors.New("invalid api key") }
+	t.Cleanup(func() { authenticate = saved })
+
+	// a cached report is not served either
+	cached := handler.Request{Body: []byte(`{"action":"read","table":"club_summary"}`)}
+	key, _ := reportCacheKey(cached, Data{Action: "read", Table: "club_summary"})
+	want, _ := structResponse(clubSummary{LeftHanded: 1})
+	reports.store(key, reports.generation, want, "", time.Minute)
+	t.Cleanup(reports.invalidate)
+
+	for _, body := range []string{
+		`{"action":"migrate","migrate":{"direction":"down"}}`,
+		`{"action":"purge","table":"customer"}`,
+		`{"action":"delete","table":"event","delete":{"field":"eventid","value":"1"}}`,
+		`{"action":"merge_customers","merge_customers":{"customerid":1,"duplicates":[2]}}`,
+		`{"action":"cancel_order","cancel_order":{"salesorderid":1}}`,
+		`{"action":"readall","table":"customer","format":"csv"}`,
+		`{"action":"read","table":"club_summary"}`,
+	} {
+		resp, err := Handle(handler.Request{Body: []byte(body)})
+		if err == nil || string(resp.Body) != "invalid api key" {
+			t.Errorf("%v answered %s, %v", body, resp.Body, err)
+		}
+	}
+	if *attempts != 0 {
+		t.Errorf("unauthenticated requests connected %v times", *attempts)
+	}
+}
+
+func TestOnConflictClause(t *testing.T) {
+	for _, tc := range []struct {
+		oc   onConflict
+		want string
+	}{
+		{onConflict{}, ""},
+		{onConflict{DoNothing: true}, " on conflict do nothing"},
+		{onConflict{Columns: []string{"SessionID"}, DoNothing: true}, ` on conflict ("sessionid") do update set "sessionid"=excluded."sessionid"`},
+		{onConflict{Columns: []string{"sessionid"}, Update: []string{"orderdate"}}, ` on conflict ("sessionid") do update set "orderdate"=excluded."orderdate"`},
+	} {
+		got, err := tc.oc.clause()
+		if err != nil || got != tc.want {
+			t.Errorf("clause(%+v) = %q, %v, want %q", tc.oc, got, err, tc.want)
+		}
+	}
+
+	// the existing row's id comes back instead of 0
+	db := &fakeQuerier{}
+	db.returns("insert into shopping_order", []interface{}{7})
+	id, err := shopping_order{SessionID: "abc"}.create(db, "shopping_order", onConflict{Columns: []string{"sessionid"}, DoNothing: true})
+	if err != nil || id != 7 {
+		t.Errorf("create = %v, %v, want the existing id 7", id, err)
+	}
+	_, err = insertReturning(&fakeQuerier{}, onConflict{DoNothing: true}, "insert into shopping_order(sessionid) values('abc') on conflict do nothing returning shoppingorderid")
+	if err == nil {
+		t.Error("a skipped insert returned an id")
+	}
+}
+
+// cascadeFake answers cascadeRelations with the salesorder's foreign keys
+func cascadeFake() *fakeQuerier {
+	db := &fakeQuerier{}
+	db.returns("from pg_constraint",
+		[]interface{}{"participant", "participant_change", "participantid"},
+		[]interface{}{"participant", "participant_option", "participantid"},
+		[]interface{}{"purchase", "participant", "purchaseid"},
+		[]interface{}{"salesorder", "purchase", "salesorderid"},
+	)
+	return db
+}
+
+func TestDeleteRowsFollowsForeignKeys(t *testing.T) {
+	db := cascadeFake()
+	db.returns("from salesorder", []interface{}{"5"})
+	db.returns("from purchase", []interface{}{"6"})
+	db.returns("from participant ", []interface{}{"8"})
+	db.returns("from participant_option", []interface{}{"9"})
+
+	report, err := deleteRows(db, "salesorder", "", []string{"5"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := deleteReport{"salesorder": {"5"}, "purchase": {"6"}, "participant": {"8"}, "participant_option": {"9"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("report %v, want %v", report, want)
+	}
+	if got := db.find(t, "from participant_change").SQL; got != `select changeid::text from participant_change where "participantid"::text = any($1)` {
+		t.Errorf("ran %v", got)
+	}
+	for _, sql := range db.sql() {
+		if strings.HasPrefix(sql, "delete") {
+			t.Errorf("dry run ran %v", sql)
+		}
+	}
+
+	db = cascadeFake()
+	_, err = deleteRows(db, "salesorder", "salesorderid = any($1) or true --", []string{"5"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.find(t, "from salesorder").SQL; got != `select salesorderid::text from salesorder where "salesorderid = any($1) or true --"::text = any($1)` {
+		t.Errorf("field was not quoted: %v", got)
+	}
+}
+
+func TestSoftDeleteCascades(t *testing.T) {
+	db := cascadeFake()
+	db.returns("update salesorder", []interface{}{"5"})
+	db.returns("update purchase", []interface{}{"6"}, []interface{}{"7"})
+	db.returns("update participant ", []interface{}{"8"})
+
+	err := softDelete(db, "salesorder", `salesorderid"=0 or true --`, "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"begin",
+		db.find(t, "from pg_constraint").SQL,
+		`update salesorder set deleted_at = now() where "salesorderid""=0 or true --"::text = any($1) and deleted_at is null returning salesorderid::text`,
+		`update purchase set deleted_at = now() where "salesorderid"::text = any($1) and deleted_at is null returning purchaseid::text`,
+		`update participant set deleted_at = now() where "purchaseid"::text = any($1) and deleted_at is null returning participantid::text`,
+		`update participant_option set deleted_at = now() where "participantid"::text = any($1) and deleted_at is null returning participantoptionsid::text`,
+		"commit",
+	}
+	if got := db.sql(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran\n%v\nwant\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if got := db.find(t, "update participant ").Args; !reflect.DeepEqual(got, []interface{}{[]string{"6", "7"}}) {
+		t.Errorf("participants of %v", got)
+	}
+}
+
+func TestExpireCartsLeavesPaymentsAndPromotions(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("from shopping_order so", []interface{}{"4"})
+	db.returns(`from shopping_order where "shoppingorderid"`, []interface{}{"4"})
+
+	ce, err := expireCarts(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ce.Removed["shopping_order"] != 1 {
+		t.Errorf("expired %+v", ce)
+	}
+	call := db.find(t, "from shopping_order so")
+	for _, cond := range []string{
+		"so.lastactivityat < $1",
+		"so.paymentstatus is distinct from $2 and so.paymentstatus is distinct from $3",
+		"not exists (select 1 from waitlist w where w.shoppingorderid = so.shoppingorderid)",
+	} {
+		if !strings.Contains(call.SQL, cond) {
+			t.Errorf("expired without %v: %v", cond, call.SQL)
+		}
+	}
+	if call.Args[1] != paymentPending || call.Args[2] != paymentSucceeded {
+		t.Errorf("args %v", call.Args)
+	}
+}
+
+func TestCartActivityKeepsCarts(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+	register(t, f, "old-session", f.Solo, testGolfer{"Ann", "SMALL", ""})
+	_, err := db.Exec(context.Background(),
+		"update shopping_order set orderdate = now() - interval '2 days', lastactivityat = now() - interval '2 days'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a later change to the cart counts as activity, the orderdate does not
+	register(t, f, "old-session", f.Solo, testGolfer{"Bob", "LARGE", ""})
+
+	var ce cartExpiry
+	call(t, map[string]interface{}{"action": "expire_carts"}, &ce)
+	if len(ce.Removed) != 0 {
+		t.Errorf("expired an active cart: %+v", ce)
+	}
+}
+
+func TestWaitlistCreateNeedsSoldOutEvent(t *testing.T) {
+	for _, tc := range []struct {
+		capacity, registered int
+		err                  error
+	}{
+		{100, 5, errEventOpen},
+		{0, 5, errEventOpen},
+		{100, 100, nil},
+	} {
+		db := &fakeQuerier{}
+		db.returns("select pk.eventid", []interface{}{3})
+		db.returns("from event e", []interface{}{3, "Open", tc.capacity, tc.registered, 0})
+		db.returns("insert into waitlist", []interface{}{9})
+
+		_, err := waitlist{PricingID: "pricing-1", Name: "Ann"}.create(db, "waitlist")
+		if !errors.Is(err, tc.err) {
+			t.Errorf("create with %v of %v registered = %v, want %v", tc.registered, tc.capacity, err, tc.err)
+		}
+	}
+}
+
+func TestWaitlistReadQuotesField(t *testing.T) {
+	db := &fakeQuerier{}
+	var w waitlist
+	_, err := w.read(db, "EventID", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.sql()[0]; !strings.Contains(got, `where "eventid"=$1`) {
+		t.Errorf("read with %v", got)
+	}
+}
+
+func TestParticipantChangeReadQuotesField(t *testing.T) {
+	db := &fakeQuerier{}
+	var p participant_change
+	_, err := p.read(db, "participant_change", "participantid=1 or true --", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.sql()[0], `select * from participant_change where "participantid=1 or true --"=$1 order by changedat`; got != want {
+		t.Errorf("read with %v, want %v", got, want)
+	}
+}
+
+func TestPricingRuleReadQuotesField(t *testing.T) {
+	db := &fakeQuerier{}
+	var p pricing_rule
+	_, err := p.read(db, "pricing_rule", "PricingID", "pricing-1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.sql()[0], `select * from pricing_rule where "pricingid"=$1 and deleted_at is null`; got != want {
+		t.Errorf("read with %v, want %v", got, want)
+	}
+}
+
+func TestRefundReadQuotesField(t *testing.T) {
+	db := &fakeQuerier{}
+	var r refund
+	_, err := r.read(db, "refund", "SalesOrderID", "5", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.sql()[0], `select * from refund where "salesorderid"=$1 and deleted_at is null`; got != want {
+		t.Errorf("read with %v, want %v", got, want)
+	}
+}
+
+func TestNextInvoiceNoFormatsFromConfig(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, padding, includeYear string
+		want                         string
+	}{
+		{"INV-", "5", "true", fmt.Sprintf("INV-%d-00042", time.Now().Year())},
+		{"GOLF/", "3", "false", "GOLF/042"},
+	} {
+		t.Setenv("invoice_prefix", tc.prefix)
+		t.Setenv("invoice_padding", tc.padding)
+		t.Setenv("invoice_include_year", tc.includeYear)
+		db := &fakeQuerier{}
+		db.returns("update invoice_sequence", []interface{}{42})
+
+		no, err := nextInvoiceNo(&fakeTx{fakeQuerier: db}, testOrganizationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if no != tc.want {
+			t.Errorf("invoice no = %v, want %v", no, tc.want)
+		}
+		if got := db.find(t, "update invoice_sequence").Args[2]; got != (tc.includeYear == "true") {
+			t.Errorf("includeyear %v", got)
+		}
+	}
+}
+
+func TestPurgeReportsBlockedRows(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("where deleted_at <", []interface{}{"7"}, []interface{}{"8"})
+	db.returns(`from customer where "customerid"`, []interface{}{"7"})
+	db.fails("delete from customer", &pgconn.PgError{Code: foreignKeyViolation})
+	db.returns(`from customer where "customerid"`, []interface{}{"8"})
+
+	p, err := purge(db, "customer", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Purged != 1 || !reflect.DeepEqual(p.Blocked, []string{"7"}) {
+		t.Errorf("purged %+v", p)
+	}
+	var commits, rollbacks int
+	for _, sql := range db.sql() {
+		switch sql {
+		case "commit":
+			commits++
+		case "rollback":
+			rollbacks++
+		}
+	}
+	if commits != 1 || rollbacks != 1 {
+		t.Errorf("purged with %v commits and %v rollbacks", commits, rollbacks)
+	}
+}
+
+func TestRestoreOnlyChildrenDeletedTogether(t *testing.T) {
+	deleted := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	db := cascadeFake()
+	db.returns("update purchase", []interface{}{"6", deleted})
+
+	err := restore(db, "purchase", "", "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.find(t, "update purchase").SQL; !strings.Contains(got, `d."purchaseid"::text = any($1) and d.deleted_at is not null`) {
+		t.Errorf("restored with %v", got)
+	}
+	call := db.find(t, "update participant ")
+	if !strings.Contains(call.SQL, `d."purchaseid"::text = any($1) and d.deleted_at = $2`) {
+		t.Errorf("restored participants with %v", call.SQL)
+	}
+	if want := []interface{}{[]string{"6"}, deleted}; !reflect.DeepEqual(call.Args, want) {
+		t.Errorf("args %v, want %v", call.Args, want)
+	}
+}
+
+func TestTransferParticipantChangedBy(t *testing.T) {
+	var d Data
+	err := json.Unmarshal([]byte(`{"action":"transfer_participant","transfer_participant":{"participantid":"3","name":"Bob","changedby":"someone@example.com"}}`), &d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &fakeQuerier{}
+	_, err = d.TransferParticipant.transfer(db)
+	if err == nil || len(db.calls) != 0 {
+		t.Errorf("a changedby from the body was accepted: %v, ran %v", err, db.sql())
+	}
+
+	d.TransferParticipant.ChangedBy = "pat@example.com"
+	db.returns("select name from participant", []interface{}{"Ann"})
+	db.returns("insert into participant_change", []interface{}{1, 3, "pat@example.com", time.Now()})
+	_, err = d.TransferParticipant.transfer(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := db.find(t, "insert into participant_change").Args[5]; got != "pat@example.com" {
+		t.Errorf("changedby %v, want the caller", got)
+	}
+}
+
+func TestOrderOrganization(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("select distinct e.organizationid", []interface{}{testOrganizationID})
+	id, err := orderOrganization(db, "11")
+	if err != nil || id != testOrganizationID {
+		t.Errorf("orderOrganization = %v, %v", id, err)
+	}
+	if got := db.find(t, "organizationid").Args; !reflect.DeepEqual(got, []interface{}{"11"}) {
+		t.Errorf("args %v", got)
+	}
+
+	for _, rows := range [][][]interface{}{
+		nil,
+		{{testOrganizationID}, {"0e5bd0a4-7f0e-4a51-9c1c-2b0e6a5f8d13"}},
+	} {
+		db := &fakeQuerier{}
+		db.returns("select distinct e.organizationid", rows...)
+		_, err := orderOrganization(db, "11")
+		if err == nil {
+			t.Errorf("orderOrganization of %v organizations succeeded", len(rows))
+		}
+	}
+}
+
+func TestRevalidateCartChecksPrice(t *testing.T) {
+	rule := 5
+	for _, tc := range []struct {
+		price []interface{}
+		ok    bool
+	}{
+		{[]interface{}{"$180.00", 18000, rule}, true},
+		{[]interface{}{"$170.00", 17000, rule}, false},
+		{[]interface{}{"$190.00", 19000, nil}, false},
+	} {
+		db := &fakeQuerier{}
+		db.returns("from shopping_cart sc", []interface{}{21, "pricing-2", 4, nil, rule, 18000})
+		db.returns("coalesce(r.price, p.price)", tc.price)
+		db.results = append(db.results, &fakeResult{match: "update pricing_rule", tag: "UPDATE 1"})
+		tx, _ := db.Begin(context.Background())
+
+		err := revalidateCart(tx, "11")
+		if (err == nil) != tc.ok {
+			t.Errorf("revalidateCart priced at %v: %v", tc.price, err)
+		}
+		args := db.find(t, "coalesce(r.price, p.price)").Args
+		if at := args[1].(time.Time); time.Since(at) > time.Minute || args[2] != 4 {
+			t.Errorf("priced at %v for qty %v, want now and the order's 4", at, args[2])
+		}
+	}
+}
+
+func TestShoppingCartCreateReprices(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("select coalesce(sum(qty), 0) from shopping_cart", []interface{}{3})
+	db.returns("coalesce(r.price, p.price)", []interface{}{"$150.00", 15000, 9})
+	db.returns("insert into shopping_cart", []interface{}{24})
+	db.returns("select shoppingcartid, couponcode", []interface{}{21, nil}, []interface{}{22, nil})
+	db.returns("coalesce(r.price, p.price)", []interface{}{"$150.00", 15000, 9})
+	db.returns("coalesce(r.price, p.price)", []interface{}{"$150.00", 15000, 9})
+
+	id, err := shopping_cart{ShoppingOrderID: "11", PricingID: "pricing-2", Qty: "1"}.create(db, "shopping_cart", onConflict{})
+	if err != nil || id != 24 {
+		t.Fatalf("create = %v, %v", id, err)
+	}
+	if got := db.find(t, "coalesce(r.price, p.price)").Args[2]; got != 4 {
+		t.Errorf("priced for qty %v, want 4", got)
+	}
+	var repriced []interface{}
+	for _, c := range db.calls {
+		if strings.HasPrefix(c.SQL, "update shopping_cart set price") {
+			repriced = append(repriced, c.Args[2])
+		}
+	}
+	if !reflect.DeepEqual(repriced, []interface{}{21, 22}) {
+		t.Errorf("repriced lines %v, want 21 and 22", repriced)
+	}
+}
+
+func TestCreateMigrateDataRefused(t *testing.T) {
+	db := testDB(t)
+	f := seedFixtures(t, db)
+	register(t, f, "solo-session", f.Solo, testGolfer{"Ann", "SMALL", ""})
+
+	var qu quote
+	call(t, map[string]interface{}{"action": "read", "table": "quote", "read": map[string]string{"value": "solo-session"}}, &qu)
+	_, err := callErr(map[string]interface{}{
+		"action": "create",
+		"table":  "migrate_data",
+		"create": map[string]string{
+			"shoppingorderid": strconv.Itoa(qu.ShoppingOrderID),
+			"paymentid":       "pi_mine",
+			"paymentstatus":   "succeeded",
+			"name":            "Pat Jones",
+			"email":           "pat@example.com",
+			"phone":           "(555) 010-2030",
+		},
+	})
+	if err == nil {
+		t.Fatal("a client checked out its own order")
+	}
+	var n int
+	err = db.QueryRow(context.Background(), "select count(*) from salesorder").Scan(&n)
+	if err != nil || n != 0 {
+		t.Errorf("%v salesorders, %v", n, err)
+	}
+}
+
+func TestStripeWebhookIgnoresOtherEvents(t *testing.T) {
+	s := stripeProvider{webhookSecret: "whsec_test"}
+	for _, tc := range []struct {
+		typ, id, status string
+	}{
+		{"payment_intent.succeeded", "pi_1", paymentSucceeded},
+		{"payment_intent.payment_failed", "pi_1", paymentFailed},
+		{"payment_intent.canceled", "pi_1", paymentCanceled},
+		{"charge.succeeded", "", ""},
+	} {
+		object := `{"id":"pi_1","amount":10000,"currency":"usd","status":"succeeded","metadata":{"shoppingorderid":"11"}}`
+		if tc.typ == "charge.succeeded" {
+			object = strings.Replace(object, "pi_1", "ch_1", 1)
+		}
+		body := []byte(`{"id":"evt_1","type":"` + tc.typ + `","data":{"object":` + object + `}}`)
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte("whsec_test"))
+		mac.Write([]byte(timestamp + "." + string(body)))
+		header := http.Header{}
+		header.Set("Stripe-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+		ev, err := s.parseWebhook(header, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ev.PaymentID != tc.id || ev.Status != tc.status || (tc.id == "") != (ev.Metadata["shoppingorderid"] == "") {
+			t.Errorf("%v parsed as %+v", tc.typ, ev)
+		}
+	}
+	if paymentClient.Timeout == 0 {
+		t.Error("payment providers are called without a timeout")
+	}
+}
+
+func TestPaymentWebhookRecordsFailureOnShoppingOrder(t *testing.T) {
+	t.Setenv("allow_fake_payments", "true")
+	t.Setenv("fake_payment_secret", "whsec_test")
+	body := []byte(`{"eventid":"evt_1","paymentid":"fake_11_19000","status":"failed","metadata":{"shoppingorderid":"11"}}`)
+	mac := hmac.New(sha256.New, []byte("whsec_test"))
+	mac.Write(body)
+	header := http.Header{}
+	header.Set("X-Fake-Signature", hex.EncodeToString(mac.Sum(nil)))
+
+	db := &fakeQuerier{}
+	db.results = append(db.results, &fakeResult{match: "update salesorder", tag: "UPDATE 0"})
+	pw, err := processPaymentWebhook(context.Background(), db, "fake", header, body)
+	if err != nil || pw.CheckedOut {
+		t.Fatalf("webhook = %+v, %v", pw, err)
+	}
+	recorded := db.find(t, "update shopping_order")
+	if want := []interface{}{"fake_11_19000", paymentFailed, 11}; !reflect.DeepEqual(recorded.Args, want) {
+		t.Errorf("recorded %v, want %v", recorded.Args, want)
+	}
+}
@@ -0,0 +1,47 @@
+package function
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// openPool returns the pool if a request has opened it, without opening it
+func openPool() *pgxpool.Pool {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	return pool
+}
+
+// closePool closes the pool if a request has opened it, a later request would
+// open a new one
+func closePool() {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if pool != nil {
+		pool.Close()
+		pool = nil
+	}
+}
+
+// Ready reports whether requests can be served, the template server answers
+// /_/ready of its admin port with it. The database credentials are cached in
+// the pool once it is open, before that they have to load from vault. The
+// database has to answer a select 1.
+func Ready(ctx context.Context) error {
+	p := openPool()
+	if p == nil {
+		var err error
+		p, err = dbPool(ctx)
+		if err != nil {
+			return fmt.Errorf("ready: secrets or database: %v", err)
+		}
+	}
+	var one int
+	err := p.QueryRow(ctx, "select 1").Scan(&one)
+	if err != nil {
+		return fmt.Errorf("ready: database: %v", err)
+	}
+	return nil
+}
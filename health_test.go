@@ -0,0 +1,46 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestReadyWithoutSecrets(t *testing.T) {
+	withoutDatabase(t, errors.New("vault unreachable"))
+
+	err := Ready(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "vault unreachable") {
+		t.Errorf("Ready = %v, want the secrets error", err)
+	}
+}
+
+func TestReady(t *testing.T) {
+	testDB(t)
+	err := Ready(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if openPool() == nil {
+		t.Error("Ready did not keep the pool it opened")
+	}
+}
+
+func TestClosePool(t *testing.T) {
+	testDB(t)
+	err := Ready(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := openPool()
+
+	// Shutdown closes it before the spans, which stay recorded for the other tests
+	closePool()
+	if openPool() != nil {
+		t.Error("closePool kept the pool")
+	}
+	if p.Ping(context.Background()) == nil {
+		t.Error("the pool answers once closed")
+	}
+}
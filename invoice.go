@@ -0,0 +1,211 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// invoice number format defaults, used when invoice_prefix, invoice_padding
+// or invoice_include_year is not set
+const (
+	defaultInvoicePrefix  = "INV-"
+	defaultInvoicePadding = 5
+)
+
+// invoiceFormat is how invoice numbers are written, with IncludeYear the
+// numbers restart every year
+type invoiceFormat struct {
+	Prefix      string
+	IncludeYear bool
+	Padding     int
+}
+
+// invoiceFormatFromEnv reads the format from invoice_prefix, invoice_padding
+// and invoice_include_year. It is read on every checkout, so a change applies
+// to every organization from its next invoice on.
+func invoiceFormatFromEnv() (invoiceFormat, error) {
+	f := invoiceFormat{Prefix: defaultInvoicePrefix, IncludeYear: true, Padding: defaultInvoicePadding}
+	if v, ok := os.LookupEnv("invoice_prefix"); ok {
+		f.Prefix = v
+	}
+	if v := os.Getenv("invoice_padding"); v != "" {
+		padding, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("invoice_padding: %v", err)
+		}
+		f.Padding = padding
+	}
+	if v := os.Getenv("invoice_include_year"); v != "" {
+		includeYear, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invoice_include_year: %v", err)
+		}
+		f.IncludeYear = includeYear
+	}
+	return f, nil
+}
+
+// format renders invoice no of year, e.g. INV-2022-00042
+func (f invoiceFormat) format(year, no int) string {
+	n := fmt.Sprintf("%0*d", f.Padding, no)
+	if f.IncludeYear {
+		return fmt.Sprintf("%v%d-%v", f.Prefix, year, n)
+	}
+	return f.Prefix + n
+}
+
+// nextInvoiceNo takes the next number of organizationID's sequence. The row
+// stays locked until tx ends, so concurrent checkouts queue up and a rolled
+// back checkout hands its number to the next one, keeping the numbers gap
+// free.
+func nextInvoiceNo(tx pgx.Tx, organizationID string) (string, error) {
+	f, err := invoiceFormatFromEnv()
+	if err != nil {
+		return "", err
+	}
+	year := time.Now().Year()
+
+	exec := fmt.Sprintf(`
+	insert into invoice_sequence(organizationid, year, nextno)
+	values ($1, $2, 1)
+	on conflict (organizationid) do nothing`)
+	_, err = tx.Exec(context.Background(), exec, organizationID, year)
+	if err != nil {
+		return "", fmt.Errorf("invoice_sequence: %v", err)
+	}
+
+	var no int
+	exec = fmt.Sprintf(`
+	update invoice_sequence set
+	nextno = case when $3 and year <> $2 then 2 else nextno + 1 end,
+	year = $2
+	where organizationid = $1
+	returning nextno - 1`)
+	err = tx.QueryRow(context.Background(), exec, organizationID, year, f.IncludeYear).Scan(&no)
+	if err != nil {
+		return "", fmt.Errorf("invoice_sequence: %v", err)
+	}
+	return f.format(year, no), nil
+}
+
+type invoiceLine struct {
+	PurchaseID  int    `json:"purchaseid"`
+	Qty         int    `json:"qty"`
+	ProductName string `json:"productname"`
+	Description string `json:"description"`
+	Price       string `json:"price"`
+}
+
+type invoiceCustomer struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+// invoice is the complete invoice document of a salesorder
+type invoice struct {
+	InvoiceNo    string          `json:"invoiceno"`
+	SalesOrderID int             `json:"salesorderid"`
+	OrderDate    time.Time       `json:"orderdate"`
+	PaymentID    string          `json:"paymentid"`
+	Customer     invoiceCustomer `json:"customer"`
+	Lines        []invoiceLine   `json:"lines"`
+	Subtotal     string          `json:"subtotal"`
+	Tax          string          `json:"tax"`
+	Refunded     string          `json:"refunded"`
+	Total        string          `json:"total"`
+}
+
+// read builds the invoice of the salesorder whose salesorderid or invoiceno
+// is value
+func (i *invoice) read(db Querier, field, value string) error {
+	switch strings.ToLower(field) {
+	case "salesorderid", "invoiceno":
+	default:
+		return fmt.Errorf("invoice: cannot read by %v", field)
+	}
+
+	exec := fmt.Sprintf(`
+	select s.salesorderid, s.invoiceno, s.orderdate, s.paymentid,
+	c.customerid, c.name, c.email, c.phone
+	from salesorder s
+	inner join customer c on c.customerid = s.customerid
+	where s.%v::text = $1`, strings.ToLower(field))
+	err := db.QueryRow(context.Background(), exec, value).Scan(
+		&i.SalesOrderID, &i.InvoiceNo, &i.OrderDate, &i.PaymentID,
+		&i.Customer.ID, &i.Customer.Name, &i.Customer.Email, &i.Customer.Phone,
+	)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return fmt.Errorf("invoice: no salesorder with %v %v", field, value)
+	case err != nil:
+		return fmt.Errorf("invoice salesorder: %v", err)
+	}
+
+	exec = fmt.Sprintf(`
+	select purchaseid, qty, productname, description, price
+	from purchase
+	where salesorderid = $1
+	order by purchaseid`)
+	rows, err := db.Query(context.Background(), exec, i.SalesOrderID)
+	if err != nil {
+		return fmt.Errorf("invoice purchase: %v", err)
+	}
+	for rows.Next() {
+		var l invoiceLine
+		err := rows.Scan(&l.PurchaseID, &l.Qty, &l.ProductName, &l.Description, &l.Price)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("invoice purchase scan: %v", err)
+		}
+		i.Lines = append(i.Lines, l)
+	}
+	rows.Close()
+
+	exec = fmt.Sprintf(`
+	select subtotal, tax, refunded, subtotal + tax - refunded from (
+			select
+			(select coalesce(sum(price), cast(0 as money)) from purchase where salesorderid = $1) as subtotal,
+			(select coalesce(tax, cast(0 as money)) from salesorder where salesorderid = $1) as tax,
+			(select coalesce(sum(amount), cast(0 as money)) from refund where salesorderid = $1) as refunded
+	) t`)
+	err = db.QueryRow(context.Background(), exec, i.SalesOrderID).Scan(&i.Subtotal, &i.Tax, &i.Refunded, &i.Total)
+	if err != nil {
+		return fmt.Errorf("invoice totals: %v", err)
+	}
+	return nil
+}
+
+var invoiceTemplate = template.Must(template.New("invoice").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Invoice {{.InvoiceNo}}</title></head>
+<body>
+<h1>Invoice {{.InvoiceNo}}</h1>
+<p>Order {{.SalesOrderID}}, {{.OrderDate.Format "January 2, 2006"}}</p>
+<p>{{.Customer.Name}}<br>{{.Customer.Email}}<br>{{.Customer.Phone}}</p>
+<table>
+<tr><th>Product</th><th>Description</th><th>Qty</th><th>Price</th></tr>
+{{range .Lines}}<tr><td>{{.ProductName}}</td><td>{{.Description}}</td><td>{{.Qty}}</td><td>{{.Price}}</td></tr>
+{{end}}</table>
+<p>Subtotal: {{.Subtotal}}<br>Tax: {{.Tax}}<br>Refunded: {{.Refunded}}<br>Total: {{.Total}}</p>
+<p>Payment reference: {{.PaymentID}}</p>
+</body>
+</html>
+`))
+
+// html renders the invoice as a printable page
+func (i invoice) html() ([]byte, error) {
+	var buf bytes.Buffer
+	err := invoiceTemplate.Execute(&buf, i)
+	return buf.Bytes(), err
+}
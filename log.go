@@ -0,0 +1,308 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	handler "github.com/openfaas/templates-sdk/go-http"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// logger writes one json object per line to stderr, where the watchdog
+// collects it. log_level is the minimum level logged, debug, info, warn or
+// error, info by default. Debug adds a line per sql statement.
+var logger = newLogger(os.Stderr, os.Getenv("log_level"))
+
+func newLogger(w io.Writer, level string) zerolog.Logger {
+	l, err := zerolog.ParseLevel(strings.ToLower(strings.TrimSpace(level)))
+	if err != nil || l == zerolog.NoLevel {
+		l = zerolog.InfoLevel
+	}
+	return zerolog.New(w).Level(l).With().Timestamp().Logger()
+}
+
+var (
+	emailRedaction  = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+	phoneRedaction  = regexp.MustCompile(`(?:\+?[0-9]{1,2}[ .-]?)?\(?[0-9]{3}\)?[ .-]?[0-9]{3}[ .-]?[0-9]{4}\b`)
+	secretRedaction = regexp.MustCompile(`(?i)(password|secret|token|apikey|api_key|authorization)("?\s*[:=]\s*"?)[^\s",]+`)
+)
+
+// redact masks the emails, phone numbers and secrets in s, errors and sql
+// can carry the values of a request
+func redact(s string) string {
+	s = emailRedaction.ReplaceAllString(s, "[email]")
+	s = phoneRedaction.ReplaceAllString(s, "[phone]")
+	return secretRedaction.ReplaceAllString(s, "$1$2[secret]")
+}
+
+// maskEmail keeps enough of email to tell callers apart in the logs,
+// pat@example.com is p***@example.com
+func maskEmail(email string) string {
+	email = strings.TrimSpace(email)
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		if email == "" {
+			return ""
+		}
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID is the caller's X-Request-Id when it is a sensible one, or a new
+// uuid
+func requestID(h http.Header) string {
+	if id := strings.TrimSpace(h.Get("X-Request-Id")); requestIDPattern.MatchString(id) {
+		return id
+	}
+	return uuid.Must(uuid.NewV4()).String()
+}
+
+// requestLog collects what is logged about one call of Handle, Handle logs
+// it once the response is ready
+type requestLog struct {
+	ID     string
+	Caller string
+	Action string
+	Table  string
+	// Rows counts the rows every statement affected or returned
+	Rows int64
+	// ErrorClass overrides the class errorClass would give the error
+	ErrorClass string
+	start      time.Time
+	// Cache is hit or miss for the reports kept in the report cache
+	Cache string
+	// ctx holds the span of the request
+	ctx context.Context
+}
+
+func newRequestLog(req handler.Request) *requestLog {
+	return &requestLog{
+		ID:     requestID(req.Header),
+		Caller: maskEmail(req.Header.Get("email")),
+		start:  time.Now(),
+	}
+}
+
+func (rl *requestLog) event(e *zerolog.Event) *zerolog.Event {
+	if sc := trace.SpanContextFromContext(rl.ctx); sc.IsValid() {
+		e = e.Str("traceid", sc.TraceID().String())
+	}
+	return e.Str("requestid", rl.ID).
+		Str("caller", rl.Caller).
+		Str("action", strings.ToLower(rl.Action)).
+		Str("table", strings.ToLower(rl.Table))
+}
+
+// done logs the outcome of the request, failures at warn when the request
+// was at fault and at error otherwise
+func (rl *requestLog) done(status int, err error) {
+	e := logger.Info()
+	class := ""
+	if err != nil {
+		class = rl.ErrorClass
+		if class == "" {
+			class = errorClass(err)
+		}
+		e = logger.Warn()
+		if class == "database" || class == "connection" {
+			e = logger.Error()
+		}
+	}
+	e = rl.event(e).
+		Int("status", status).
+		Dur("durationms", time.Since(rl.start)).
+		Int64("rows", rl.Rows)
+	if rl.Cache != "" {
+		e = e.Str("cache", rl.Cache)
+	}
+	if err != nil {
+		e = e.Str("errorclass", class).Str("error", redact(err.Error()))
+	}
+	e.Msg("request")
+}
+
+// stmt is a sql statement of the request being run, end adds it to the
+// request, logs it at debug and ends its span
+type stmt struct {
+	rl    *requestLog
+	ctx   context.Context
+	sql   string
+	start time.Time
+	span  trace.Span
+}
+
+// begin starts the span of a statement, as a child of the span of ctx or
+// else of the request's
+func (rl *requestLog) begin(ctx context.Context, sql string) stmt {
+	if !trace.SpanContextFromContext(ctx).IsValid() && rl.ctx != nil {
+		ctx = rl.ctx
+	}
+	operation, table := statementName(sql)
+	name := strings.TrimSpace(operation + " " + table)
+	ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemPostgreSQL,
+		semconv.DBOperationKey.String(operation),
+		semconv.DBSQLTableKey.String(table),
+	))
+	return stmt{rl: rl, ctx: ctx, sql: sql, start: time.Now(), span: span}
+}
+
+func (st stmt) end(rows int64, err error) {
+	st.rl.Rows += rows
+	st.span.SetAttributes(attribute.Int64("db.rows", rows))
+	if errors.Is(err, pgx.ErrNoRows) {
+		endSpan(st.span, nil)
+	} else {
+		endSpan(st.span, err)
+	}
+
+	e := logger.Debug()
+	if !e.Enabled() {
+		return
+	}
+	e = st.rl.event(e).
+		Str("sql", redact(strings.Join(strings.Fields(st.sql), " "))).
+		Dur("durationms", time.Since(st.start)).
+		Int64("rows", rows)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		e = e.Str("error", redact(err.Error()))
+	}
+	e.Msg("statement")
+}
+
+// errorClass groups errors for the logs. Most errors are wrapped with %v, so
+// only the ones returned as they are can be told apart.
+func errorClass(err error) string {
+	var ve validationErrors
+	var pe *pgconn.PgError
+	switch {
+	case errors.As(err, &ve):
+		return "validation"
+	case errors.Is(err, errEventFull), errors.Is(err, errEventOpen):
+		return "capacity"
+	case errors.Is(err, errBadSignature):
+		return "signature"
+	case errors.Is(err, pgx.ErrNoRows):
+		return "notfound"
+	case errors.As(err, &pe):
+		return "database"
+	}
+	return "request"
+}
+
+// statementLog is the Querier Handle passes down, it counts the rows of each
+// statement into the request log and traces it
+type statementLog struct {
+	Querier
+	rl *requestLog
+}
+
+func (s statementLog) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	st := s.rl.begin(ctx, sql)
+	tag, err := s.Querier.Exec(st.ctx, sql, args...)
+	st.end(tag.RowsAffected(), err)
+	return tag, err
+}
+
+func (s statementLog) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	st := s.rl.begin(ctx, sql)
+	rows, err := s.Querier.Query(st.ctx, sql, args...)
+	if err != nil {
+		st.end(0, err)
+		return rows, err
+	}
+	return &loggedRows{Rows: rows, st: st}, nil
+}
+
+func (s statementLog) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	st := s.rl.begin(ctx, sql)
+	return loggedRow{Row: s.Querier.QueryRow(st.ctx, sql, args...), st: st}
+}
+
+func (s statementLog) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := s.Querier.Begin(ctx)
+	if err != nil {
+		return tx, err
+	}
+	return loggedTx{Tx: tx, log: statementLog{Querier: tx, rl: s.rl}}, nil
+}
+
+// loggedTx logs the statements run in a transaction like statementLog
+type loggedTx struct {
+	pgx.Tx
+	log statementLog
+}
+
+func (tx loggedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return tx.log.Exec(ctx, sql, args...)
+}
+
+func (tx loggedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return tx.log.Query(ctx, sql, args...)
+}
+
+func (tx loggedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return tx.log.QueryRow(ctx, sql, args...)
+}
+
+func (tx loggedTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return tx.log.Begin(ctx)
+}
+
+// loggedRows logs its statement once the rows are read or closed
+type loggedRows struct {
+	pgx.Rows
+	st   stmt
+	done bool
+}
+
+func (r *loggedRows) finish() {
+	if r.done {
+		return
+	}
+	r.done = true
+	r.st.end(r.Rows.CommandTag().RowsAffected(), r.Rows.Err())
+}
+
+func (r *loggedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.finish()
+	return false
+}
+
+func (r *loggedRows) Close() {
+	r.Rows.Close()
+	r.finish()
+}
+
+type loggedRow struct {
+	pgx.Row
+	st stmt
+}
+
+func (r loggedRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	var rows int64
+	if err == nil {
+		rows = 1
+	}
+	r.st.end(rows, err)
+	return err
+}
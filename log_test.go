@@ -0,0 +1,156 @@
+package function
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+func TestRedact(t *testing.T) {
+	for in, want := range map[string]string{
+		"customer pat@example.com exists":              "customer [email] exists",
+		"phone (555) 010-2030 and 555.010.2030":        "phone [phone] and [phone]",
+		"update customer set phone='+1 555 010 2030'":  "update customer set phone='[phone]'",
+		`{"apitoken":"abc123","name":"x"}`:             `{"apitoken":"[secret]","name":"x"}`,
+		"orderdate 2026-05-01 shoppingorderid 11":      "orderdate 2026-05-01 shoppingorderid 11",
+		"pricing aa9a52a7-ab83-46ff-ab15-b35bd868407f": "pricing aa9a52a7-ab83-46ff-ab15-b35bd868407f",
+	} {
+		if got := redact(in); got != want {
+			t.Errorf("redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	if got := maskEmail("pat@example.com"); got != "p***@example.com" {
+		t.Errorf("maskEmail = %v", got)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Request-Id", "abc-123")
+	if got := requestID(h); got != "abc-123" {
+		t.Errorf("requestID kept %v, want abc-123", got)
+	}
+	h.Set("X-Request-Id", "bad id\n{}")
+	if got := requestID(h); got == "bad id\n{}" || got == "" {
+		t.Errorf("requestID kept %q", got)
+	}
+	if requestID(nil) == requestID(nil) {
+		t.Error("generated request ids repeat")
+	}
+}
+
+// captureLogs sends the logs to a buffer at level for the rest of the test
+func captureLogs(t *testing.T, level string) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := logger
+	logger = newLogger(&buf, level)
+	t.Cleanup(func() { logger = saved })
+	return &buf
+}
+
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var ll []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var l map[string]interface{}
+		err := json.Unmarshal([]byte(line), &l)
+		if err != nil {
+			t.Fatalf("log line %q is not json: %v", line, err)
+		}
+		ll = append(ll, l)
+	}
+	return ll
+}
+
+func TestHandleLogsRequest(t *testing.T) {
+	buf := captureLogs(t, "")
+	withoutDatabase(t, errors.New("dial pat@example.com: refused"))
+
+	req := handler.Request{Body: []byte(`{"action":"read","table":"customer"}`), Header: http.Header{}}
+	req.Header.Set("X-Request-Id", "req-1")
+	req.Header.Set("email", "admin@example.com")
+	resp, err := Handle(req)
+	if err == nil {
+		t.Fatal("Handle without a database did not fail")
+	}
+	if got := resp.Header["X-Request-Id"]; len(got) != 1 || got[0] != "req-1" {
+		t.Errorf("response X-Request-Id = %v", got)
+	}
+
+	ll := logLines(t, buf)
+	if len(ll) != 1 {
+		t.Fatalf("logged %v lines, want 1: %v", len(ll), buf)
+	}
+	l := ll[0]
+	for k, want := range map[string]interface{}{
+		"level":      "error",
+		"message":    "request",
+		"requestid":  "req-1",
+		"caller":     "a***@example.com",
+		"action":     "read",
+		"table":      "customer",
+		"errorclass": "connection",
+		"error":      "dial [email]: refused",
+		"status":     float64(http.StatusBadRequest),
+	} {
+		if l[k] != want {
+			t.Errorf("%v = %v, want %v", k, l[k], want)
+		}
+	}
+	if _, ok := l["durationms"]; !ok {
+		t.Error("no durationms logged")
+	}
+}
+
+func TestStatementLogCountsRows(t *testing.T) {
+	buf := captureLogs(t, "debug")
+	db := &fakeQuerier{}
+	db.returns("from customer", []interface{}{1}, []interface{}{2})
+	db.results = append(db.results, &fakeResult{match: "update customer", tag: "UPDATE 3"})
+	db.fails("delete from customer", validationErrors{"customerid": "is required"})
+
+	rl := &requestLog{ID: "req-2", Action: "read", Table: "customer"}
+	sl := statementLog{Querier: db, rl: rl}
+
+	rows, err := sl.Query(context.Background(), "select customerid from customer where email = 'pat@example.com'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+	}
+	rows.Close()
+	tx, err := sl.Begin(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec(context.Background(), "update customer set name = $1", "Pat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Exec(context.Background(), "delete from customer")
+	tx.Rollback(context.Background())
+
+	if rl.Rows != 5 {
+		t.Errorf("counted %v rows, want 2 read and 3 updated", rl.Rows)
+	}
+	ll := logLines(t, buf)
+	if len(ll) != 3 {
+		t.Fatalf("logged %v statements, want 3: %v", len(ll), buf)
+	}
+	if got := ll[0]["sql"]; got != "select customerid from customer where email = '[email]'" {
+		t.Errorf("logged sql %v", got)
+	}
+	if ll[1]["rows"] != float64(3) || ll[2]["error"] == nil {
+		t.Errorf("transaction statements logged as %v", ll[1:])
+	}
+}
@@ -0,0 +1,206 @@
+package function
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "mojodomo"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests handled by action, table and response status.",
+	}, []string{"action", "table", "status"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle a request by action, table and response status.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"action", "table", "status"})
+
+	secretFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_fetch_duration_seconds",
+		Help:      "Time taken to fetch a secret from vault by path.",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"path"})
+
+	secretFetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secret_fetch_errors_total",
+		Help:      "Failed secret fetches from vault by path.",
+	}, []string{"path"})
+)
+
+// metricsRegistry holds the metrics served by MetricsHandler
+var metricsRegistry = prometheus.NewRegistry()
+
+// the collectors are registered in init, after the descriptions they use are
+// set
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestsTotal,
+		requestDuration,
+		secretFetchDuration,
+		secretFetchErrors,
+		poolCollector{},
+		businessCollector{},
+	)
+}
+
+// MetricsHandler serves the metrics in the prometheus text format, the
+// template server mounts it on /metrics of its admin port
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+var labelPattern = regexp.MustCompile(`^[a-z_]{1,64}$`)
+
+// maxLabelValues bounds the distinct actions and tables labelled, they come
+// from the request body
+const maxLabelValues = 200
+
+var (
+	labelMu     sync.Mutex
+	labelValues = map[string]bool{}
+)
+
+// metricLabel is v as a label value, values that cannot be an action or a
+// table, or that come after maxLabelValues others, are "other"
+func metricLabel(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return "none"
+	}
+	if !labelPattern.MatchString(v) {
+		return "other"
+	}
+	labelMu.Lock()
+	defer labelMu.Unlock()
+	if !labelValues[v] {
+		if len(labelValues) >= maxLabelValues {
+			return "other"
+		}
+		labelValues[v] = true
+	}
+	return v
+}
+
+// observe counts the request and its duration
+func (rl *requestLog) observe(status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	labels := prometheus.Labels{
+		"action": metricLabel(rl.Action),
+		"table":  metricLabel(rl.Table),
+		"status": strconv.Itoa(status),
+	}
+	requestsTotal.With(labels).Inc()
+	requestDuration.With(labels).Observe(time.Since(rl.start).Seconds())
+}
+
+func observeSecretFetch(path string, start time.Time, err error) {
+	secretFetchDuration.WithLabelValues(path).Observe(time.Since(start).Seconds())
+	if err != nil {
+		secretFetchErrors.WithLabelValues(path).Inc()
+	}
+}
+
+var (
+	poolAcquiredConns = prometheus.NewDesc(metricsNamespace+"_pool_acquired_conns", "Connections in use.", nil, nil)
+	poolIdleConns     = prometheus.NewDesc(metricsNamespace+"_pool_idle_conns", "Idle connections.", nil, nil)
+	poolTotalConns    = prometheus.NewDesc(metricsNamespace+"_pool_total_conns", "Open connections.", nil, nil)
+	poolMaxConns      = prometheus.NewDesc(metricsNamespace+"_pool_max_conns", "Most connections the pool opens.", nil, nil)
+	poolAcquires      = prometheus.NewDesc(metricsNamespace+"_pool_acquires_total", "Connections acquired.", nil, nil)
+	poolEmptyAcquires = prometheus.NewDesc(metricsNamespace+"_pool_empty_acquires_total", "Acquires that waited for a connection.", nil, nil)
+	poolCanceled      = prometheus.NewDesc(metricsNamespace+"_pool_canceled_acquires_total", "Acquires canceled before a connection was available.", nil, nil)
+	poolAcquireTime   = prometheus.NewDesc(metricsNamespace+"_pool_acquire_seconds_total", "Time spent acquiring connections.", nil, nil)
+)
+
+// poolCollector reports the statistics of the connection pool once it is
+// open
+type poolCollector struct{}
+
+func (poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{poolAcquiredConns, poolIdleConns, poolTotalConns, poolMaxConns, poolAcquires, poolEmptyAcquires, poolCanceled, poolAcquireTime} {
+		ch <- d
+	}
+}
+
+func (poolCollector) Collect(ch chan<- prometheus.Metric) {
+	p := openPool()
+	if p == nil {
+		return
+	}
+	s := p.Stat()
+	ch <- prometheus.MustNewConstMetric(poolAcquiredConns, prometheus.GaugeValue, float64(s.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(poolIdleConns, prometheus.GaugeValue, float64(s.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(poolTotalConns, prometheus.GaugeValue, float64(s.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(poolMaxConns, prometheus.GaugeValue, float64(s.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(poolAcquires, prometheus.CounterValue, float64(s.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolEmptyAcquires, prometheus.CounterValue, float64(s.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolCanceled, prometheus.CounterValue, float64(s.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(poolAcquireTime, prometheus.CounterValue, s.AcquireDuration().Seconds())
+}
+
+var (
+	eventRegistered = prometheus.NewDesc(metricsNamespace+"_event_participants_registered", "Confirmed participants by event.", []string{"eventid", "event"}, nil)
+	eventInFlight   = prometheus.NewDesc(metricsNamespace+"_event_participants_inflight", "Participants still in a shopping cart by event.", []string{"eventid", "event"}, nil)
+	eventRemaining  = prometheus.NewDesc(metricsNamespace+"_event_capacity_remaining", "Places left by event, events without a capacity are not reported.", []string{"eventid", "event"}, nil)
+	cartsOpen       = prometheus.NewDesc(metricsNamespace+"_carts_open", "Shopping orders not checked out or expired yet.", nil, nil)
+)
+
+// businessCollector queries the registrations and open carts on every
+// scrape. Nothing is reported before a request has opened the pool, and a
+// failed query is logged and left out of the scrape.
+type businessCollector struct{}
+
+func (businessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- eventRegistered
+	ch <- eventInFlight
+	ch <- eventRemaining
+	ch <- cartsOpen
+}
+
+func (businessCollector) Collect(ch chan<- prometheus.Metric) {
+	p := openPool()
+	if p == nil {
+		return
+	}
+
+	el, err := getEventCapacities(p, "true")
+	if err != nil {
+		logger.Warn().Str("error", redact(err.Error())).Msg("metrics")
+	}
+	for _, ec := range el {
+		id := strconv.Itoa(ec.EventID)
+		ch <- prometheus.MustNewConstMetric(eventRegistered, prometheus.GaugeValue, float64(ec.Registered), id, ec.Name)
+		ch <- prometheus.MustNewConstMetric(eventInFlight, prometheus.GaugeValue, float64(ec.InFlight), id, ec.Name)
+		if ec.Capacity > 0 {
+			ch <- prometheus.MustNewConstMetric(eventRemaining, prometheus.GaugeValue, float64(ec.Remaining), id, ec.Name)
+		}
+	}
+
+	var carts int
+	err = p.QueryRow(context.Background(), "select count(*) from shopping_order").Scan(&carts)
+	if err != nil {
+		logger.Warn().Str("error", redact(err.Error())).Msg("metrics")
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(cartsOpen, prometheus.GaugeValue, float64(carts))
+}
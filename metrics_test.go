@@ -0,0 +1,48 @@
+package function
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+)
+
+func TestMetricLabel(t *testing.T) {
+	for in, want := range map[string]string{
+		"Read":                "read",
+		"":                    "none",
+		"customer; drop":      "other",
+		"registration_detail": "registration_detail",
+	} {
+		if got := metricLabel(in); got != want {
+			t.Errorf("metricLabel(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	captureLogs(t, "error")
+	withoutDatabase(t, errors.New("refused"))
+
+	Handle(handler.Request{Body: []byte(`{"action":"create","table":"customer"}`)})
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	for _, want := range []string{
+		`mojodomo_requests_total{action="create",status="400",table="customer"}`,
+		`mojodomo_request_duration_seconds_count{action="create",status="400",table="customer"}`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics have no %v", want)
+		}
+	}
+	// the pool never opened, so neither are its statistics or the queries
+	if strings.Contains(string(body), "mojodomo_pool_") || strings.Contains(string(body), "mojodomo_carts_open") {
+		t.Error("metrics report a pool that is not open")
+	}
+}
@@ -0,0 +1,224 @@
+package function
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationLockClass namespaces the advisory lock held while migrating, so
+// two instances starting together apply each migration once
+const migrationLockClass = 4
+
+// migrationFiles holds the schema as NNNN_name.up.sql and NNNN_name.down.sql
+// pairs, applied in version order
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationName = regexp.MustCompile(`^([0-9]+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// loadMigrations reads the embedded migrations sorted by version, every
+// version needs both its up and its down file
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, f := range files {
+		m := migrationName.FindStringSubmatch(path.Base(f))
+		if m == nil {
+			return nil, fmt.Errorf("migrations: unexpected file %v", f)
+		}
+		version, _ := strconv.Atoi(m[1])
+		b, err := migrationFiles.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		mi, ok := byVersion[version]
+		if !ok {
+			mi = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mi
+		}
+		if mi.Name != m[2] {
+			return nil, fmt.Errorf("migrations: version %v is both %v and %v", version, mi.Name, m[2])
+		}
+		if m[3] == "up" {
+			mi.up = string(b)
+		} else {
+			mi.down = string(b)
+		}
+	}
+
+	var ml []migration
+	for _, mi := range byVersion {
+		if mi.up == "" || mi.down == "" {
+			return nil, fmt.Errorf("migrations: %04d_%v needs an up and a down file", mi.Version, mi.Name)
+		}
+		ml = append(ml, *mi)
+	}
+	sort.Slice(ml, func(i, j int) bool { return ml[i].Version < ml[j].Version })
+	return ml, nil
+}
+
+type migrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedat,omitempty"`
+}
+
+// migrate request, Direction is up, down or status. Up applies Steps pending
+// migrations, all of them when Steps is 0, down reverts the last Steps, one
+// when Steps is 0.
+type migrate struct {
+	Direction string `json:"direction"`
+	Steps     int    `json:"steps"`
+}
+
+// run applies the request and returns the status of every migration
+// afterwards
+func (mr migrate) run(db Querier) ([]migrationStatus, error) {
+	if mr.Steps < 0 {
+		return nil, errors.New("migrate: steps cannot be negative")
+	}
+	ml, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(context.Background(), `
+	create table if not exists schema_migrations (
+			version integer primary key,
+			name text not null,
+			appliedat timestamptz not null default now()
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %v", err)
+	}
+
+	_, err = db.Exec(context.Background(), "select pg_advisory_lock($1, 0)", migrationLockClass)
+	if err != nil {
+		return nil, fmt.Errorf("migrate lock: %v", err)
+	}
+	defer db.Exec(context.Background(), "select pg_advisory_unlock($1, 0)", migrationLockClass)
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(mr.Direction) {
+	case "up":
+		n := 0
+		for _, m := range ml {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if mr.Steps > 0 && n == mr.Steps {
+				break
+			}
+			err = applyMigration(db, m, true)
+			if err != nil {
+				return nil, err
+			}
+			n++
+		}
+	case "down":
+		steps := mr.Steps
+		if steps == 0 {
+			steps = 1
+		}
+		for i := len(ml) - 1; i >= 0 && steps > 0; i-- {
+			if _, ok := applied[ml[i].Version]; !ok {
+				continue
+			}
+			err = applyMigration(db, ml[i], false)
+			if err != nil {
+				return nil, err
+			}
+			steps--
+		}
+	case "status", "":
+	default:
+		return nil, fmt.Errorf("migrate: unknown direction %v", mr.Direction)
+	}
+
+	applied, err = appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var sl []migrationStatus
+	for _, m := range ml {
+		ms := migrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := applied[m.Version]; ok {
+			ms.Applied = true
+			ms.AppliedAt = &at
+		}
+		sl = append(sl, ms)
+	}
+	return sl, nil
+}
+
+func appliedMigrations(db Querier) (map[int]time.Time, error) {
+	applied := map[int]time.Time{}
+	rows, err := db.Query(context.Background(), "select version, appliedat from schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("schema_migrations: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var at time.Time
+		err := rows.Scan(&version, &at)
+		if err != nil {
+			return nil, fmt.Errorf("schema_migrations scan: %v", err)
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// applyMigration runs the up or down script of m and records it in
+// schema_migrations in one transaction
+func applyMigration(db Querier, m migration, up bool) error {
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	script, record := m.down, "delete from schema_migrations where version = $1"
+	if up {
+		script, record = m.up, "insert into schema_migrations(version, name) values ($1, $2)"
+	}
+	_, err = tx.Exec(context.Background(), script)
+	if err != nil {
+		return fmt.Errorf("migration %04d_%v: %v", m.Version, m.Name, err)
+	}
+	args := []interface{}{m.Version}
+	if up {
+		args = append(args, m.Name)
+	}
+	_, err = tx.Exec(context.Background(), record, args...)
+	if err != nil {
+		return fmt.Errorf("schema_migrations: %v", err)
+	}
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,18 @@
+drop table participant_option;
+drop table participant;
+drop table purchase;
+drop table salesorder;
+drop table cart_participant_option;
+drop table cart_participant;
+drop table shopping_cart;
+drop table shopping_order;
+drop table option_item;
+drop table category_option;
+drop table package;
+drop table package_category;
+drop table pricing;
+drop table product;
+drop table customer;
+drop table event;
+drop table payment_provider;
+drop table organization;
@@ -0,0 +1,131 @@
+-- Tables as the handler has always used them. Reads select * and scan by
+-- position, so the column order here is part of the contract: later
+-- migrations only ever append columns.
+-- gen_random_uuid() is built in from postgres 13.
+
+create table organization (
+    organizationid uuid primary key default gen_random_uuid(),
+    name text not null,
+    address text not null default '',
+    city text not null default '',
+    state text not null default '',
+    postcode text not null default '',
+    isactive boolean not null default true
+);
+
+create table payment_provider (
+    id uuid primary key default gen_random_uuid(),
+    name text not null
+);
+
+create table event (
+    eventid serial primary key,
+    organizationid uuid not null references organization,
+    name text not null,
+    location text not null default '',
+    capacity integer not null default 0,
+    startson date not null,
+    endson date not null
+);
+
+create table customer (
+    customerid serial primary key,
+    organizationid uuid not null references organization,
+    name text not null,
+    email text not null default '',
+    phone text not null default ''
+);
+
+create table product (
+    productid uuid primary key default gen_random_uuid(),
+    description text not null,
+    paymentproviderid uuid not null references payment_provider
+);
+
+create table pricing (
+    pricingid uuid primary key default gen_random_uuid(),
+    productid uuid not null references product,
+    price money not null
+);
+
+create table package_category (
+    packagecategoryid serial primary key,
+    name text not null
+);
+
+create table package (
+    packageid serial primary key,
+    eventid integer not null references event,
+    productid uuid not null references product,
+    packagecategoryid integer not null references package_category,
+    name text not null,
+    description text not null default ''
+);
+
+create table category_option (
+    categoryoptionsid serial primary key,
+    packagecategoryid integer not null references package_category,
+    name text not null
+);
+
+create table option_item (
+    optionitemsid serial primary key,
+    categoryoptionsid integer not null references category_option,
+    name text not null
+);
+
+create table shopping_order (
+    shoppingorderid serial primary key,
+    orderdate timestamptz not null default now(),
+    sessionid text not null
+);
+
+create table shopping_cart (
+    shoppingcartid serial primary key,
+    shoppingorderid integer not null references shopping_order,
+    pricingid uuid not null references pricing,
+    qty integer not null
+);
+
+create table cart_participant (
+    cartparticipantid serial primary key,
+    shoppingcartid integer not null references shopping_cart,
+    name text not null
+);
+
+create table cart_participant_option (
+    cartparticipantoptionsid serial primary key,
+    cartparticipantid integer not null references cart_participant,
+    optionitemsid integer not null references option_item
+);
+
+-- checkout copies the cart rows over keeping their ids, so the order tables
+-- draw their defaults from the cart sequences and never collide with them
+create table salesorder (
+    salesorderid integer primary key default nextval('shopping_order_shoppingorderid_seq'),
+    orderdate timestamptz not null,
+    customerid integer not null references customer,
+    paymentid text not null default '',
+    invoiceno text not null default ''
+);
+
+create table purchase (
+    purchaseid integer primary key default nextval('shopping_cart_shoppingcartid_seq'),
+    salesorderid integer not null references salesorder,
+    qty integer not null,
+    productname text not null,
+    description text not null default '',
+    price money not null
+);
+
+create table participant (
+    participantid integer primary key default nextval('cart_participant_cartparticipantid_seq'),
+    purchaseid integer not null references purchase,
+    name text not null
+);
+
+create table participant_option (
+    participantoptionsid integer primary key default nextval('cart_participant_option_cartparticipantoptionsid_seq'),
+    participantid integer not null references participant,
+    optionitemsid integer not null references option_item
+);
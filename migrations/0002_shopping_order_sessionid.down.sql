@@ -0,0 +1 @@
+drop index shopping_order_sessionid_key;
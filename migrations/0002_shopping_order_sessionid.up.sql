@@ -0,0 +1,2 @@
+-- registration upserts the session's shopping order on sessionid
+create unique index shopping_order_sessionid_key on shopping_order (sessionid);
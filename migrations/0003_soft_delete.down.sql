@@ -0,0 +1,3 @@
+alter table customer drop column deleted_at;
+alter table event drop column deleted_at;
+alter table organization drop column deleted_at;
@@ -0,0 +1,3 @@
+alter table organization add column deleted_at timestamptz;
+alter table event add column deleted_at timestamptz;
+alter table customer add column deleted_at timestamptz;
@@ -0,0 +1,18 @@
+-- shoppingorderid is not a foreign key, checkout deletes the shopping order
+-- a promoted entry points at
+create table waitlist (
+    waitlistid serial primary key,
+    eventid integer not null references event,
+    pricingid uuid not null references pricing,
+    name text not null,
+    email text not null default '',
+    phone text not null default '',
+    golferinfo jsonb not null,
+    status text not null default 'waiting',
+    joinedat timestamptz not null default now(),
+    promotedat timestamptz,
+    sessionid text,
+    shoppingorderid integer
+);
+
+create index waitlist_eventid_status_idx on waitlist (eventid, status, joinedat);
@@ -0,0 +1,2 @@
+drop table refund;
+alter table participant drop column cancelledat;
@@ -0,0 +1,10 @@
+alter table participant add column cancelledat timestamptz;
+
+create table refund (
+    refundid serial primary key,
+    salesorderid integer not null references salesorder,
+    purchaseid integer not null references purchase,
+    amount money not null,
+    reason text not null default '',
+    refundedat timestamptz not null default now()
+);
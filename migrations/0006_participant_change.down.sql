@@ -0,0 +1 @@
+drop table participant_change;
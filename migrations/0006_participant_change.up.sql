@@ -0,0 +1,10 @@
+create table participant_change (
+    changeid serial primary key,
+    participantid integer not null references participant,
+    oldname text not null,
+    newname text not null,
+    oldoptions text[] not null default '{}',
+    newoptions text[] not null default '{}',
+    changedby text not null,
+    changedat timestamptz not null default now()
+);
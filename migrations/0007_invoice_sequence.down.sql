@@ -0,0 +1 @@
+drop table invoice_sequence;
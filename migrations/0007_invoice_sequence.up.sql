@@ -0,0 +1,8 @@
+create table invoice_sequence (
+    organizationid uuid primary key references organization,
+    prefix text not null,
+    includeyear boolean not null,
+    padding integer not null,
+    year integer not null,
+    nextno integer not null
+);
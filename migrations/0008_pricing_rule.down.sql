@@ -0,0 +1,7 @@
+alter table purchase drop column pricingruleid;
+
+alter table shopping_cart drop column couponcode;
+alter table shopping_cart drop column pricingruleid;
+alter table shopping_cart drop column price;
+
+drop table pricing_rule;
@@ -0,0 +1,18 @@
+create table pricing_rule (
+    ruleid serial primary key,
+    pricingid uuid not null references pricing,
+    name text not null,
+    price money not null,
+    validfrom timestamptz,
+    validuntil timestamptz,
+    minqty integer not null default 1,
+    couponcode text,
+    maxuses integer,
+    uses integer not null default 0
+);
+
+alter table shopping_cart add column price money;
+alter table shopping_cart add column pricingruleid integer references pricing_rule;
+alter table shopping_cart add column couponcode text;
+
+alter table purchase add column pricingruleid integer references pricing_rule;
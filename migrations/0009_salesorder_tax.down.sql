@@ -0,0 +1 @@
+alter table salesorder drop column tax;
@@ -0,0 +1 @@
+alter table salesorder add column paymentstatus text;
@@ -0,0 +1,2 @@
+drop index customer_phone_idx;
+drop index customer_email_idx;
@@ -0,0 +1,3 @@
+-- checkout matches returning customers on their normalized email and phone
+create index customer_email_idx on customer (organizationid, lower(trim(email))) where deleted_at is null;
+create index customer_phone_idx on customer (organizationid, regexp_replace(phone, '\D', '', 'g')) where deleted_at is null;
@@ -0,0 +1,4 @@
+drop table report_refresh;
+drop materialized view report_registration_detail;
+drop materialized view report_option;
+drop materialized view report_product;
@@ -0,0 +1,85 @@
+-- the reports read these views instead of aggregating the purchases on every
+-- call. Each has a unique index so it can be refreshed concurrently, and
+-- report_refresh records when it was last refreshed.
+
+-- totals of each product: active participants, registrations, collected and
+-- refunded
+create materialized view report_product as
+select pu.productname,
+    coalesce(pa.participants, 0) as participants,
+    coalesce(pa.registrations, 0) as registrations,
+    pu.collected,
+    coalesce(r.refunded, cast(0 as money)) as refunded
+from (
+    select productname, sum(price) as collected
+    from purchase
+    group by productname
+) pu
+left join (
+    select pu.productname, count(*)::integer as participants, sum(pu.qty)::integer as registrations
+    from participant pa
+    inner join purchase pu on pu.purchaseid = pa.purchaseid
+    where pa.cancelledat is null
+    group by pu.productname
+) pa on pa.productname = pu.productname
+left join (
+    select pu.productname, sum(r.amount) as refunded
+    from refund r
+    inner join purchase pu on pu.purchaseid = r.purchaseid
+    group by pu.productname
+) r on r.productname = pu.productname;
+
+create unique index report_product_idx on report_product (productname);
+
+-- active participants by the option item they chose, shirt sizes and
+-- dexterity among them
+create materialized view report_option as
+select oi.name, count(*)::integer as participants
+from participant_option po
+inner join option_item oi on oi.optionitemsid = po.optionitemsid
+inner join participant pa on pa.participantid = po.participantid
+where pa.cancelledat is null
+group by oi.name;
+
+create unique index report_option_idx on report_option (name);
+
+-- one row per salesorder with its active members, their shirts and clubs
+create materialized view report_registration_detail as
+select s.salesorderid, c.name, c.phone, t.members, t.shirt, t1.club
+from customer c
+inner join salesorder s on s.customerid = c.customerid
+inner join (
+    select pu.salesorderid,
+        string_agg(p.name, '\n' order by p.name) as members,
+        string_agg(oi.name, '\n' order by p.name) as shirt
+    from participant p
+    inner join purchase pu on pu.purchaseid = p.purchaseid
+    inner join participant_option po on po.participantid = p.participantid
+    inner join option_item oi on oi.optionitemsid = po.optionitemsid
+    inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+    and co.name = 'T-Shirt'
+    where p.cancelledat is null
+    group by pu.salesorderid
+) t on t.salesorderid = s.salesorderid
+left join (
+    select pu.salesorderid,
+        string_agg(oi.name, '\n' order by p.name) as club
+    from participant p
+    inner join purchase pu on pu.purchaseid = p.purchaseid
+    inner join participant_option po on po.participantid = p.participantid
+    inner join option_item oi on oi.optionitemsid = po.optionitemsid
+    inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+    and co.name = 'Dexterity'
+    where p.cancelledat is null
+    group by pu.salesorderid
+) t1 on t1.salesorderid = s.salesorderid;
+
+create unique index report_registration_detail_idx on report_registration_detail (salesorderid);
+
+create table report_refresh (
+    name text primary key,
+    refreshedat timestamptz not null default now()
+);
+
+insert into report_refresh(name) values
+    ('report_product'), ('report_option'), ('report_registration_detail');
@@ -0,0 +1,93 @@
+-- every entity table gets the deleted_at of 0003. Carts and waitlist entries
+-- expire on their own schedule and audit rows are never deleted, so those
+-- tables keep hard deletes.
+alter table payment_provider add column deleted_at timestamptz;
+alter table product add column deleted_at timestamptz;
+alter table pricing add column deleted_at timestamptz;
+alter table pricing_rule add column deleted_at timestamptz;
+alter table package_category add column deleted_at timestamptz;
+alter table package add column deleted_at timestamptz;
+alter table category_option add column deleted_at timestamptz;
+alter table option_item add column deleted_at timestamptz;
+alter table salesorder add column deleted_at timestamptz;
+alter table purchase add column deleted_at timestamptz;
+alter table participant add column deleted_at timestamptz;
+alter table participant_option add column deleted_at timestamptz;
+alter table refund add column deleted_at timestamptz;
+
+-- the report views are recreated to leave out soft deleted rows
+drop materialized view report_registration_detail;
+drop materialized view report_option;
+drop materialized view report_product;
+
+create materialized view report_product as
+select pu.productname,
+    coalesce(pa.participants, 0) as participants,
+    coalesce(pa.registrations, 0) as registrations,
+    pu.collected,
+    coalesce(r.refunded, cast(0 as money)) as refunded
+from (
+    select productname, sum(price) as collected
+    from purchase
+    where deleted_at is null
+    group by productname
+) pu
+left join (
+    select pu.productname, count(*)::integer as participants, sum(pu.qty)::integer as registrations
+    from participant pa
+    inner join purchase pu on pu.purchaseid = pa.purchaseid
+    where pa.cancelledat is null and pa.deleted_at is null and pu.deleted_at is null
+    group by pu.productname
+) pa on pa.productname = pu.productname
+left join (
+    select pu.productname, sum(r.amount) as refunded
+    from refund r
+    inner join purchase pu on pu.purchaseid = r.purchaseid
+    where r.deleted_at is null and pu.deleted_at is null
+    group by pu.productname
+) r on r.productname = pu.productname;
+
+create unique index report_product_idx on report_product (productname);
+
+create materialized view report_option as
+select oi.name, count(*)::integer as participants
+from participant_option po
+inner join option_item oi on oi.optionitemsid = po.optionitemsid
+inner join participant pa on pa.participantid = po.participantid
+where pa.cancelledat is null and pa.deleted_at is null and po.deleted_at is null
+group by oi.name;
+
+create unique index report_option_idx on report_option (name);
+
+create materialized view report_registration_detail as
+select s.salesorderid, c.name, c.phone, t.members, t.shirt, t1.club
+from customer c
+inner join salesorder s on s.customerid = c.customerid
+inner join (
+    select pu.salesorderid,
+        string_agg(p.name, '\n' order by p.name) as members,
+        string_agg(oi.name, '\n' order by p.name) as shirt
+    from participant p
+    inner join purchase pu on pu.purchaseid = p.purchaseid
+    inner join participant_option po on po.participantid = p.participantid
+    inner join option_item oi on oi.optionitemsid = po.optionitemsid
+    inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+    and co.name = 'T-Shirt'
+    where p.cancelledat is null and p.deleted_at is null and po.deleted_at is null
+    group by pu.salesorderid
+) t on t.salesorderid = s.salesorderid
+left join (
+    select pu.salesorderid,
+        string_agg(oi.name, '\n' order by p.name) as club
+    from participant p
+    inner join purchase pu on pu.purchaseid = p.purchaseid
+    inner join participant_option po on po.participantid = p.participantid
+    inner join option_item oi on oi.optionitemsid = po.optionitemsid
+    inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+    and co.name = 'Dexterity'
+    where p.cancelledat is null and p.deleted_at is null and po.deleted_at is null
+    group by pu.salesorderid
+) t1 on t1.salesorderid = s.salesorderid
+where c.deleted_at is null and s.deleted_at is null;
+
+create unique index report_registration_detail_idx on report_registration_detail (salesorderid);
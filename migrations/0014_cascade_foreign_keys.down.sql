@@ -0,0 +1,18 @@
+alter table shopping_cart drop constraint shopping_cart_shoppingorderid_fkey,
+    add constraint shopping_cart_shoppingorderid_fkey foreign key (shoppingorderid) references shopping_order;
+alter table cart_participant drop constraint cart_participant_shoppingcartid_fkey,
+    add constraint cart_participant_shoppingcartid_fkey foreign key (shoppingcartid) references shopping_cart;
+alter table cart_participant_option drop constraint cart_participant_option_cartparticipantid_fkey,
+    add constraint cart_participant_option_cartparticipantid_fkey foreign key (cartparticipantid) references cart_participant;
+alter table purchase drop constraint purchase_salesorderid_fkey,
+    add constraint purchase_salesorderid_fkey foreign key (salesorderid) references salesorder;
+alter table participant drop constraint participant_purchaseid_fkey,
+    add constraint participant_purchaseid_fkey foreign key (purchaseid) references purchase;
+alter table participant_option drop constraint participant_option_participantid_fkey,
+    add constraint participant_option_participantid_fkey foreign key (participantid) references participant;
+alter table participant_change drop constraint participant_change_participantid_fkey,
+    add constraint participant_change_participantid_fkey foreign key (participantid) references participant;
+alter table refund drop constraint refund_salesorderid_fkey,
+    add constraint refund_salesorderid_fkey foreign key (salesorderid) references salesorder;
+alter table refund drop constraint refund_purchaseid_fkey,
+    add constraint refund_purchaseid_fkey foreign key (purchaseid) references purchase;
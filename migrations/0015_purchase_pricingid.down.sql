@@ -0,0 +1 @@
+alter table purchase drop column pricingid;
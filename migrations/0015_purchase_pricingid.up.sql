@@ -0,0 +1,12 @@
+-- purchases keep the pricing they were sold at, capacity and cancellation
+-- find the event of a purchase through it instead of the product description
+alter table purchase add column pricingid uuid references pricing;
+
+update purchase pu set pricingid = (
+    select p.pricingid
+    from pricing p
+    inner join product pr on pr.productid = p.productid
+    where pr.description = pu.productname
+    order by p.pricingid
+    limit 1
+);
@@ -0,0 +1,2 @@
+alter table shopping_order drop column paymentstatus;
+alter table shopping_order drop column paymentid;
@@ -0,0 +1,4 @@
+-- a payment that fails or is canceled before checkout is recorded on the
+-- shopping order, there is no salesorder to hold it yet
+alter table shopping_order add column paymentid text;
+alter table shopping_order add column paymentstatus text;
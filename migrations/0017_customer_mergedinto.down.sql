@@ -0,0 +1 @@
+alter table customer drop column mergedinto;
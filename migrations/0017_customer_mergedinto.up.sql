@@ -0,0 +1,2 @@
+-- merge_customers soft deletes the duplicates and records who they became
+alter table customer add column mergedinto integer references customer;
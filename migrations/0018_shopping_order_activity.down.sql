@@ -0,0 +1,9 @@
+drop trigger cart_participant_option_touch on cart_participant_option;
+drop function cart_participant_option_touch();
+drop trigger cart_participant_touch on cart_participant;
+drop function cart_participant_touch();
+drop trigger shopping_cart_touch on shopping_cart;
+drop function shopping_cart_touch();
+drop trigger shopping_order_touch on shopping_order;
+drop function shopping_order_touch();
+alter table shopping_order drop column lastactivityat;
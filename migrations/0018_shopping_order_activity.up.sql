@@ -0,0 +1,53 @@
+-- lastactivityat is kept by the database, unlike orderdate which the client
+-- sends: any change to the order, its carts, participants or options moves
+-- it, and expire_carts sweeps the orders left idle
+alter table shopping_order add column lastactivityat timestamptz not null default now();
+
+-- an update setting lastactivityat itself keeps its value, as housekeeping does
+create function shopping_order_touch() returns trigger language plpgsql as $$
+begin
+    if new.lastactivityat is not distinct from old.lastactivityat then
+        new.lastactivityat = now();
+    end if;
+    return new;
+end
+$$;
+
+create trigger shopping_order_touch before update on shopping_order
+for each row execute function shopping_order_touch();
+
+create function shopping_cart_touch() returns trigger language plpgsql as $$
+begin
+    update shopping_order set lastactivityat = now()
+    where shoppingorderid = new.shoppingorderid;
+    return null;
+end
+$$;
+
+create trigger shopping_cart_touch after insert or update on shopping_cart
+for each row execute function shopping_cart_touch();
+
+create function cart_participant_touch() returns trigger language plpgsql as $$
+begin
+    update shopping_order so set lastactivityat = now()
+    from shopping_cart sc
+    where sc.shoppingcartid = new.shoppingcartid and so.shoppingorderid = sc.shoppingorderid;
+    return null;
+end
+$$;
+
+create trigger cart_participant_touch after insert or update on cart_participant
+for each row execute function cart_participant_touch();
+
+create function cart_participant_option_touch() returns trigger language plpgsql as $$
+begin
+    update shopping_order so set lastactivityat = now()
+    from cart_participant cp
+    inner join shopping_cart sc on sc.shoppingcartid = cp.shoppingcartid
+    where cp.cartparticipantid = new.cartparticipantid and so.shoppingorderid = sc.shoppingorderid;
+    return null;
+end
+$$;
+
+create trigger cart_participant_option_touch after insert or update on cart_participant_option
+for each row execute function cart_participant_option_touch();
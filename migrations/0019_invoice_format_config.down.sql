@@ -0,0 +1,3 @@
+alter table invoice_sequence add column prefix text not null default 'INV-';
+alter table invoice_sequence add column includeyear boolean not null default true;
+alter table invoice_sequence add column padding integer not null default 5;
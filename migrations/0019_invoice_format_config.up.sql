@@ -0,0 +1,5 @@
+-- the invoice number format comes from the configuration on every checkout,
+-- the sequence only keeps the counter and the year it counts in
+alter table invoice_sequence drop column prefix;
+alter table invoice_sequence drop column includeyear;
+alter table invoice_sequence drop column padding;
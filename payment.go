@@ -0,0 +1,416 @@
+package function
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// payment statuses stored on salesorder.paymentstatus, and on
+// shopping_order.paymentstatus before checkout
+const (
+	paymentPending   = "pending"
+	paymentSucceeded = "succeeded"
+	paymentFailed    = "failed"
+	paymentCanceled  = "canceled"
+)
+
+// paymentLockClass namespaces the advisory locks taken per shopping order
+// while a webhook checks it out, so a redelivered event waits for the first
+// delivery instead of checking out twice
+const paymentLockClass = 2
+
+// stripeSignatureTolerance is how old a signed Stripe webhook may be
+const stripeSignatureTolerance = 5 * time.Minute
+
+// paymentClient calls the providers' APIs, create_payment waits on it so it
+// must not hang on a provider that does not answer
+var paymentClient = &http.Client{Timeout: 15 * time.Second}
+
+var errBadSignature = errors.New("payment webhook: invalid signature")
+
+// paymentEvent is a provider's webhook event reduced to what checkout needs,
+// Amount is in cents of Currency and Metadata carries what createPayment
+// attached to the payment
+type paymentEvent struct {
+	EventID   string            `json:"eventid"`
+	Type      string            `json:"type"`
+	PaymentID string            `json:"paymentid"`
+	Status    string            `json:"status"`
+	Amount    int64             `json:"amount"`
+	Currency  string            `json:"currency"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// payment is a payment started with a provider, the client completes it with
+// ClientSecret and the provider's webhook reports the outcome
+type payment struct {
+	Provider     string `json:"provider"`
+	PaymentID    string `json:"paymentid"`
+	ClientSecret string `json:"clientsecret"`
+	Status       string `json:"status"`
+	Amount       int64  `json:"amount"`
+	Currency     string `json:"currency"`
+}
+
+// paymentProvider is implemented by every payment service the function can
+// take payments with
+type paymentProvider interface {
+	// createPayment starts a payment of the quote's total on behalf of md
+	createPayment(qu quote, md migrate_data) (payment, error)
+	// parseWebhook verifies the signature of a webhook delivery and parses it
+	parseWebhook(header http.Header, body []byte) (paymentEvent, error)
+}
+
+// paymentProviderFor returns the provider called name. The fake provider is
+// only available when allow_fake_payments is true.
+func paymentProviderFor(ctx context.Context, name string) (paymentProvider, error) {
+	switch strings.ToLower(name) {
+	case "stripe":
+		secretKey, err := getSecret(ctx, "payment/stripe", "secretkey")
+		if err != nil {
+			return nil, fmt.Errorf("stripe secretkey: %v", err)
+		}
+		webhookSecret, err := getSecret(ctx, "payment/stripe", "webhooksecret")
+		if err != nil {
+			return nil, fmt.Errorf("stripe webhooksecret: %v", err)
+		}
+		p := stripeProvider{
+			apiURL:        "https://api.stripe.com",
+			secretKey:     string(secretKey),
+			webhookSecret: string(webhookSecret),
+		}
+		if v := os.Getenv("stripe_api_url"); v != "" {
+			p.apiURL = strings.TrimSuffix(v, "/")
+		}
+		return p, nil
+	case "fake":
+		if os.Getenv("allow_fake_payments") != "true" {
+			return nil, errors.New("payment: fake provider is disabled")
+		}
+		return fakeProvider{secret: os.Getenv("fake_payment_secret")}, nil
+	}
+	return nil, fmt.Errorf("payment: unknown provider %v", name)
+}
+
+// stripeProvider talks to the Stripe API, or any API compatible with its
+// payment intents and webhook signatures
+type stripeProvider struct {
+	apiURL        string
+	secretKey     string
+	webhookSecret string
+}
+
+func (s stripeProvider) createPayment(qu quote, md migrate_data) (payment, error) {
+	p := payment{Provider: "stripe", Amount: qu.Total, Currency: qu.Currency}
+
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(qu.Total, 10))
+	form.Set("currency", qu.Currency)
+	form.Set("metadata[shoppingorderid]", strconv.Itoa(qu.ShoppingOrderID))
+	form.Set("metadata[name]", md.Name)
+	form.Set("metadata[email]", md.Email)
+	form.Set("metadata[phone]", md.Phone)
+
+	req, err := http.NewRequest(http.MethodPost, s.apiURL+"/v1/payment_intents", strings.NewReader(form.Encode()))
+	if err != nil {
+		return p, err
+	}
+	req.SetBasicAuth(s.secretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	// a retried request for the same order and amount returns the same intent
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("shopping_order-%v-%v", qu.ShoppingOrderID, qu.Total))
+
+	resp, err := paymentClient.Do(req)
+	if err != nil {
+		return p, fmt.Errorf("stripe: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return p, fmt.Errorf("stripe: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return p, fmt.Errorf("stripe: %v: %s", resp.Status, body)
+	}
+
+	var intent struct {
+		ID           string `json:"id"`
+		ClientSecret string `json:"client_secret"`
+		Status       string `json:"status"`
+	}
+	err = json.Unmarshal(body, &intent)
+	if err != nil {
+		return p, fmt.Errorf("stripe: %v", err)
+	}
+	p.PaymentID = intent.ID
+	p.ClientSecret = intent.ClientSecret
+	p.Status = intent.Status
+	return p, nil
+}
+
+// parseWebhook checks the Stripe-Signature header, t=<unix time>,v1=<hex
+// hmac-sha256 of "t.body">, and parses payment_intent events. Any other event,
+// such as charge.succeeded whose object is not the payment intent, comes back
+// without metadata so it is acknowledged and ignored.
+func (s stripeProvider) parseWebhook(header http.Header, body []byte) (paymentEvent, error) {
+	var ev paymentEvent
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ev, errBadSignature
+	}
+	if age := time.Since(time.Unix(t, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+		return ev, errors.New("payment webhook: signature timestamp outside tolerance")
+	}
+	valid := false
+	for _, sig := range signatures {
+		if validSignature(s.webhookSecret, []byte(timestamp+"."+string(body)), sig) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ev, errBadSignature
+	}
+
+	var se struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID       string            `json:"id"`
+				Amount   int64             `json:"amount"`
+				Currency string            `json:"currency"`
+				Status   string            `json:"status"`
+				Metadata map[string]string `json:"metadata"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &se)
+	if err != nil {
+		return ev, fmt.Errorf("payment webhook: %v", err)
+	}
+	ev = paymentEvent{EventID: se.ID, Type: se.Type}
+	// a failed intent goes back to requires_payment_method, report it as such
+	switch se.Type {
+	case "payment_intent.succeeded":
+		ev.Status = se.Data.Object.Status
+	case "payment_intent.payment_failed":
+		ev.Status = paymentFailed
+	case "payment_intent.canceled":
+		ev.Status = paymentCanceled
+	default:
+		return ev, nil
+	}
+	ev.PaymentID = se.Data.Object.ID
+	ev.Amount = se.Data.Object.Amount
+	ev.Currency = se.Data.Object.Currency
+	ev.Metadata = se.Data.Object.Metadata
+	return ev, nil
+}
+
+// fakeProvider stands in for a real provider in tests and local setups. Its
+// webhook body is a paymentEvent signed with X-Fake-Signature, the hex
+// hmac-sha256 of the body with fake_payment_secret.
+type fakeProvider struct {
+	secret string
+}
+
+func (f fakeProvider) createPayment(qu quote, md migrate_data) (payment, error) {
+	return payment{
+		Provider:     "fake",
+		PaymentID:    fmt.Sprintf("fake_%v_%v", qu.ShoppingOrderID, qu.Total),
+		ClientSecret: "fake",
+		Status:       "requires_payment_method",
+		Amount:       qu.Total,
+		Currency:     qu.Currency,
+	}, nil
+}
+
+func (f fakeProvider) parseWebhook(header http.Header, body []byte) (paymentEvent, error) {
+	var ev paymentEvent
+	if f.secret == "" || !validSignature(f.secret, body, header.Get("X-Fake-Signature")) {
+		return ev, errBadSignature
+	}
+	err := json.Unmarshal(body, &ev)
+	if err != nil {
+		return ev, fmt.Errorf("payment webhook: %v", err)
+	}
+	return ev, nil
+}
+
+// validSignature reports whether signature is the hex hmac-sha256 of payload
+func validSignature(secret string, payload []byte, signature string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// create_payment request, starts paying for the cart of SessionID with
+// Provider. Name, Email and Phone become the customer at checkout.
+type paymentRequest struct {
+	Provider  string `json:"provider"`
+	SessionID string `json:"sessionid"`
+	Name      string `json:"name"`
+	Email     string `json:"email"`
+	Phone     string `json:"phone"`
+}
+
+// create quotes the cart and starts a payment of its total, the shopping
+// order is marked pending so expire_carts leaves it to the webhook
+func (pr paymentRequest) create(ctx context.Context, db Querier) (payment, error) {
+	provider, err := paymentProviderFor(ctx, pr.Provider)
+	if err != nil {
+		return payment{}, err
+	}
+	qu, err := quoteFor(db, "sessionid", pr.SessionID)
+	if err != nil {
+		return payment{}, err
+	}
+	if !qu.Valid {
+		return payment{}, errors.New("create_payment: the cart's prices changed, please review the cart")
+	}
+	p, err := provider.createPayment(qu, migrate_data{
+		ShoppingOrderID: strconv.Itoa(qu.ShoppingOrderID),
+		Name:            pr.Name,
+		Email:           pr.Email,
+		Phone:           pr.Phone,
+	})
+	if err != nil {
+		return p, err
+	}
+	_, err = db.Exec(context.Background(),
+		"update shopping_order set paymentid = $1, paymentstatus = $2 where shoppingorderid = $3", p.PaymentID, paymentPending, qu.ShoppingOrderID)
+	if err != nil {
+		return p, fmt.Errorf("create_payment shopping_order: %v", err)
+	}
+	return p, nil
+}
+
+// paymentWebhook is the outcome of a webhook delivery
+type paymentWebhook struct {
+	EventID      string `json:"eventid"`
+	PaymentID    string `json:"paymentid"`
+	Status       string `json:"status"`
+	SalesOrderID string `json:"salesorderid,omitempty"`
+	CheckedOut   bool   `json:"checkedout"`
+}
+
+// processPaymentWebhook verifies a webhook delivery of providerName and
+// applies it. A succeeded payment of a shopping order checks it out, once:
+// redeliveries and later events only update the salesorder's payment status.
+// Other outcomes before checkout are recorded on the shopping order.
+// The paid amount has to match the order's quote.
+func processPaymentWebhook(ctx context.Context, db Querier, providerName string, header http.Header, body []byte) (paymentWebhook, error) {
+	var pw paymentWebhook
+
+	provider, err := paymentProviderFor(ctx, providerName)
+	if err != nil {
+		return pw, err
+	}
+	ev, err := provider.parseWebhook(header, body)
+	if err != nil {
+		return pw, err
+	}
+	pw.EventID = ev.EventID
+	pw.PaymentID = ev.PaymentID
+	pw.Status = ev.Status
+
+	soid := ev.Metadata["shoppingorderid"]
+	if soid == "" {
+		// not a checkout payment, nothing to do
+		return pw, nil
+	}
+	id, err := strconv.Atoi(soid)
+	if err != nil {
+		return pw, fmt.Errorf("payment webhook: shoppingorderid: %v", err)
+	}
+	pw.SalesOrderID = soid
+
+	_, err = db.Exec(context.Background(), "select pg_advisory_lock($1, $2)", paymentLockClass, id)
+	if err != nil {
+		return pw, fmt.Errorf("payment webhook lock: %v", err)
+	}
+	defer db.Exec(context.Background(), "select pg_advisory_unlock($1, $2)", paymentLockClass, id)
+
+	// salesorders take the id of the shopping order they were checked out from
+	tag, err := db.Exec(context.Background(),
+		"update salesorder set paymentstatus = $1 where salesorderid = $2 and paymentid = $3", ev.Status, id, ev.PaymentID)
+	if err != nil {
+		return pw, fmt.Errorf("payment webhook salesorder: %v", err)
+	}
+	if tag.RowsAffected() > 0 {
+		return pw, nil
+	}
+	if ev.Status != paymentSucceeded {
+		// not checked out yet, the shopping order keeps the outcome
+		_, err = db.Exec(context.Background(),
+			"update shopping_order set paymentid = $1, paymentstatus = $2 where shoppingorderid = $3", ev.PaymentID, ev.Status, id)
+		if err != nil {
+			return pw, fmt.Errorf("payment webhook shopping_order: %v", err)
+		}
+		return pw, nil
+	}
+
+	var exists bool
+	err = db.QueryRow(context.Background(), "select exists(select 1 from salesorder where salesorderid = $1)", id).Scan(&exists)
+	if err != nil {
+		return pw, fmt.Errorf("payment webhook salesorder: %v", err)
+	}
+	if exists {
+		return pw, fmt.Errorf("payment webhook: shopping_order %v was checked out with another payment", id)
+	}
+
+	qu, err := quoteFor(db, "shoppingorderid", soid)
+	if err != nil {
+		return pw, err
+	}
+	if qu.Total != ev.Amount || !strings.EqualFold(qu.Currency, ev.Currency) {
+		return pw, fmt.Errorf("payment webhook: paid %v %v but shopping_order %v costs %v %v",
+			ev.Amount, ev.Currency, id, qu.Total, qu.Currency)
+	}
+
+	err = migrateData(db, migrate_data{
+		ShoppingOrderID: soid,
+		PaymentID:       ev.PaymentID,
+		PaymentStatus:   ev.Status,
+		Name:            ev.Metadata["name"],
+		Email:           ev.Metadata["email"],
+		Phone:           ev.Metadata["phone"],
+	})
+	if err != nil {
+		return pw, err
+	}
+	pw.CheckedOut = true
+	return pw, nil
+}
@@ -0,0 +1,260 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// pricing_rule overrides the price of a pricing while it applies: inside its
+// validity window (early-bird until ValidUntil), for orders holding at least
+// MinQty of the pricing across their cart lines, and when CouponCode is set
+// only for that code until it was used MaxUses times
+type pricing_rule struct {
+	RuleID     int        `json:"ruleid"`
+	PricingID  string     `json:"pricingid"`
+	Name       string     `json:"name"`
+	Price      string     `json:"price"`
+	ValidFrom  *time.Time `json:"validfrom"`
+	ValidUntil *time.Time `json:"validuntil"`
+	MinQty     int        `json:"minqty"`
+	CouponCode *string    `json:"couponcode"`
+	MaxUses    *int       `json:"maxuses"`
+	Uses       int        `json:"uses"`
+	DeletedAt  *time.Time `json:"deletedat,omitempty"`
+}
+
+func (p pricing_rule) create(db Querier, table string, oc onConflict) (int, error) {
+	conflict, err := oc.clause()
+	if err != nil {
+		return 0, err
+	}
+	if p.MinQty < 1 {
+		p.MinQty = 1
+	}
+	exec := fmt.Sprintf(`insert into %v(pricingid, name, price, validfrom, validuntil, minqty, couponcode, maxuses, uses)
+	values($1, $2, $3, $4, $5, $6, $7, $8, 0)%v returning ruleid`, table, conflict)
+	return insertReturning(db, oc, exec, p.PricingID, p.Name, p.Price, p.ValidFrom, p.ValidUntil, p.MinQty, p.CouponCode, p.MaxUses)
+}
+
+// scan reads a pricing_rule from a row of select *, as readall answers it
+func (p *pricing_rule) scan(rows pgx.Rows) error {
+	return rows.Scan(&p.RuleID, &p.PricingID, &p.Name, &p.Price, &p.ValidFrom, &p.ValidUntil, &p.MinQty, &p.CouponCode, &p.MaxUses, &p.Uses, &p.DeletedAt)
+}
+
+func (p *pricing_rule) readall(db Querier, table string, includeDeleted bool) ([]pricing_rule, error) {
+	var pr pricing_rule
+	var pl []pricing_rule
+	query := fmt.Sprintf("select * from %v where %v", table, deletedFilter(includeDeleted))
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := pr.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		pl = append(pl, pr)
+	}
+	return pl, nil
+}
+
+func (p *pricing_rule) read(db Querier, table, field, value string, includeDeleted bool) ([]pricing_rule, error) {
+	var pr pricing_rule
+	var pl []pricing_rule
+	query := fmt.Sprintf("select * from %v where %v=$1 and %v", table, sanitizeColumn(field), deletedFilter(includeDeleted))
+	rows, err := db.Query(context.Background(), query, value)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := pr.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		pl = append(pl, pr)
+	}
+	return pl, nil
+}
+
+// appliedPrice is the price of a cart line and the rule that set it, RuleID
+// is nil when the base pricing price applies. Cents is Price in cents.
+type appliedPrice struct {
+	Price  string
+	Cents  int64
+	RuleID *int
+}
+
+// priceFor computes the price of pricingID for an order holding qty of it,
+// placed at. The cheapest applicable pricing_rule wins over the base price.
+func priceFor(q Querier, pricingID string, qty int, couponCode *string, at time.Time) (appliedPrice, error) {
+	var ap appliedPrice
+	exec := fmt.Sprintf(`
+	select coalesce(r.price, p.price), (coalesce(r.price, p.price)::numeric * 100)::bigint, r.ruleid
+	from pricing p
+	left join lateral (
+			select ruleid, price
+			from pricing_rule r
+			where r.pricingid = p.pricingid
+			and r.deleted_at is null
+			and (r.validfrom is null or r.validfrom <= $2)
+			and (r.validuntil is null or r.validuntil > $2)
+			and r.minqty <= $3
+			and (r.couponcode is null or lower(r.couponcode) = lower($4))
+			and (r.maxuses is null or r.uses < r.maxuses)
+			order by r.price, r.ruleid
+			limit 1
+	) r on true
+	where p.pricingid = $1 and p.deleted_at is null`)
+	err := q.QueryRow(context.Background(), exec, pricingID, at, qty, couponCode).Scan(&ap.Price, &ap.Cents, &ap.RuleID)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return ap, fmt.Errorf("pricing %v not found", pricingID)
+	case err != nil:
+		return ap, fmt.Errorf("priceFor: %v", err)
+	}
+	return ap, nil
+}
+
+// orderQty is how many of pricingID the shopping order holds, the quantity
+// its tiers are priced by
+func orderQty(q Querier, shoppingorderid, pricingID string) (int, error) {
+	var qty int
+	err := q.QueryRow(context.Background(),
+		"select coalesce(sum(qty), 0) from shopping_cart where shoppingorderid::text = $1 and pricingid::text = $2",
+		shoppingorderid, pricingID,
+	).Scan(&qty)
+	if err != nil {
+		return 0, fmt.Errorf("orderQty: %v", err)
+	}
+	return qty, nil
+}
+
+// repriceLines prices the other lines of pricingID in the shopping order
+// again for its new quantity qty, so a quantity tier reached by adding a line
+// applies to every line of the pricing
+func repriceLines(q Querier, shoppingorderid, pricingID string, qty int, except int) error {
+	type cartLine struct {
+		shoppingcartid int
+		couponcode     *string
+	}
+
+	exec := fmt.Sprintf(`
+	select shoppingcartid, couponcode
+	from shopping_cart
+	where shoppingorderid::text = $1 and pricingid::text = $2
+	and price is not null and shoppingcartid <> $3`)
+	rows, err := q.Query(context.Background(), exec, shoppingorderid, pricingID, except)
+	if err != nil {
+		return fmt.Errorf("repriceLines query err: %v", err)
+	}
+	var lines []cartLine
+	for rows.Next() {
+		var l cartLine
+		err := rows.Scan(&l.shoppingcartid, &l.couponcode)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("repriceLines scan err: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	rows.Close()
+
+	for _, l := range lines {
+		ap, err := priceFor(q, pricingID, qty, l.couponcode, time.Now())
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(context.Background(),
+			"update shopping_cart set price = $1, pricingruleid = $2 where shoppingcartid = $3", ap.Price, ap.RuleID, l.shoppingcartid)
+		if err != nil {
+			return fmt.Errorf("repriceLines: %v", err)
+		}
+	}
+	return nil
+}
+
+// checkPrice prices a cart line again as of now for the order's quantity of
+// its pricing. The line still holds when it comes to the price and the rule
+// it was added with, checkout refuses it otherwise.
+func checkPrice(q Querier, pricingID string, qty int, couponCode *string, cents int64, ruleID *int) (appliedPrice, bool, error) {
+	ap, err := priceFor(q, pricingID, qty, couponCode, time.Now())
+	if err != nil {
+		return ap, false, err
+	}
+	return ap, ap.Cents == cents && sameRule(ap.RuleID, ruleID), nil
+}
+
+// revalidateCart recomputes the price of every priced line of the shopping
+// order at checkout, on the server's clock, and claims a use of each rule
+// applied. A line whose price or rule changed, such as an early-bird that
+// ended or a coupon used up since it was added, fails the checkout. Lines
+// added before pricing rules have no price and are charged the base price.
+func revalidateCart(tx pgx.Tx, shoppingorderid string) error {
+	type cartLine struct {
+		shoppingcartid int
+		pricingid      string
+		orderqty       int
+		couponcode     *string
+		ruleid         *int
+		cents          int64
+	}
+
+	exec := fmt.Sprintf(`
+	select shoppingcartid, pricingid, orderqty, couponcode, pricingruleid, cents
+	from (
+			select sc.shoppingcartid, sc.pricingid, sum(sc.qty) over (partition by sc.pricingid)::integer as orderqty,
+			sc.couponcode, sc.pricingruleid, (sc.price::numeric * 100)::bigint as cents, sc.price is not null as priced
+			from shopping_cart sc
+			where sc.shoppingorderid = $1
+	) l
+	where l.priced`)
+	rows, err := tx.Query(context.Background(), exec, shoppingorderid)
+	if err != nil {
+		return fmt.Errorf("revalidateCart query err: %v", err)
+	}
+	var lines []cartLine
+	for rows.Next() {
+		var l cartLine
+		err := rows.Scan(&l.shoppingcartid, &l.pricingid, &l.orderqty, &l.couponcode, &l.ruleid, &l.cents)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("revalidateCart scan err: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	rows.Close()
+
+	for _, l := range lines {
+		ap, ok, err := checkPrice(tx, l.pricingid, l.orderqty, l.couponcode, l.cents, l.ruleid)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("shopping_cart %v: the price changed since it was added, please review the cart", l.shoppingcartid)
+		}
+		if ap.RuleID == nil {
+			continue
+		}
+		tag, err := tx.Exec(context.Background(),
+			"update pricing_rule set uses = uses + 1 where ruleid = $1 and (maxuses is null or uses < maxuses)", *ap.RuleID)
+		if err != nil {
+			return fmt.Errorf("pricing_rule uses: %v", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("shopping_cart %v: discount is no longer available", l.shoppingcartid)
+		}
+	}
+	return nil
+}
+
+func sameRule(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
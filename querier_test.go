@@ -0,0 +1,235 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// fakeCall is one statement run against a fakeQuerier, SQL has its
+// whitespace collapsed so tests can compare it on one line
+type fakeCall struct {
+	SQL  string
+	Args []interface{}
+}
+
+// fakeResult answers the first statement containing match that has not been
+// answered yet
+type fakeResult struct {
+	match  string
+	fields []string
+	rows   [][]interface{}
+	tag    string
+	err    error
+}
+
+// fakeQuerier is a Querier that records every statement and answers them
+// from scripted results instead of a database. A statement with no result
+// returns no rows, which QueryRow reports as pgx.ErrNoRows.
+type fakeQuerier struct {
+	calls   []fakeCall
+	results []*fakeResult
+}
+
+var _ Querier = (*fakeQuerier)(nil)
+
+// returns scripts the rows of the next statement containing match
+func (f *fakeQuerier) returns(match string, rows ...[]interface{}) {
+	f.results = append(f.results, &fakeResult{match: match, rows: rows})
+}
+
+// fails scripts an error for the next statement containing match
+func (f *fakeQuerier) fails(match string, err error) {
+	f.results = append(f.results, &fakeResult{match: match, err: err})
+}
+
+func (f *fakeQuerier) record(sql string, args []interface{}) *fakeResult {
+	sql = strings.Join(strings.Fields(sql), " ")
+	f.calls = append(f.calls, fakeCall{SQL: sql, Args: args})
+	for i, r := range f.results {
+		if strings.Contains(sql, r.match) {
+			f.results = append(f.results[:i], f.results[i+1:]...)
+			return r
+		}
+	}
+	return &fakeResult{}
+}
+
+func (f *fakeQuerier) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	r := f.record(sql, args)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &fakeRows{fields: r.fields, rows: r.rows, i: -1}, nil
+}
+
+func (f *fakeQuerier) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	r := f.record(sql, args)
+	return fakeRow{rows: &fakeRows{rows: r.rows, i: -1}, err: r.err}
+}
+
+func (f *fakeQuerier) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	r := f.record(sql, args)
+	return pgconn.CommandTag(r.tag), r.err
+}
+
+func (f *fakeQuerier) Begin(ctx context.Context) (pgx.Tx, error) {
+	f.record("begin", nil)
+	return &fakeTx{fakeQuerier: f}, nil
+}
+
+// sql lists the statements run so far
+func (f *fakeQuerier) sql() []string {
+	var sl []string
+	for _, c := range f.calls {
+		sl = append(sl, c.SQL)
+	}
+	return sl
+}
+
+// find returns the first call containing match, failing the test without one
+func (f *fakeQuerier) find(t *testing.T, match string) fakeCall {
+	t.Helper()
+	for _, c := range f.calls {
+		if strings.Contains(c.SQL, match) {
+			return c
+		}
+	}
+	t.Fatalf("no statement contains %q, ran:\n%v", match, strings.Join(f.sql(), "\n"))
+	return fakeCall{}
+}
+
+// fakeTx records its statements, commit and rollback on the fakeQuerier that
+// began it. The embedded pgx.Tx is nil, the methods the function does not use
+// panic.
+type fakeTx struct {
+	pgx.Tx
+	*fakeQuerier
+	done bool
+}
+
+func (tx *fakeTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return tx.fakeQuerier.Query(ctx, sql, args...)
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return tx.fakeQuerier.QueryRow(ctx, sql, args...)
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return tx.fakeQuerier.Exec(ctx, sql, args...)
+}
+
+func (tx *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return tx.fakeQuerier.Begin(ctx)
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	tx.record("commit", nil)
+	return nil
+}
+
+// Rollback after Commit is a no-op like it is on a real transaction, so the
+// deferred rollbacks do not show up in the calls
+func (tx *fakeTx) Rollback(ctx context.Context) error {
+	if tx.done {
+		return pgx.ErrTxClosed
+	}
+	tx.done = true
+	tx.record("rollback", nil)
+	return nil
+}
+
+type fakeRows struct {
+	pgx.Rows
+	fields []string
+	rows   [][]interface{}
+	i      int
+}
+
+func (r *fakeRows) Next() bool {
+	r.i++
+	return r.i < len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...interface{}) error {
+	if r.i < 0 || r.i >= len(r.rows) {
+		return pgx.ErrNoRows
+	}
+	return scanValues(r.rows[r.i], dest)
+}
+
+func (r *fakeRows) Values() ([]interface{}, error) { return r.rows[r.i], nil }
+func (r *fakeRows) Err() error                     { return nil }
+func (r *fakeRows) Close()                         { r.i = len(r.rows) }
+
+func (r *fakeRows) FieldDescriptions() []pgproto3.FieldDescription {
+	var fd []pgproto3.FieldDescription
+	for _, f := range r.fields {
+		fd = append(fd, pgproto3.FieldDescription{Name: []byte(f)})
+	}
+	return fd
+}
+
+func (r *fakeRows) CommandTag() pgconn.CommandTag {
+	return pgconn.CommandTag(fmt.Sprintf("SELECT %d", len(r.rows)))
+}
+
+type fakeRow struct {
+	rows *fakeRows
+	err  error
+}
+
+func (r fakeRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	if !r.rows.Next() {
+		return pgx.ErrNoRows
+	}
+	return r.rows.Scan(dest...)
+}
+
+// scanValues assigns row to dest by reflection, converting between
+// convertible types and allocating pointer destinations. A nil value leaves
+// the zero value.
+func scanValues(row []interface{}, dest []interface{}) error {
+	if len(row) != len(dest) {
+		return fmt.Errorf("fake scan: %d values into %d destinations", len(row), len(dest))
+	}
+	for i, v := range row {
+		d := reflect.ValueOf(dest[i])
+		if d.Kind() != reflect.Ptr || d.IsNil() {
+			return fmt.Errorf("fake scan: destination %d is not a pointer", i)
+		}
+		d = d.Elem()
+		if v == nil {
+			d.Set(reflect.Zero(d.Type()))
+			continue
+		}
+		if d.Kind() == reflect.Ptr {
+			d.Set(reflect.New(d.Type().Elem()))
+			d = d.Elem()
+		}
+		rv := reflect.ValueOf(v)
+		switch {
+		case rv.Type().AssignableTo(d.Type()):
+			d.Set(rv)
+		case rv.Type().ConvertibleTo(d.Type()) && rv.Kind() != reflect.String && d.Kind() != reflect.String:
+			d.Set(rv.Convert(d.Type()))
+		default:
+			return fmt.Errorf("fake scan: cannot scan %T into %v", v, d.Type())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultCurrency is used when currency is not set
+const defaultCurrency = "usd"
+
+// quoteLine is a cart line priced the way migrateData will charge it, amounts
+// are in cents. Valid is false when the line's price or discount no longer
+// applies and checkout would refuse it.
+type quoteLine struct {
+	ShoppingCartID int    `json:"shoppingcartid"`
+	PricingID      string `json:"pricingid"`
+	ProductName    string `json:"productname"`
+	Qty            int    `json:"qty"`
+	BasePrice      int64  `json:"baseprice"`
+	Discount       int64  `json:"discount"`
+	Price          int64  `json:"price"`
+	PricingRuleID  *int   `json:"pricingruleid,omitempty"`
+	Valid          bool   `json:"valid"`
+}
+
+// quote is the cost of a shopping order, amounts are in cents of Currency so
+// Total can be handed to the payment provider as is
+type quote struct {
+	SessionID       string      `json:"sessionid"`
+	ShoppingOrderID int         `json:"shoppingorderid"`
+	Lines           []quoteLine `json:"lines"`
+	Subtotal        int64       `json:"subtotal"`
+	Discounts       int64       `json:"discounts"`
+	Taxes           int64       `json:"taxes"`
+	Total           int64       `json:"total"`
+	Currency        string      `json:"currency"`
+	Valid           bool        `json:"valid"`
+}
+
+// quoteFor prices the shopping order whose sessionid or shoppingorderid is
+// value. migrateData calls it inside the checkout transaction, so a quote is
+// exactly what checkout charges: each line at its cart price and tax_rate
+// applied to the discounted subtotal.
+func quoteFor(q Querier, field, value string) (quote, error) {
+	qu := quote{Currency: defaultCurrency, Valid: true}
+	if v := os.Getenv("currency"); v != "" {
+		qu.Currency = strings.ToLower(v)
+	}
+	taxRate := 0.0
+	if v := os.Getenv("tax_rate"); v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return qu, fmt.Errorf("tax_rate: %v", err)
+		}
+		taxRate = r
+	}
+
+	switch strings.ToLower(field) {
+	case "sessionid", "shoppingorderid":
+	default:
+		return qu, fmt.Errorf("quote: cannot quote by %v", field)
+	}
+
+	type cartLine struct {
+		quoteLine
+		couponcode *string
+		orderqty   int
+		priced     bool
+	}
+
+	exec := fmt.Sprintf(`
+	select so.sessionid, so.shoppingorderid, sum(sc.qty) over (partition by sc.pricingid)::integer,
+	sc.shoppingcartid, sc.pricingid, pr.description, sc.qty,
+	(p.price::numeric * 100)::bigint,
+	(coalesce(sc.price, p.price)::numeric * 100)::bigint,
+	sc.pricingruleid, sc.couponcode, sc.price is not null
+	from shopping_order so
+	inner join shopping_cart sc on sc.shoppingorderid = so.shoppingorderid
+	inner join pricing p on p.pricingid = sc.pricingid
+	inner join product pr on pr.productid = p.productid
+	where so.%v::text = $1
+	order by sc.shoppingcartid`, strings.ToLower(field))
+	rows, err := q.Query(context.Background(), exec, value)
+	if err != nil {
+		return qu, fmt.Errorf("quote query err: %v", err)
+	}
+	var lines []cartLine
+	for rows.Next() {
+		var l cartLine
+		err := rows.Scan(&qu.SessionID, &qu.ShoppingOrderID, &l.orderqty,
+			&l.ShoppingCartID, &l.PricingID, &l.ProductName, &l.Qty,
+			&l.BasePrice, &l.Price, &l.PricingRuleID, &l.couponcode, &l.priced)
+		if err != nil {
+			rows.Close()
+			return qu, fmt.Errorf("quote scan err: %v", err)
+		}
+		lines = append(lines, l)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return qu, fmt.Errorf("quote: %v", rows.Err())
+	}
+	if len(lines) == 0 {
+		return qu, fmt.Errorf("quote: no cart for %v %v", field, value)
+	}
+
+	for _, l := range lines {
+		l.Valid = true
+		if l.priced {
+			_, l.Valid, err = checkPrice(q, l.PricingID, l.orderqty, l.couponcode, l.Price, l.PricingRuleID)
+			if err != nil {
+				return qu, err
+			}
+		}
+		l.Discount = l.BasePrice - l.Price
+		qu.Subtotal += l.BasePrice
+		qu.Discounts += l.Discount
+		qu.Valid = qu.Valid && l.Valid
+		qu.Lines = append(qu.Lines, l.quoteLine)
+	}
+	qu.Taxes = int64(math.Round(float64(qu.Subtotal-qu.Discounts) * taxRate))
+	qu.Total = qu.Subtotal - qu.Discounts + qu.Taxes
+	return qu, nil
+}
+
+// centsToMoney formats cents for a money column
+func centsToMoney(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%v%d.%02d", sign, cents/100, cents%100)
+}
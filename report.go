@@ -0,0 +1,95 @@
+package function
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// reportViews are the materialized views the reports read, see migration
+// 0012_report_views
+var reportViews = []string{"report_product", "report_option", "report_registration_detail"}
+
+// reportFreshness says how stale a report is, the time its view was last
+// refreshed and the seconds since then when the report was read
+type reportFreshness struct {
+	RefreshedAt time.Time `json:"refreshedat"`
+	AgeSeconds  float64   `json:"ageseconds"`
+}
+
+func readFreshness(db Querier, view string) (reportFreshness, error) {
+	var rf reportFreshness
+	err := db.QueryRow(context.Background(),
+		"select refreshedat, extract(epoch from now() - refreshedat)::float8 from report_refresh where name = $1", view,
+	).Scan(&rf.RefreshedAt, &rf.AgeSeconds)
+	if err != nil {
+		return rf, fmt.Errorf("report_refresh %v: %v", view, err)
+	}
+	return rf, nil
+}
+
+type reportRefresh struct {
+	Name        string    `json:"name"`
+	RefreshedAt time.Time `json:"refreshedat"`
+}
+
+// refreshReports refreshes every report view concurrently, so the reports
+// keep reading the previous data meanwhile. Each view is refreshed in its own
+// transaction with report_refresh, which records the time it started, at
+// most as late as the data the refresh saw.
+func refreshReports(db Querier) ([]reportRefresh, error) {
+	var rl []reportRefresh
+	for _, view := range reportViews {
+		r, err := refreshReport(db, view)
+		if err != nil {
+			return rl, err
+		}
+		rl = append(rl, r)
+	}
+	return rl, nil
+}
+
+func refreshReport(db Querier, view string) (reportRefresh, error) {
+	r := reportRefresh{Name: view}
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return r, err
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(context.Background(), fmt.Sprintf("refresh materialized view concurrently %v", view))
+	if err != nil {
+		return r, fmt.Errorf("refresh %v: %v", view, err)
+	}
+	exec := fmt.Sprintf(`
+	insert into report_refresh(name, refreshedat) values ($1, now())
+	on conflict (name) do update set refreshedat = excluded.refreshedat
+	returning refreshedat`)
+	err = tx.QueryRow(context.Background(), exec, view).Scan(&r.RefreshedAt)
+	if err != nil {
+		return r, fmt.Errorf("report_refresh %v: %v", view, err)
+	}
+	return r, tx.Commit(context.Background())
+}
+
+// unreportedTables are not read by the report views, deleting their rows
+// leaves the reports as they are
+var unreportedTables = map[string]bool{
+	"shopping_order":          true,
+	"shopping_cart":           true,
+	"cart_participant":        true,
+	"cart_participant_option": true,
+	"waitlist":                true,
+	"participant_change":      true,
+}
+
+// refreshReportsAfter refreshes the reports once action has changed the
+// purchases, participants or refunds, or the rows they report on. The change
+// is committed by then, so a failed refresh is only logged and the reports
+// catch up on the next one.
+func refreshReportsAfter(db Querier, action string) {
+	_, err := refreshReports(db)
+	if err != nil {
+		logger.Warn().Str("action", action).Str("error", redact(err.Error())).Msg("refresh reports")
+	}
+}
@@ -0,0 +1,71 @@
+package function
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRefreshReports(t *testing.T) {
+	db := &fakeQuerier{}
+	at := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for range reportViews {
+		db.returns("insert into report_refresh", []interface{}{at})
+	}
+
+	rr, err := refreshReports(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rr) != len(reportViews) {
+		t.Fatalf("refreshed %+v", rr)
+	}
+	var want []string
+	for i, view := range reportViews {
+		if rr[i].Name != view || !rr[i].RefreshedAt.Equal(at) {
+			t.Errorf("refresh %v = %+v", i, rr[i])
+		}
+		want = append(want, "begin", "refresh materialized view concurrently "+view, "insert into report_refresh", "commit")
+	}
+	sl := db.sql()
+	if len(sl) != len(want) {
+		t.Fatalf("ran:\n%v", strings.Join(sl, "\n"))
+	}
+	for i, w := range want {
+		if !strings.HasPrefix(sl[i], w) {
+			t.Errorf("statement %v = %q, want %q", i, sl[i], w)
+		}
+	}
+}
+
+func TestRefreshReportsStopsOnError(t *testing.T) {
+	db := &fakeQuerier{}
+	db.fails("refresh materialized view concurrently report_product", errors.New("no unique index"))
+
+	_, err := refreshReports(db)
+	if err == nil || !strings.Contains(err.Error(), "refresh report_product") {
+		t.Fatalf("refreshReports = %v", err)
+	}
+	if got := db.sql(); got[len(got)-1] != "rollback" || strings.Contains(strings.Join(got, "\n"), "report_option") {
+		t.Errorf("ran:\n%v", strings.Join(got, "\n"))
+	}
+}
+
+func TestShirtSummaryReadsView(t *testing.T) {
+	db := &fakeQuerier{}
+	db.returns("from report_option", []interface{}{1, 2, 0, 0, 3})
+	db.returns("from report_refresh", []interface{}{time.Now(), 4.5})
+
+	var ss shirtSummary
+	err := ss.getShirtSummary(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss.Small != 1 || ss.XXLarge != 3 || ss.ReportFreshness.AgeSeconds != 4.5 {
+		t.Errorf("shirt_summary = %+v", ss)
+	}
+	if c := db.find(t, "from report_refresh"); len(c.Args) != 1 || c.Args[0] != "report_option" {
+		t.Errorf("freshness read with %v", c.Args)
+	}
+}
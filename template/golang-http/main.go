@@ -24,10 +24,21 @@ var (
 
 const defaultTimeout = 10 * time.Second
 
+// defaultAdminPort serves /metrics and /_/ready apart from the function port
+// the gateway routes to, so neither is reachable without the api key checks
+const defaultAdminPort = 8083
+
+// readyTimeout bounds the checks of /_/ready
+const readyTimeout = 2 * time.Second
+
 func main() {
 	readTimeout := parseIntOrDurationValue(os.Getenv("read_timeout"), defaultTimeout)
 	writeTimeout := parseIntOrDurationValue(os.Getenv("write_timeout"), defaultTimeout)
 	healthInterval := parseIntOrDurationValue(os.Getenv("healthcheck_interval"), writeTimeout)
+	adminPort := defaultAdminPort
+	if p, err := strconv.Atoi(os.Getenv("admin_port")); err == nil && p > 0 {
+		adminPort = p
+	}
 
 	s := &http.Server{
 		Addr:           fmt.Sprintf(":%d", 8082),
@@ -36,11 +47,25 @@ func main() {
 		MaxHeaderBytes: 1 << 20, // Max header of 1MB
 	}
 
+	http.HandleFunc("/_/health", healthHandler)
 	http.HandleFunc("/", makeRequestHandler())
-	listenUntilShutdown(s, healthInterval, writeTimeout)
+
+	admin := http.NewServeMux()
+	admin.Handle("/metrics", function.MetricsHandler())
+	admin.HandleFunc("/_/health", healthHandler)
+	admin.HandleFunc("/_/ready", readyHandler)
+	a := &http.Server{
+		Addr:           fmt.Sprintf(":%d", adminPort),
+		Handler:        admin,
+		ReadTimeout:    readTimeout,
+		WriteTimeout:   writeTimeout,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	listenUntilShutdown(s, a, healthInterval, writeTimeout)
 }
 
-func listenUntilShutdown(s *http.Server, shutdownTimeout time.Duration, writeTimeout time.Duration) {
+func listenUntilShutdown(s *http.Server, admin *http.Server, shutdownTimeout time.Duration, writeTimeout time.Duration) {
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sig := make(chan os.Signal, 1)
@@ -48,6 +73,10 @@ func listenUntilShutdown(s *http.Server, shutdownTimeout time.Duration, writeTim
 
 		<-sig
 
+		// stop reporting ready so no new requests are routed here while the
+		// in-flight ones drain
+		atomic.StoreInt32(&acceptingConnections, 0)
+
 		log.Printf("[entrypoint] SIGTERM: no connections in: %s", shutdownTimeout.String())
 		<-time.Tick(shutdownTimeout)
 
@@ -57,6 +86,12 @@ func listenUntilShutdown(s *http.Server, shutdownTimeout time.Duration, writeTim
 		if err := s.Shutdown(ctx); err != nil {
 			log.Printf("[entrypoint] Error in Shutdown: %v", err)
 		}
+		if err := admin.Shutdown(ctx); err != nil {
+			log.Printf("[entrypoint] Error in admin Shutdown: %v", err)
+		}
+		if err := function.Shutdown(ctx); err != nil {
+			log.Printf("[entrypoint] Error in function Shutdown: %v", err)
+		}
 
 		log.Printf("[entrypoint] Exiting.")
 
@@ -70,6 +105,11 @@ func listenUntilShutdown(s *http.Server, shutdownTimeout time.Duration, writeTim
 			close(idleConnsClosed)
 		}
 	}()
+	go func() {
+		if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("[entrypoint] Error admin ListenAndServe: %v", err)
+		}
+	}()
 
 	atomic.StoreInt32(&acceptingConnections, 1)
 
@@ -100,27 +140,37 @@ func makeRequestHandler() func(http.ResponseWriter, *http.Request) {
 		}
 		req.WithContext(r.Context())
 
-		result, resultErr := function.Handle(req)
+		// exports are streamed to w, everything else is written once handled
+		function.Serve(w, req)
+	}
+}
 
-		if result.Header != nil {
-			for k, v := range result.Header {
-				w.Header()[k] = v
-			}
-		}
+// healthHandler reports the process is alive
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
 
-		if resultErr != nil {
-			log.Print(resultErr)
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			if result.StatusCode == 0 {
-				w.WriteHeader(http.StatusOK)
-			} else {
-				w.WriteHeader(result.StatusCode)
-			}
-		}
+// readyHandler reports whether requests can be served: not while draining
+// after SIGTERM, nor while the secrets or the database are unreachable. Why
+// is only logged, connect errors name the database host and user.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&acceptingConnections) == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not accepting connections"))
+		return
+	}
 
-		w.Write(result.Body)
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+	if err := function.Ready(ctx); err != nil {
+		log.Printf("[entrypoint] not ready: %v", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready"))
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
 }
 
 func parseIntOrDurationValue(val string, fallback time.Duration) time.Duration {
@@ -0,0 +1,108 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of Handle, the secret fetches, connecting and every
+// sql statement. Until tracing_exporter is set the global provider is the
+// no-op one and the spans are not recorded.
+var tracer = otel.Tracer("handler/function")
+
+// tracerProvider is the provider set up from the env, nil when tracing is off
+var tracerProvider *sdktrace.TracerProvider
+
+// tracing_exporter=otlp exports the spans over OTLP/HTTP. otlp_endpoint is
+// the collector's host:port and otlp_insecure=true sends them without tls,
+// the standard OTEL_EXPORTER_OTLP_* variables apply otherwise. Spans join the
+// trace of the W3C traceparent header of the request.
+func init() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tp, err := newTracerProvider(os.Getenv("tracing_exporter"))
+	if err != nil {
+		logger.Error().Str("error", err.Error()).Msg("tracing")
+		return
+	}
+	if tp != nil {
+		tracerProvider = tp
+		otel.SetTracerProvider(tp)
+	}
+}
+
+func newTracerProvider(exporter string) (*sdktrace.TracerProvider, error) {
+	switch strings.ToLower(strings.TrimSpace(exporter)) {
+	case "", "none":
+		return nil, nil
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if v := os.Getenv("otlp_endpoint"); v != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(v))
+		}
+		if os.Getenv("otlp_insecure") == "true" {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exp, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("tracing otlp: %v", err)
+		}
+		service := os.Getenv("tracing_service_name")
+		if service == "" {
+			service = "db"
+		}
+		return sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exp),
+			sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+		), nil
+	}
+	return nil, fmt.Errorf("tracing_exporter: unknown exporter %v", exporter)
+}
+
+// Shutdown closes the database pool and exports the spans still buffered, the
+// template server calls it before exiting once the requests have drained
+func Shutdown(ctx context.Context) error {
+	closePool()
+	if tracerProvider == nil {
+		return nil
+	}
+	return tracerProvider.Shutdown(ctx)
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		msg := redact(err.Error())
+		span.RecordError(errors.New(msg))
+		span.SetStatus(codes.Error, msg)
+	}
+	span.End()
+}
+
+var statementTable = regexp.MustCompile(`(?i)\b(?:from|into|update|join)\s+([a-z_][a-z0-9_]*)`)
+
+// statementName names a statement by its operation and first table, such as
+// "insert shopping_cart", spans carry it instead of the sql and its values
+func statementName(sql string) (operation, table string) {
+	f := strings.Fields(sql)
+	if len(f) == 0 {
+		return "", ""
+	}
+	operation = strings.ToLower(f[0])
+	if m := statementTable.FindStringSubmatch(sql); m != nil {
+		table = strings.ToLower(m[1])
+	}
+	return operation, table
+}
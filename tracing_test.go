@@ -0,0 +1,110 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	handler "github.com/openfaas/templates-sdk/go-http"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// spanRecorder collects the spans of every test, TestMain installs it
+var spanRecorder = tracetest.NewSpanRecorder()
+
+// spansOf returns the ended spans of traceID by name
+func spansOf(traceID string) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spanRecorder.Ended() {
+		if s.SpanContext().TraceID().String() == traceID {
+			spans[s.Name()] = s
+		}
+	}
+	return spans
+}
+
+func TestStatementName(t *testing.T) {
+	for sql, want := range map[string]string{
+		"insert into cart_participant(shoppingcartid, name) values ($1, $2)": "insert cart_participant",
+		"\n\tselect * from customer where email=$1":                          "select customer",
+		"update salesorder set customerid = $1":                              "update salesorder",
+		"delete from customer where customerid = any($1)":                    "delete customer",
+		"select pg_advisory_lock($1, $2)":                                    "select",
+	} {
+		operation, table := statementName(sql)
+		if got := strings.TrimSpace(operation + " " + table); got != want {
+			t.Errorf("statementName(%q) = %v, want %v", sql, got, want)
+		}
+	}
+}
+
+func TestHandleSpans(t *testing.T) {
+	captureLogs(t, "error")
+	withoutDatabase(t, errors.New("refused"))
+
+	traceID, parentID := "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	req := handler.Request{Body: []byte(`{"action":"read","table":"customer"}`), Header: http.Header{}}
+	req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+	Handle(req)
+
+	spans := spansOf(traceID)
+	h, ok := spans["Handle"]
+	if !ok {
+		t.Fatalf("no Handle span in the gateway's trace, got %v", spans)
+	}
+	if h.Parent().SpanID().String() != parentID {
+		t.Errorf("Handle's parent is %v, want %v", h.Parent().SpanID(), parentID)
+	}
+	c, ok := spans["connect"]
+	if !ok {
+		t.Fatal("no connect span")
+	}
+	if c.Parent().SpanID() != h.SpanContext().SpanID() {
+		t.Error("connect is not a child of Handle")
+	}
+	if c.Status().Description != "refused" || h.Status().Description != "refused" {
+		t.Errorf("span status connect %+v Handle %+v", c.Status(), h.Status())
+	}
+}
+
+func TestStatementSpans(t *testing.T) {
+	ctx, span := tracer.Start(context.Background(), "Handle")
+	traceID := span.SpanContext().TraceID().String()
+	db := &fakeQuerier{}
+	db.returns("from customer", []interface{}{1}, []interface{}{2})
+	sl := statementLog{Querier: db, rl: &requestLog{ctx: ctx}}
+
+	_, err := sl.Exec(context.Background(), "update customer set email = $1", "pat@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	err = sl.QueryRow(context.Background(), "select count(*) from customer where phone = '5550102030'").Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	spans := spansOf(traceID)
+	for name, rows := range map[string]int64{"update customer": 0, "select customer": 1} {
+		s, ok := spans[name]
+		if !ok {
+			t.Fatalf("no %v span, got %v", name, spans)
+		}
+		if s.Parent().SpanID() != span.SpanContext().SpanID() || s.SpanKind() != trace.SpanKindClient {
+			t.Errorf("%v is not a client span of the request", name)
+		}
+		for _, a := range s.Attributes() {
+			if a.Key == "db.rows" && a.Value.AsInt64() != rows {
+				t.Errorf("%v has %v rows, want %v", name, a.Value.AsInt64(), rows)
+			}
+			if v := a.Value.Emit(); strings.Contains(v, "example.com") || strings.Contains(v, "5550102030") {
+				t.Errorf("%v carries the value %v", name, v)
+			}
+		}
+	}
+}
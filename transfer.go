@@ -0,0 +1,207 @@
+package function
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// participant_change is the audit trail of transfer_participant, the option
+// columns hold the option item names before and after the change
+type participant_change struct {
+	ChangeID      int       `json:"changeid"`
+	ParticipantID int       `json:"participantid"`
+	OldName       string    `json:"oldname"`
+	NewName       string    `json:"newname"`
+	OldOptions    []string  `json:"oldoptions"`
+	NewOptions    []string  `json:"newoptions"`
+	ChangedBy     string    `json:"changedby"`
+	ChangedAt     time.Time `json:"changedat"`
+}
+
+// scan reads a participant_change from a row of select *, as readall answers it
+func (p *participant_change) scan(rows pgx.Rows) error {
+	return rows.Scan(&p.ChangeID, &p.ParticipantID, &p.OldName, &p.NewName, &p.OldOptions, &p.NewOptions, &p.ChangedBy, &p.ChangedAt)
+}
+
+func (p *participant_change) readall(db Querier, table string) ([]participant_change, error) {
+	var pc participant_change
+	var pl []participant_change
+	query := fmt.Sprintf("select * from %v order by changedat", table)
+	rows, err := db.Query(context.Background(), query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := pc.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		pl = append(pl, pc)
+	}
+	return pl, nil
+}
+
+func (p *participant_change) read(db Querier, table, field, value string) ([]participant_change, error) {
+	var pc participant_change
+	var pl []participant_change
+	query := fmt.Sprintf("select * from %v where %v=$1 order by changedat", table, sanitizeColumn(field))
+	rows, err := db.Query(context.Background(), query, value)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		err := pc.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		pl = append(pl, pc)
+	}
+	return pl, nil
+}
+
+// transfer_participant request, an empty Name keeps the current golfer and
+// ShirtSize and Dexterity are option item ids like in golfer, empty ones
+// leave that selection unchanged. ChangedBy is not read from the body, Handle
+// sets it to the authenticated caller's email header.
+type transferParticipant struct {
+	ParticipantID string `json:"participantid"`
+	Name          string `json:"name"`
+	ShirtSize     string `json:"shirtsize"`
+	Dexterity     string `json:"dexterity"`
+	ChangedBy     string `json:"-"`
+}
+
+// transfer renames or replaces the participant on its purchase and swaps its
+// option selections, recording the change in participant_change, all in one
+// transaction
+func (t transferParticipant) transfer(db Querier) (participant_change, error) {
+	var pc participant_change
+
+	participantid, err := strconv.Atoi(t.ParticipantID)
+	if err != nil {
+		return pc, fmt.Errorf("transfer_participant: participantid: %v", err)
+	}
+	if t.ChangedBy == "" {
+		return pc, errors.New("transfer_participant: the caller's email header is required")
+	}
+
+	tx, err := db.Begin(context.Background())
+	if err != nil {
+		return pc, err
+	}
+	defer tx.Rollback(context.Background())
+
+	err = tx.QueryRow(context.Background(),
+		"select name from participant where participantid = $1 and cancelledat is null for update", participantid,
+	).Scan(&pc.OldName)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return pc, fmt.Errorf("transfer_participant: participant %v not found or cancelled", participantid)
+	case err != nil:
+		return pc, fmt.Errorf("transfer_participant participant: %v", err)
+	}
+
+	pc.OldOptions, err = participantOptionNames(tx, participantid)
+	if err != nil {
+		return pc, err
+	}
+
+	pc.NewName = pc.OldName
+	if t.Name != "" {
+		pc.NewName = t.Name
+		_, err = tx.Exec(context.Background(), "update participant set name = $1 where participantid = $2", t.Name, participantid)
+		if err != nil {
+			return pc, fmt.Errorf("transfer_participant name: %v", err)
+		}
+	}
+
+	if t.ShirtSize != "" {
+		err = replaceParticipantOption(tx, participantid, "T-Shirt", t.ShirtSize)
+		if err != nil {
+			return pc, err
+		}
+	}
+	if t.Dexterity != "" {
+		err = replaceParticipantOption(tx, participantid, "Dexterity", t.Dexterity)
+		if err != nil {
+			return pc, err
+		}
+	}
+
+	pc.NewOptions, err = participantOptionNames(tx, participantid)
+	if err != nil {
+		return pc, err
+	}
+
+	exec := fmt.Sprintf(`
+	insert into participant_change(participantid, oldname, newname, oldoptions, newoptions, changedby, changedat)
+	values ($1, $2, $3, $4, $5, $6, now()) returning changeid, participantid, changedby, changedat`)
+	err = tx.QueryRow(context.Background(), exec,
+		participantid, pc.OldName, pc.NewName, pc.OldOptions, pc.NewOptions, t.ChangedBy,
+	).Scan(&pc.ChangeID, &pc.ParticipantID, &pc.ChangedBy, &pc.ChangedAt)
+	if err != nil {
+		return pc, fmt.Errorf("transfer_participant participant_change: %v", err)
+	}
+
+	return pc, tx.Commit(context.Background())
+}
+
+// replaceParticipantOption swaps the participant's selection in category for
+// optionItemID, which has to belong to that category
+func replaceParticipantOption(tx pgx.Tx, participantid int, category, optionItemID string) error {
+	exec := fmt.Sprintf(`
+	delete from participant_option po
+	using option_item oi, category_option co
+	where po.participantid = $1
+	and oi.optionitemsid = po.optionitemsid
+	and co.categoryoptionsid = oi.categoryoptionsid
+	and co.name = $2`)
+	_, err := tx.Exec(context.Background(), exec, participantid, category)
+	if err != nil {
+		return fmt.Errorf("transfer_participant %v: %v", category, err)
+	}
+
+	exec = fmt.Sprintf(`
+	insert into participant_option(participantid, optionitemsid)
+	select $1, oi.optionitemsid
+	from option_item oi
+	inner join category_option co on co.categoryoptionsid = oi.categoryoptionsid
+	where oi.optionitemsid::text = $2 and co.name = $3`)
+	tag, err := tx.Exec(context.Background(), exec, participantid, optionItemID, category)
+	if err != nil {
+		return fmt.Errorf("transfer_participant %v: %v", category, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("transfer_participant: option %v is not a %v option", optionItemID, category)
+	}
+	return nil
+}
+
+func participantOptionNames(tx pgx.Tx, participantid int) ([]string, error) {
+	var names []string
+	exec := fmt.Sprintf(`
+	select oi.name
+	from participant_option po
+	inner join option_item oi on oi.optionitemsid = po.optionitemsid
+	where po.participantid = $1
+	order by oi.name`)
+	rows, err := tx.Query(context.Background(), exec, participantid)
+	if err != nil {
+		return nil, fmt.Errorf("transfer_participant options: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("transfer_participant options scan: %v", err)
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,282 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+	phonePattern = regexp.MustCompile(`^\+?[0-9 ().-]{7,20}$`)
+	moneyPattern = regexp.MustCompile(`^\$?[0-9]+(\.[0-9]{1,2})?$`)
+	datePattern  = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}`)
+)
+
+// rule declares the constraints of one field of a payload, the zero value of
+// a constraint leaves it unchecked
+type rule struct {
+	Field    string
+	Required bool
+	MinLen   int
+	MaxLen   int
+	Pattern  *regexp.Regexp
+	Enum     []string
+	Integer  bool
+	Min      *float64
+	Max      *float64
+	// Ref is a registeredTables table whose key has to hold the value
+	Ref string
+	// Count lists the allowed lengths of an array field
+	Count []int
+	// Each holds the rules of every object of an array field
+	Each []rule
+}
+
+func bound(f float64) *float64 { return &f }
+
+// golferRules apply to every golfer of a registration or waitlist entry,
+// shirtsize and dexterity are option_item ids
+var golferRules = []rule{
+	{Field: "name", Required: true, MinLen: 1, MaxLen: 100},
+	{Field: "shirtsize", Required: true, Ref: "option_item"},
+	{Field: "dexterity", Ref: "option_item"},
+}
+
+// validationRules are checked against create payloads by their json names
+// before any sql runs, entities without rules are not validated
+var validationRules = map[string][]rule{
+	"salesorder": {
+		{Field: "orderdate", Required: true, Pattern: datePattern},
+		{Field: "customerid", Required: true, Ref: "customer"},
+		{Field: "paymentid", Required: true, MaxLen: 255},
+	},
+	"participant": {
+		{Field: "purshaseid", Required: true, Ref: "purchase"},
+		{Field: "name", Required: true, MinLen: 1, MaxLen: 100},
+	},
+	"shopping_order": {
+		{Field: "orderdate", Required: true, Pattern: datePattern},
+		{Field: "sessionid", Required: true, MaxLen: 100},
+	},
+	"shopping_cart": {
+		{Field: "shoppingorderid", Required: true, Ref: "shopping_order"},
+		{Field: "pricingid", Required: true, Ref: "pricing"},
+		{Field: "qty", Required: true, Integer: true, Min: bound(1), Max: bound(100)},
+		{Field: "couponcode", MaxLen: 50},
+	},
+	"cart_participant": {
+		{Field: "shoppingcartid", Required: true, Ref: "shopping_cart"},
+		{Field: "name", Required: true, MinLen: 1, MaxLen: 100},
+	},
+	"cart_participant_option": {
+		{Field: "cartparticipantid", Required: true, Ref: "cart_participant"},
+		{Field: "optionitemsid", Required: true, Ref: "option_item"},
+	},
+	"registration": {
+		{Field: "orderdate", Required: true, Pattern: datePattern},
+		{Field: "sessionid", Required: true, MaxLen: 100},
+		{Field: "pricingid", Required: true, Ref: "pricing"},
+		{Field: "couponcode", MaxLen: 50},
+		{Field: "golferinfo", Required: true, Count: []int{1, 2, 4}, Each: golferRules},
+	},
+	"waitlist": {
+		{Field: "pricingid", Required: true, Ref: "pricing"},
+		{Field: "name", Required: true, MinLen: 1, MaxLen: 100},
+		{Field: "email", Required: true, Pattern: emailPattern},
+		{Field: "phone", Pattern: phonePattern},
+		{Field: "golferinfo", Required: true, Count: []int{1, 2, 4}, Each: golferRules},
+	},
+	"pricing_rule": {
+		{Field: "pricingid", Required: true, Ref: "pricing"},
+		{Field: "name", Required: true, MinLen: 1, MaxLen: 100},
+		{Field: "price", Required: true, Pattern: moneyPattern},
+		{Field: "minqty", Integer: true, Min: bound(0)},
+		{Field: "maxuses", Integer: true, Min: bound(1)},
+	},
+}
+
+// validationErrors maps each invalid field to what is wrong with it, its
+// Error is the map as json so it can be returned as the response body
+type validationErrors map[string]string
+
+func (v validationErrors) Error() string {
+	b, _ := json.Marshal(map[string]string(v))
+	return string(b)
+}
+
+// validate checks payload, a struct or raw json, against the rules of entity
+// and returns every violation together as validationErrors
+func validate(db Querier, entity string, payload interface{}) error {
+	rules, ok := validationRules[strings.ToLower(entity)]
+	if !ok {
+		return nil
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("validate %v: %v", entity, err)
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return fmt.Errorf("validate %v: %v", entity, err)
+	}
+
+	errs := validationErrors{}
+	err = checkRules(db, rules, m, "", errs)
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func checkRules(db Querier, rules []rule, m map[string]interface{}, prefix string, errs validationErrors) error {
+	for _, r := range rules {
+		name := prefix + r.Field
+		msg, err := r.check(db, name, m[r.Field], errs)
+		if err != nil {
+			return err
+		}
+		if msg != "" {
+			errs[name] = msg
+		}
+	}
+	return nil
+}
+
+// checkCount checks n items of field against the Count of entity's rule, for
+// creates that do not go through validate like waitlist promotions
+func checkCount(entity, field string, n int) error {
+	for _, r := range validationRules[entity] {
+		if r.Field == field && len(r.Count) > 0 && !containsInt(r.Count, n) {
+			return validationErrors{field: fmt.Sprintf("must have %v items", joinInts(r.Count))}
+		}
+	}
+	return nil
+}
+
+// check returns the violation of value, if any. Violations of the objects of
+// an array are added to errs under name[i].field.
+func (r rule) check(db Querier, name string, value interface{}, errs validationErrors) (string, error) {
+	if items, ok := value.([]interface{}); ok {
+		if len(r.Count) > 0 && !containsInt(r.Count, len(items)) {
+			return fmt.Sprintf("must have %v items", joinInts(r.Count)), nil
+		}
+		for i, item := range items {
+			obj, ok := item.(map[string]interface{})
+			if !ok {
+				return "must be a list of objects", nil
+			}
+			err := checkRules(db, r.Each, obj, fmt.Sprintf("%v[%d].", name, i), errs)
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+
+	var s string
+	switch v := value.(type) {
+	case nil:
+	case string:
+		s = strings.TrimSpace(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		s = strconv.FormatBool(v)
+	default:
+		return "must be a single value", nil
+	}
+	if s == "" {
+		if r.Required {
+			return "is required", nil
+		}
+		return "", nil
+	}
+	if len(r.Count) > 0 {
+		return "must be a list", nil
+	}
+
+	if n := utf8.RuneCountInString(s); r.MinLen > 0 && n < r.MinLen {
+		return fmt.Sprintf("must be at least %d characters", r.MinLen), nil
+	}
+	if n := utf8.RuneCountInString(s); r.MaxLen > 0 && n > r.MaxLen {
+		return fmt.Sprintf("must be at most %d characters", r.MaxLen), nil
+	}
+	if r.Pattern != nil && !r.Pattern.MatchString(s) {
+		return "is malformed", nil
+	}
+	if len(r.Enum) > 0 && !containsString(r.Enum, s) {
+		return fmt.Sprintf("must be one of %v", strings.Join(r.Enum, ", ")), nil
+	}
+	if r.Integer || r.Min != nil || r.Max != nil {
+		f, err := strconv.ParseFloat(s, 64)
+		switch {
+		case err != nil:
+			return "must be a number", nil
+		case r.Integer && f != float64(int64(f)):
+			return "must be a whole number", nil
+		case r.Min != nil && f < *r.Min:
+			return fmt.Sprintf("must be at least %v", *r.Min), nil
+		case r.Max != nil && f > *r.Max:
+			return fmt.Sprintf("must be at most %v", *r.Max), nil
+		}
+	}
+	if r.Ref != "" {
+		rt, ok := registeredTables[r.Ref]
+		if !ok {
+			return "", fmt.Errorf("validate %v: unknown table %v", name, r.Ref)
+		}
+		query := fmt.Sprintf("select exists(select 1 from %v where %v::text = $1", r.Ref, rt.key)
+		if softDeleteTables[r.Ref] {
+			query += " and " + deletedFilter(false)
+		}
+		query += ")"
+		var exists bool
+		err := db.QueryRow(context.Background(), query, s).Scan(&exists)
+		if err != nil {
+			return "", fmt.Errorf("validate %v: %v", name, err)
+		}
+		if !exists {
+			return fmt.Sprintf("%v %v does not exist", r.Ref, s), nil
+		}
+	}
+	return "", nil
+}
+
+func containsInt(l []int, i int) bool {
+	for _, v := range l {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// joinInts lists l as "1, 2 or 4"
+func joinInts(l []int) string {
+	s := make([]string, len(l))
+	for i, v := range l {
+		s[i] = strconv.Itoa(v)
+	}
+	if len(s) < 2 {
+		return strings.Join(s, "")
+	}
+	return strings.Join(s[:len(s)-1], ", ") + " or " + s[len(s)-1]
+}
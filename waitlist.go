@@ -0,0 +1,239 @@
+package function
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// waitlist entry statuses, an entry starts waiting, is promoted into a
+// shopping order once a seat frees up and expires if that order is not paid
+// within waitlist_claim_ttl
+const (
+	waitlistWaiting  = "waiting"
+	waitlistPromoted = "promoted"
+	waitlistExpired  = "expired"
+)
+
+// errEventOpen is returned when joining the waitlist of an event that still
+// has places, or no capacity at all, the golfers can register instead
+var errEventOpen = errors.New("waitlist: the event is not sold out, register instead")
+
+// defaultWaitlistClaimTTL is used when waitlist_claim_ttl is not set
+const defaultWaitlistClaimTTL = 24 * time.Hour
+
+type waitlist struct {
+	WaitlistID      int        `json:"waitlistid"`
+	EventID         int        `json:"eventid"`
+	PricingID       string     `json:"pricingid"`
+	Name            string     `json:"name"`
+	Email           string     `json:"email"`
+	Phone           string     `json:"phone"`
+	GolferInfo      []golfer   `json:"golferinfo"`
+	Status          string     `json:"status"`
+	Position        int        `json:"position"`
+	JoinedAt        time.Time  `json:"joinedat"`
+	PromotedAt      *time.Time `json:"promotedat,omitempty"`
+	SessionID       *string    `json:"sessionid,omitempty"`
+	ShoppingOrderID *int       `json:"shoppingorderid,omitempty"`
+}
+
+// waitlistQuery selects every entry with its position in its event's queue,
+// callers add the where and order by
+const waitlistQuery = `
+	select * from (
+			select waitlistid, eventid, pricingid, name, email, phone, golferinfo,
+					status, case when status = 'waiting' then
+							row_number() over (partition by eventid, status order by joinedat, waitlistid)
+					else 0 end as position,
+					joinedat, promotedat, sessionid, shoppingorderid
+			from waitlist
+	) w`
+
+// create adds the customer and their golfers to the end of the waitlist of
+// the event sold by PricingID and returns the new waitlistid, only sold out
+// events take waitlist entries
+func (w waitlist) create(db Querier, table string) (int, error) {
+	eventID, err := eventForPricing(db, w.PricingID)
+	if err != nil {
+		return 0, fmt.Errorf("waitlist event: %v", err)
+	}
+	el, err := getEventCapacities(db, "e.eventid = $1", eventID)
+	if err != nil {
+		return 0, err
+	}
+	if len(el) != 1 || el[0].Capacity == 0 || el[0].Remaining > 0 {
+		return 0, errEventOpen
+	}
+
+	golferInfo, err := json.Marshal(w.GolferInfo)
+	if err != nil {
+		return 0, err
+	}
+
+	var waitlistid int
+	exec := fmt.Sprintf(`
+	insert into %v(eventid, pricingid, name, email, phone, golferinfo, status, joinedat)
+	values ($1, $2, $3, $4, $5, $6, $7, now()) returning waitlistid`, table)
+	err = db.QueryRow(context.Background(), exec,
+		eventID, w.PricingID, w.Name, w.Email, w.Phone, golferInfo, waitlistWaiting,
+	).Scan(&waitlistid)
+	return waitlistid, err
+}
+
+func (w *waitlist) readall(db Querier) ([]waitlist, error) {
+	return queryWaitlist(db, waitlistQuery+" order by eventid, status desc, position, joinedat")
+}
+
+func (w *waitlist) read(db Querier, field, value string) ([]waitlist, error) {
+	query := fmt.Sprintf(waitlistQuery+" where %v=$1 order by eventid, status desc, position, joinedat", sanitizeColumn(field))
+	return queryWaitlist(db, query, value)
+}
+
+func queryWaitlist(db Querier, query string, args ...interface{}) ([]waitlist, error) {
+	var wl []waitlist
+	rows, err := db.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var w waitlist
+		err := w.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		wl = append(wl, w)
+	}
+	return wl, rows.Err()
+}
+
+// scan reads a waitlist entry from a row of waitlistQuery
+func (w *waitlist) scan(rows pgx.Rows) error {
+	var golferInfo []byte
+	err := rows.Scan(&w.WaitlistID, &w.EventID, &w.PricingID, &w.Name, &w.Email, &w.Phone, &golferInfo,
+		&w.Status, &w.Position, &w.JoinedAt, &w.PromotedAt, &w.SessionID, &w.ShoppingOrderID)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(golferInfo, &w.GolferInfo)
+	if err != nil {
+		return fmt.Errorf("waitlist golferinfo: %v", err)
+	}
+	return nil
+}
+
+// promoteWaitlist moves the first waiting entry of eventID into a new
+// shopping order, built by registration.create so the customer only has to
+// pay for it. It returns nil when nobody is waiting or the next entry does
+// not fit in the remaining capacity.
+func promoteWaitlist(db Querier, eventID int) (*waitlist, error) {
+	// hold the event lock for the whole promotion so two promotions cannot
+	// pick the same entry, registration.create takes it again which postgres
+	// allows within the same session
+	_, err := db.Exec(context.Background(), "select pg_advisory_lock($1, $2)", eventLockClass, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("promoteWaitlist lock err: %v", err)
+	}
+	defer db.Exec(context.Background(), "select pg_advisory_unlock($1, $2)", eventLockClass, eventID)
+
+	wl, err := queryWaitlist(db, waitlistQuery+" where eventid=$1 and status=$2 order by position limit 1", eventID, waitlistWaiting)
+	if err != nil {
+		return nil, fmt.Errorf("promoteWaitlist: %v", err)
+	}
+	if len(wl) == 0 {
+		return nil, nil
+	}
+	w := wl[0]
+
+	sessionID, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	r := registration{
+		OrderDate:  time.Now().Format(time.RFC3339),
+		SessionID:  sessionID.String(),
+		PricingID:  w.PricingID,
+		GolferInfo: w.GolferInfo,
+	}
+	shoppingorderid, err := r.create(db)
+	switch {
+	case errors.Is(err, errEventFull):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("promoteWaitlist registration: %v", err)
+	}
+
+	exec := fmt.Sprintf(`
+	update waitlist set status = $1, promotedat = now(), sessionid = $2, shoppingorderid = $3
+	where waitlistid = $4 returning promotedat`)
+	err = db.QueryRow(context.Background(), exec, waitlistPromoted, r.SessionID, shoppingorderid, w.WaitlistID).Scan(&w.PromotedAt)
+	if err != nil {
+		return nil, fmt.Errorf("promoteWaitlist update: %v", err)
+	}
+	w.Status = waitlistPromoted
+	w.Position = 0
+	w.SessionID = &r.SessionID
+	w.ShoppingOrderID = &shoppingorderid
+	return &w, nil
+}
+
+type waitlistExpiry struct {
+	Expired  int        `json:"expired"`
+	Promoted []waitlist `json:"promoted"`
+}
+
+// expireWaitlist gives up on promotions whose shopping order was not checked
+// out within ttl, removing the order and promoting the next entry in its place
+func expireWaitlist(db Querier, ttl time.Duration) (waitlistExpiry, error) {
+	var we waitlistExpiry
+
+	exec := fmt.Sprintf(`
+	select w.waitlistid, w.eventid, w.shoppingorderid
+	from waitlist w
+	where w.status = $1 and w.promotedat < $2
+	and not exists (select 1 from salesorder s where s.salesorderid = w.shoppingorderid)`)
+	rows, err := db.Query(context.Background(), exec, waitlistPromoted, time.Now().Add(-ttl))
+	if err != nil {
+		return we, fmt.Errorf("expireWaitlist query err: %v", err)
+	}
+	var expired []waitlist
+	for rows.Next() {
+		var w waitlist
+		err := rows.Scan(&w.WaitlistID, &w.EventID, &w.ShoppingOrderID)
+		if err != nil {
+			rows.Close()
+			return we, fmt.Errorf("expireWaitlist scan err: %v", err)
+		}
+		expired = append(expired, w)
+	}
+	rows.Close()
+
+	for _, w := range expired {
+		if w.ShoppingOrderID != nil {
+			_, err := deleteRows(db, "shopping_order", "shoppingorderid", []string{fmt.Sprint(*w.ShoppingOrderID)}, false)
+			if err != nil {
+				return we, fmt.Errorf("expireWaitlist: %v", err)
+			}
+		}
+		_, err = db.Exec(context.Background(), "update waitlist set status = $1 where waitlistid = $2", waitlistExpired, w.WaitlistID)
+		if err != nil {
+			return we, fmt.Errorf("expireWaitlist update: %v", err)
+		}
+		we.Expired++
+
+		p, err := promoteWaitlist(db, w.EventID)
+		if err != nil {
+			return we, err
+		}
+		if p != nil {
+			we.Promoted = append(we.Promoted, *p)
+		}
+	}
+	return we, nil
+}